@@ -0,0 +1,108 @@
+package adasync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// State files are written with a trailing checksum so a partial write (like a
+// drive being pulled) can be detected when they're read back. They're written
+// to a temp file and renamed into place so the old file is never truncated.
+
+const checksumMagic = "ADAS"
+
+const checksumLen = len(checksumMagic) + md5.Size
+
+var (
+	ErrNoChecksum  = errors.New("File does not have a checksum")
+	ErrBadChecksum = errors.New("Checksum did not match")
+)
+
+func withChecksum(data []byte) []byte {
+	sum := md5.Sum(data)
+	out := make([]byte, 0, len(data)+checksumLen)
+	out = append(out, data...)
+	out = append(out, checksumMagic...)
+	return append(out, sum[:]...)
+}
+
+// verifyChecksum checks the trailing checksum and returns the data without it.
+// If there is no checksum, ErrNoChecksum is returned along with all the data,
+// files written before checksums were added won't have one.
+func verifyChecksum(buf []byte) ([]byte, error) {
+	l := len(buf) - checksumLen
+	if l < 0 || string(buf[l:l+len(checksumMagic)]) != checksumMagic {
+		return buf, ErrNoChecksum
+	}
+	data := buf[:l]
+	sum := md5.Sum(data)
+	if !bytes.Equal(sum[:], buf[l+len(checksumMagic):]) {
+		return nil, ErrBadChecksum
+	}
+	return data, nil
+}
+
+// tmpName keeps the .collection ending so a temp file left behind by a crash
+// is still ignored when scanning.
+func tmpName(pathStr string) string {
+	dir, name := filepath.Split(pathStr)
+	return dir + ".tmp" + name
+}
+
+// writeAtomic writes data to a temp file, syncs it and then renames it over
+// pathStr. If prev is not empty, the current file is kept there.
+func writeAtomic(pathStr string, data []byte, prev string) error {
+	tmp := tmpName(pathStr)
+	f, e := filesystem.Create(tmp)
+	if e != nil {
+		return e
+	}
+	if _, e = f.Write(data); e == nil {
+		e = f.Sync()
+	}
+	f.Close()
+	if e != nil {
+		filesystem.RemoveAll(tmp)
+		return e
+	}
+	if prev != "" {
+		if _, e := filesystem.Stat(pathStr); e == nil {
+			if e := filesystem.Rename(pathStr, prev); e != nil {
+				return e
+			}
+		}
+	}
+	return filesystem.Rename(tmp, pathStr)
+}
+
+func readFile(pathStr string) ([]byte, error) {
+	f, e := filesystem.Open(pathStr)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// readTag returns the directory ID in a tag file
+func readTag(pathStr string) (*Hash, error) {
+	if !keepsTags(pathStr) {
+		return nil, os.ErrNotExist
+	}
+	buf, e := readFile(pathStr)
+	if e != nil {
+		return nil, e
+	}
+	data, e := verifyChecksum(buf)
+	if e != nil && e != ErrNoChecksum {
+		return nil, e
+	}
+	if len(data) != md5.Size {
+		return nil, errors.New("Bad tag file: " + pathStr)
+	}
+	return HashFromBytes(data), nil
+}
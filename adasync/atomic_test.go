@@ -0,0 +1,129 @@
+package adasync
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	data := []byte("this is a test")
+	buf := withChecksum(data)
+	got, e := verifyChecksum(buf)
+	if e != nil || string(got) != string(data) {
+		t.Error("Checksum did not verify")
+	}
+
+	buf[3] = 'X'
+	if _, e := verifyChecksum(buf); e != ErrBadChecksum {
+		t.Error("Expected ErrBadChecksum, got: ", e)
+	}
+
+	if got, e := verifyChecksum(data); e != ErrNoChecksum || string(got) != string(data) {
+		t.Error("Expected ErrNoChecksum and the original data")
+	}
+
+	short := withChecksum(data)
+	short = short[:len(short)-1]
+	if _, e := verifyChecksum(short); e == nil {
+		t.Error("Truncated file should not verify")
+	}
+}
+
+func TestTmpName(t *testing.T) {
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{
+			input:  "/foo/.collection",
+			expect: "/foo/.tmp.collection",
+		}, {
+			input:  "/foo/bar/.tag.collection",
+			expect: "/foo/bar/.tmp.tag.collection",
+		},
+	}
+	for _, test := range tests {
+		if got := tmpName(test.input); got != test.expect {
+			t.Error("Expected: " + test.expect + " Got: " + got)
+		}
+	}
+}
+
+func TestWriteAtomic(t *testing.T) {
+	tmp := tempInstanceDir(t)
+	pathStr, prev := tmp+"/.collection", tmp+"/.prev.collection"
+
+	if e := writeAtomic(pathStr, []byte("one"), prev); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := os.Stat(prev); !os.IsNotExist(e) {
+		t.Error("Nothing should be kept before the first write")
+	}
+	if e := writeAtomic(pathStr, []byte("two"), prev); e != nil {
+		t.Fatal(e)
+	}
+	if buf, _ := ioutil.ReadFile(pathStr); string(buf) != "two" {
+		t.Error("Expected new contents, got: ", string(buf))
+	}
+	if buf, _ := ioutil.ReadFile(prev); string(buf) != "one" {
+		t.Error("Expected previous contents to be kept, got: ", string(buf))
+	}
+	if _, e := os.Stat(tmpName(pathStr)); !os.IsNotExist(e) {
+		t.Error("Temp file should be renamed into place")
+	}
+
+	// without prev the old file is replaced
+	writeAtomic(pathStr, []byte("three"), "")
+	if buf, _ := ioutil.ReadFile(prev); string(buf) != "one" {
+		t.Error("Previous should not rotate without prev")
+	}
+}
+
+func TestLoadInstanceFallback(t *testing.T) {
+	tmp := tempInstanceDir(t, "/a")
+	a, e := Init(tmp+"/a", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	ioutil.WriteFile(tmp+"/a/song.mp3", []byte("song"), 0600)
+	a.SelfUpdate()
+	a.Write()
+	good, _ := ioutil.ReadFile(tmp + "/a/.collection")
+	// the open instance would be returned instead of what's on disk
+	load := func() (*Instance, error) {
+		delete(collections, a.CollectionId())
+		return loadInstance(tmp + "/a")
+	}
+
+	ins, e := load()
+	if e != nil || ins.dirty || len(ins.resources) != 1 {
+		t.Fatal("Expected the current state: ", e)
+	}
+
+	badChecksum := append([]byte{}, good...)
+	badChecksum[len(badChecksum)/2] ^= 0xff
+	damaged := map[string][]byte{
+		"truncated":    good[:len(good)/2],
+		"bad checksum": badChecksum,
+	}
+	for name, buf := range damaged {
+		ioutil.WriteFile(tmp+"/a/.collection", buf, 0600)
+		ins, e := load()
+		if e != nil {
+			t.Error(name, ": expected fallback, got ", e)
+			continue
+		}
+		if len(ins.resources) != 0 {
+			t.Error(name, ": expected the previous state")
+		}
+		if !ins.dirty {
+			t.Error(name, ": instance should be marked to be rewritten")
+		}
+	}
+
+	os.Remove(tmp + "/a/.prev.collection")
+	if _, e := load(); e == nil {
+		t.Error("Expected an error with nothing to fall back to")
+	}
+}
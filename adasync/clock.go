@@ -0,0 +1,135 @@
+package adasync
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Clock is a vector clock keyed by instance ID. Every PathNode carries one,
+// when an instance adds a node to a resource's history, the clock is copied
+// from the previous node and the count for that instance is incremented. So
+// comparing the clocks on two nodes tells us if one change was made knowing
+// about the other, or if they happened concurrently on different instances.
+type Clock map[string]uint64
+
+const (
+	ClockEqual = iota
+	ClockBefore
+	ClockAfter
+	ClockConcurrent
+)
+
+// Compare returns ClockBefore if a happened before b, ClockAfter if a happened
+// after b, ClockConcurrent if neither knew about the other and ClockEqual if
+// they are the same.
+func (a Clock) Compare(b Clock) int {
+	aAhead := false
+	bAhead := false
+	for id, ac := range a {
+		if bc := b[id]; ac > bc {
+			aAhead = true
+		} else if ac < bc {
+			bAhead = true
+		}
+	}
+	for id, bc := range b {
+		if _, ok := a[id]; !ok && bc > 0 {
+			bAhead = true
+		}
+	}
+	switch {
+	case aAhead && bAhead:
+		return ClockConcurrent
+	case aAhead:
+		return ClockAfter
+	case bAhead:
+		return ClockBefore
+	}
+	return ClockEqual
+}
+
+// tick returns a copy of the clock with the count for id incremented
+func (c Clock) tick(id *Hash) Clock {
+	cp := make(Clock, len(c)+1)
+	for k, v := range c {
+		cp[k] = v
+	}
+	if id != nil {
+		cp[id.String()]++
+	}
+	return cp
+}
+
+func (c Clock) sum() uint64 {
+	s := uint64(0)
+	for _, v := range c {
+		s += v
+	}
+	return s
+}
+
+// less gives concurrent clocks an order that will be the same on every
+// instance; more changes wins, then it falls back to comparing the clocks.
+func (a Clock) less(b Clock) bool {
+	if sa, sb := a.sum(), b.sum(); sa != sb {
+		return sa < sb
+	}
+	return a.String() < b.String()
+}
+
+func (c Clock) String() string {
+	ids := make([]string, 0, len(c))
+	for id := range c {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	str := "{"
+	for i, id := range ids {
+		if i > 0 {
+			str += ", "
+		}
+		str += id + ":" + strconv.FormatUint(c[id], 10)
+	}
+	return str + "}"
+}
+
+// Record adds nodes to the history as new changes made by the instance the
+// node belongs to, at the current time. Use Add for nodes that are copies of another history.
+func (pns *PathNodes) Record(pn ...*PathNode) {
+	for _, n := range pn {
+		var prev Clock
+		if last := pns.Last(); last != nil {
+			prev = last.Clock
+		}
+		var id *Hash
+		if n.Instance != nil {
+			id = n.Instance.id
+		}
+		n.Clock = prev.tick(id)
+		n.Time = now().UnixNano()
+		pns.Add(n)
+	}
+}
+
+func (c Clock) marshal() []*SerialClockEntry {
+	sc := make([]*SerialClockEntry, 0, len(c))
+	for idStr, count := range c {
+		id, e := DecodeHash(idStr)
+		if e != nil {
+			continue
+		}
+		sc = append(sc, &SerialClockEntry{
+			Instance: id[:],
+			Count:    count,
+		})
+	}
+	return sc
+}
+
+func unmarshalClock(sc []*SerialClockEntry) Clock {
+	c := make(Clock, len(sc))
+	for _, entry := range sc {
+		c[HashFromBytes(entry.Instance).String()] = entry.Count
+	}
+	return c
+}
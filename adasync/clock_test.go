@@ -0,0 +1,75 @@
+package adasync
+
+import (
+	"testing"
+)
+
+func TestClockCompare(t *testing.T) {
+	tests := []struct {
+		a, b   Clock
+		expect int
+	}{
+		{a: Clock{}, b: Clock{}, expect: ClockEqual},
+		{a: Clock{"a": 1}, b: Clock{"a": 1}, expect: ClockEqual},
+		{a: Clock{"a": 1}, b: Clock{"a": 2}, expect: ClockBefore},
+		{a: Clock{"a": 2, "b": 1}, b: Clock{"a": 2}, expect: ClockAfter},
+		{a: Clock{}, b: Clock{"b": 1}, expect: ClockBefore},
+		{a: Clock{"a": 2, "b": 1}, b: Clock{"a": 1, "b": 2}, expect: ClockConcurrent},
+		{a: Clock{"a": 1}, b: Clock{"b": 1}, expect: ClockConcurrent},
+	}
+	for _, test := range tests {
+		if got := test.a.Compare(test.b); got != test.expect {
+			t.Error("Expected: ", test.expect, " Got: ", got, " for ", test.a, test.b)
+		}
+	}
+}
+
+func TestClockLess(t *testing.T) {
+	a := Clock{"a": 1}
+	b := Clock{"b": 1}
+	if a.less(b) == b.less(a) {
+		t.Error("Concurrent clocks should have a consistent order")
+	}
+	if !a.less(Clock{"b": 2}) {
+		t.Error("More changes should win")
+	}
+}
+
+func TestRecord(t *testing.T) {
+	c := New()
+	a := c.AddInstance("/a")
+	b := c.AddInstance("/b")
+	pns := &PathNodes{}
+	pns.Record(a.PathNode(a.root, "foo"))
+	pns.Record(b.PathNode(b.root, "bar"), b.PathNode(b.root, "baz"))
+	clock := pns.Last().Clock
+	if clock[a.id.String()] != 1 || clock[b.id.String()] != 2 {
+		t.Error("Incorrect clock: ", clock)
+	}
+	if pns.nodes[0].Clock.Compare(clock) != ClockBefore {
+		t.Error("Expected earlier node to be before the last")
+	}
+}
+
+func TestResolveConcurrent(t *testing.T) {
+	c := New()
+	a := c.AddInstance("/a")
+	b := c.AddInstance("/b")
+	id := HashFromBytes([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	resA := &Resource{ID: id, PathNodes: &PathNodes{}}
+	resA.PathNodes.Record(a.PathNode(a.root, "foo"))
+	resB := &Resource{ID: id, PathNodes: resA.PathNodes.clone(b)}
+
+	resA.PathNodes.Record(a.PathNode(a.root, "bar"))
+	resB.PathNodes.Record(b.PathNode(b.root, "baz"))
+	ab := resolveDifference(resA, resB, 1)
+	ba := resolveDifference(resB, resA, 1)
+	if (ab == MV_A2B) != (ba == MV_B2A) {
+		t.Error("Concurrent moves should resolve the same way regardless of order")
+	}
+
+	resB.PathNodes.Record(b.PathNodeFromHash(nil, ".deleted"))
+	if got := resolveDifference(resA, resB, 1); got != CP_A2B {
+		t.Error("Concurrent move should win over delete, got: ", got)
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"github.com/adamcolton/fs"
 )
 
-var filesystem = fs.Std
+var filesystem fs.FileSystem = newRouter(fs.Std)
 
 var Settings = map[string]string{}
 
@@ -37,11 +37,16 @@ func New(id ...byte) *Collection {
 func (c *Collection) AddInstance(pathStr string) *Instance {
 	pathStr = toSlash(pathStr)
 	ins := &Instance{
+		id:          newInstanceId(),
 		collection:  c,
 		pathStr:     pathStr,
 		resources:   make(map[string]*Resource),
 		directories: make(map[string]*Directory),
 		settings:    make(map[string]string),
+		trash:       make(map[string]*TrashEntry),
+		registry:    make(map[string]*InstanceInfo),
+		forgotten:   make(map[string]*Hash),
+		tombstones:  make(map[string]map[string]*Hash),
 		isNew:       true,
 	}
 	hash := &Hash{}
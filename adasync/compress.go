@@ -0,0 +1,118 @@
+package adasync
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"github.com/adamcolton/fs"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+/*
+An instance with "compress: true" keeps the files copied to it gzipped, with a
+marker and the plain size in front. The names don't change and the hashes are
+of the plain contents, so it syncs with any other instance and files are
+uncompressed as they're copied out of it. Files that are already compressed,
+like photos, music and video, are copied as they are. Anything put in the
+instance by hand isn't compressed until it's copied in by a sync, and turning
+the setting off leaves what's there compressed, it can still be read.
+*/
+
+const (
+	compressMagic     = "\x00ADAGZ\x00\x01"
+	compressHeaderLen = len(compressMagic) + 8
+)
+
+var ErrCompressSize = errors.New("Size changed while compressing")
+
+// compressedExts won't get any smaller
+var compressedExts = map[string]bool{
+	"jpg": true, "jpeg": true, "png": true, "gif": true, "webp": true,
+	"heic": true, "heif": true, "avif": true,
+	"mp3": true, "m4a": true, "aac": true, "ogg": true, "opus": true,
+	"flac": true, "wma": true,
+	"mp4": true, "m4v": true, "mkv": true, "mov": true, "avi": true,
+	"webm": true, "wmv": true,
+	"zip": true, "gz": true, "tgz": true, "bz2": true, "xz": true,
+	"zst": true, "7z": true, "rar": true, "jar": true, "apk": true,
+	"docx": true, "xlsx": true, "pptx": true, "odt": true, "epub": true,
+}
+
+// compresses is true if a file with name should be compressed when it's
+// copied to ins.
+func (ins *Instance) compresses(name string) bool {
+	if ins.GetSetting("compress") != "true" {
+		return false
+	}
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	return !compressedExts[ext]
+}
+
+// readContents gives the plain contents of f and their size. If f isn't
+// compressed it's returned as it is.
+func readContents(f fs.File) (io.Reader, int64, error) {
+	fi, e := f.Stat()
+	if e != nil {
+		return nil, 0, e
+	}
+	if fi.IsDir() || fi.Size() < int64(compressHeaderLen) {
+		return f, fi.Size(), nil
+	}
+	header := make([]byte, compressHeaderLen)
+	if _, e := io.ReadFull(f, header); e != nil {
+		return nil, 0, e
+	}
+	if string(header[:len(compressMagic)]) != compressMagic {
+		_, e := f.Seek(0, io.SeekStart)
+		return f, fi.Size(), e
+	}
+	zr, e := gzip.NewReader(f)
+	if e != nil {
+		return nil, 0, e
+	}
+	return zr, int64(binary.BigEndian.Uint64(header[len(compressMagic):])), nil
+}
+
+// contentSize is the plain size of the file at pathStr.
+func contentSize(pathStr string, fi os.FileInfo) int64 {
+	if fi.IsDir() || fi.Size() < int64(compressHeaderLen) {
+		return fi.Size()
+	}
+	f, e := filesystem.Open(pathStr)
+	if e != nil {
+		return fi.Size()
+	}
+	defer f.Close()
+	_, size, e := readContents(f)
+	if e != nil {
+		return fi.Size()
+	}
+	return size
+}
+
+// writeContents copies size bytes from src to dst, compressing them if a file
+// with name is compressed in ins.
+func (ins *Instance) writeContents(dst io.Writer, src io.Reader, size int64, name string) error {
+	if !ins.compresses(name) {
+		_, e := io.Copy(dst, src)
+		return e
+	}
+	header := make([]byte, compressHeaderLen)
+	copy(header, compressMagic)
+	binary.BigEndian.PutUint64(header[len(compressMagic):], uint64(size))
+	if _, e := dst.Write(header); e != nil {
+		return e
+	}
+	zw := gzip.NewWriter(dst)
+	n, e := io.Copy(zw, src)
+	if e2 := zw.Close(); e == nil {
+		e = e2
+	}
+	if e == nil && n != size {
+		e = ErrCompressSize
+	}
+	return e
+}
@@ -0,0 +1,62 @@
+package adasync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCompressedInstance(t *testing.T) {
+	tmp := tempInstanceDir(t, "/a/docs", "/backup", "/c")
+	text := []byte(strings.Repeat("all work and no play makes jack a dull boy\n", 1000))
+	ioutil.WriteFile(tmp+"/a/docs/notes.txt", text, 0600)
+	ioutil.WriteFile(tmp+"/a/docs/photo.jpg", text, 0600)
+
+	a, e := Init(tmp+"/a", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	backup, e := Init(tmp+"/backup", a.CollectionId())
+	if e != nil {
+		t.Fatal(e)
+	}
+	backup.settings["compress"] = "true"
+	backup.settings["static"] = "false"
+	SyncInstances(a, backup)
+
+	buf, _ := ioutil.ReadFile(tmp + "/backup/docs/notes.txt")
+	if !bytes.HasPrefix(buf, []byte(compressMagic)) || len(buf) >= len(text) {
+		t.Error("Expected notes to be compressed: ", len(buf))
+	}
+	if buf, _ := ioutil.ReadFile(tmp + "/backup/docs/photo.jpg"); !bytes.Equal(buf, text) {
+		t.Error("Expected photo to be copied as it is")
+	}
+	for id, res := range a.resources {
+		if other, ok := backup.resources[id]; !ok || !other.Hash.Equal(res.Hash) || other.Size != res.Size {
+			t.Error("Expected the same hash and size on both instances")
+		}
+	}
+
+	// a rescan doesn't see a change
+	count, histories := len(backup.resources), 0
+	for _, res := range backup.resources {
+		histories += res.PathNodes.Len()
+	}
+	backup.SelfUpdate()
+	for _, res := range backup.resources {
+		histories -= res.PathNodes.Len()
+	}
+	if len(backup.resources) != count || histories != 0 {
+		t.Error("Compressed files shouldn't look changed")
+	}
+
+	c, e := Init(tmp+"/c", a.CollectionId())
+	if e != nil {
+		t.Fatal(e)
+	}
+	SyncInstances(backup, c)
+	if buf, e := ioutil.ReadFile(tmp + "/c/docs/notes.txt"); e != nil || !bytes.Equal(buf, text) {
+		t.Error("Expected notes to be uncompressed when copied out")
+	}
+}
@@ -0,0 +1,666 @@
+package adasync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/adamcolton/fs"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+An encrypted instance has a plain ".crypt.collection" file at it's root with
+the collection id, everything else is encrypted with the collection's key.
+The key is kept in the "collection keys" directory, it has to be copied to any
+machine that should be able to open the instance.
+
+Everything goes through cryptFS, which is put in front of the root when the
+instance is opened, so the rest of AdaSync only sees plain names and contents.
+That means the hashes are of the plain contents and an encrypted instance
+syncs with a plain one like any other.
+
+Each part of a path is sealed with AES-GCM using a nonce made from the name,
+so the same name always encrypts the same way and a path can be found without
+reading the directory. It's base32 so it's safe on filesystems that ignore
+case. The same name in two directories looks the same on disk, but nothing
+else about it can be read. Contents are sealed in 64k chunks, each with the
+file's random nonce prefix and the chunk number, and the last chunk is marked
+so a file that's been cut short won't open.
+
+An encrypted name is about twice as long as the plain one, so a name over
+about 130 bytes would be too long for most filesystems. Those are stored under
+"l." and a hash of the encrypted name, with the encrypted name in a side file
+next to it that ends in ".name". The side file is written when the file or
+directory is created and removed along with it.
+*/
+
+const cryptMarker = "/.crypt.collection"
+
+const (
+	// cryptNameMax is the longest name most filesystems allow
+	cryptNameMax   = 255
+	longNamePrefix = "l."
+	longNameSuffix = ".name"
+)
+
+const (
+	cryptMagic     = "ADAE"
+	cryptHeaderLen = len(cryptMagic) + 8
+	cryptChunk     = 64 * 1024
+)
+
+var (
+	ErrNoCollectionKey = errors.New("No key for collection")
+	ErrWrongKey        = errors.New("Key does not match instance")
+	ErrNotEncrypted    = errors.New("File is not encrypted")
+	ErrNotEmpty        = errors.New("Directory has to be empty to be encrypted")
+	ErrCryptWrite      = errors.New("Encrypted file can't be changed after it's written")
+)
+
+var nameEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// keyPath is the file the key for collection id is kept in.
+func keyPath(id string) string {
+	if buf, e := base64.StdEncoding.DecodeString(id); e == nil {
+		id = base64.RawURLEncoding.EncodeToString(buf)
+	}
+	return filepath.Join(GetServiceSetting("collection keys"), id+".key")
+}
+
+// collectionKey reads the key for collection id. If create is set and there
+// isn't one, it's made.
+func collectionKey(id string, create bool) ([]byte, error) {
+	pathStr := keyPath(id)
+	buf, e := ioutil.ReadFile(pathStr)
+	if e == nil {
+		key, e := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+		if e != nil || len(key) != 32 {
+			return nil, errors.New("Bad collection key in " + pathStr)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(e) {
+		return nil, e
+	}
+	if !create {
+		return nil, errors.New(ErrNoCollectionKey.Error() + ", copy it to " + pathStr)
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	os.MkdirAll(filepath.Dir(pathStr), 0700)
+	if e := ioutil.WriteFile(pathStr, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); e != nil {
+		return nil, e
+	}
+	return key, nil
+}
+
+func keyCheck(key []byte) string {
+	return base64.StdEncoding.EncodeToString(hmacSHA256(key, "adasync key check"))
+}
+
+// InitEncrypted is Init for an instance that's encrypted with the
+// collection's key. If id is empty, a new collection and key are made.
+func InitEncrypted(pathStr, id string) (*Instance, error) {
+	if _, e := filesystem.Stat(pathStr + cryptMarker); e == nil {
+		return nil, ErrAlreadyInstance
+	}
+	if f, e := filesystem.Open(pathStr); e != nil {
+		return nil, e
+	} else {
+		fis, _ := f.Readdir(1)
+		f.Close()
+		if len(fis) > 0 {
+			return nil, ErrNotEmpty
+		}
+	}
+	if id == "" {
+		id = New().IdStr()
+	}
+	key, e := collectionKey(id, true)
+	if e != nil {
+		return nil, e
+	}
+	if e := writeSettings(pathStr+cryptMarker, map[string]string{
+		"id":    id,
+		"check": keyCheck(key),
+	}); e != nil {
+		return nil, e
+	}
+	if e := useCrypt(pathStr, key); e != nil {
+		return nil, e
+	}
+	return Init(pathStr, id)
+}
+
+// IsInstanceRoot is true if pathStr has the config of an instance, or is an
+// encrypted instance.
+func IsInstanceRoot(pathStr string) bool {
+	for _, name := range []string{"/config.collection", cryptMarker} {
+		if _, e := filesystem.Stat(pathStr + name); e == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// isEncrypted is true if pathStr is the root of an open encrypted instance.
+func isEncrypted(pathStr string) bool {
+	r, ok := filesystem.(*router)
+	return ok && r.encrypted(pathStr)
+}
+
+// openCrypt puts cryptFS in front of pathStr if it's an encrypted instance.
+func openCrypt(pathStr string) error {
+	if r, ok := filesystem.(*router); !ok || r.encrypted(pathStr) {
+		return nil
+	}
+	marker, e := LoadConfig(pathStr + cryptMarker)
+	if os.IsNotExist(e) {
+		return nil
+	} else if e != nil {
+		return e
+	}
+	key, e := collectionKey(marker["id"], false)
+	if e != nil {
+		return e
+	}
+	if !hmac.Equal([]byte(keyCheck(key)), []byte(marker["check"])) {
+		return ErrWrongKey
+	}
+	return useCrypt(pathStr, key)
+}
+
+func useCrypt(root string, key []byte) error {
+	r, ok := filesystem.(*router)
+	if !ok {
+		return errors.New("Encryption needs the default filesystem")
+	}
+	c, e := newCryptFS(root, key, r.transport)
+	if e != nil {
+		return e
+	}
+	r.mux.Lock()
+	r.crypt[root] = c
+	r.mux.Unlock()
+	return nil
+}
+
+// cryptFS is the filesystem for everything under root.
+type cryptFS struct {
+	root     string
+	names    cipher.AEAD
+	nameKey  []byte
+	contents cipher.AEAD
+	inner    func(pathStr string) (fs.FileSystem, error)
+}
+
+func newCryptFS(root string, key []byte, inner func(string) (fs.FileSystem, error)) (*cryptFS, error) {
+	c := &cryptFS{
+		root:    root,
+		nameKey: hmacSHA256(key, "names nonce"),
+		inner:   inner,
+	}
+	var e error
+	if c.names, e = newGCM(hmacSHA256(key, "names")); e != nil {
+		return nil, e
+	}
+	if c.contents, e = newGCM(hmacSHA256(key, "contents")); e != nil {
+		return nil, e
+	}
+	return c, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, e := aes.NewCipher(key)
+	if e != nil {
+		return nil, e
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *cryptFS) encryptName(name string) string {
+	nonce := hmacSHA256(c.nameKey, name)[:c.names.NonceSize()]
+	sealed := c.names.Seal(nonce, nonce, []byte(name), nil)
+	return strings.ToLower(nameEncoding.EncodeToString(sealed))
+}
+
+func (c *cryptFS) decryptName(name string) (string, bool) {
+	sealed, e := nameEncoding.DecodeString(strings.ToUpper(name))
+	if e != nil || len(sealed) < c.names.NonceSize() {
+		return "", false
+	}
+	n := c.names.NonceSize()
+	plain, e := c.names.Open(nil, sealed[:n], sealed[n:], nil)
+	if e != nil {
+		return "", false
+	}
+	return string(plain), true
+}
+
+// diskName is the name a part of a path has on disk, long is true if it's
+// too long to be the encrypted name.
+func (c *cryptFS) diskName(name string) (disk string, long bool) {
+	enc := c.encryptName(name)
+	if len(enc) <= cryptNameMax {
+		return enc, false
+	}
+	sum := sha256.Sum256([]byte(enc))
+	return longNamePrefix + strings.ToLower(nameEncoding.EncodeToString(sum[:20])), true
+}
+
+// path is where pathStr is on disk. The marker is left as it is.
+func (c *cryptFS) path(pathStr string) string {
+	rel := strings.TrimPrefix(pathStr, c.root)
+	if rel == cryptMarker {
+		return pathStr
+	}
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		if part != "" {
+			parts[i], _ = c.diskName(part)
+		}
+	}
+	return c.root + strings.Join(parts, "/")
+}
+
+// longName is the side file for pathStr, it's empty if the name isn't long.
+func (c *cryptFS) longName(pathStr string) string {
+	pathStr = strings.TrimSuffix(pathStr, "/")
+	i := strings.LastIndex(pathStr, "/")
+	disk, long := c.diskName(pathStr[i+1:])
+	if !long {
+		return ""
+	}
+	return c.path(pathStr[:i]) + "/" + disk + longNameSuffix
+}
+
+// writeLongName writes the side file for pathStr if it needs one.
+func (c *cryptFS) writeLongName(pathStr string) error {
+	side := c.longName(pathStr)
+	if side == "" {
+		return nil
+	}
+	inner, e := c.inner(side)
+	if e != nil {
+		return e
+	}
+	f, e := inner.Create(side)
+	if e != nil {
+		return e
+	}
+	name := strings.TrimSuffix(pathStr, "/")
+	_, e = f.Write([]byte(c.encryptName(name[strings.LastIndex(name, "/")+1:])))
+	if e2 := f.Close(); e == nil {
+		e = e2
+	}
+	return e
+}
+
+// removeLongName removes the side file for pathStr if it has one.
+func (c *cryptFS) removeLongName(pathStr string) error {
+	side := c.longName(pathStr)
+	if side == "" {
+		return nil
+	}
+	inner, e := c.inner(side)
+	if e != nil {
+		return e
+	}
+	if e := inner.Remove(side); e != nil && !os.IsNotExist(e) {
+		return e
+	}
+	return nil
+}
+
+// readLongName is the plain name of disk in the directory dir on disk.
+func (c *cryptFS) readLongName(dir, disk string) (string, bool) {
+	if !strings.HasPrefix(disk, longNamePrefix) || strings.HasSuffix(disk, longNameSuffix) {
+		return "", false
+	}
+	side := dir + "/" + disk + longNameSuffix
+	inner, e := c.inner(side)
+	if e != nil {
+		return "", false
+	}
+	f, e := inner.Open(side)
+	if e != nil {
+		return "", false
+	}
+	defer f.Close()
+	enc, e := ioutil.ReadAll(io.LimitReader(f, 4*cryptNameMax))
+	if e != nil {
+		return "", false
+	}
+	return c.decryptName(string(enc))
+}
+
+func (c *cryptFS) fs(pathStr string) (fs.FileSystem, string, error) {
+	enc := c.path(pathStr)
+	inner, e := c.inner(enc)
+	return inner, enc, e
+}
+
+func (c *cryptFS) Open(pathStr string) (fs.File, error) {
+	inner, enc, e := c.fs(pathStr)
+	if e != nil {
+		return nil, e
+	}
+	f, e := inner.Open(enc)
+	if e != nil {
+		return nil, e
+	}
+	fi, e := f.Stat()
+	if e != nil {
+		f.Close()
+		return nil, e
+	}
+	cf := &cryptFile{c: c, inner: f, name: pathStr, chunk: -1}
+	if fi.IsDir() {
+		cf.info = c.info(pathStr, fi)
+		return cf, nil
+	}
+	header := make([]byte, cryptHeaderLen)
+	if _, e := io.ReadFull(f, header); e != nil || string(header[:len(cryptMagic)]) != cryptMagic {
+		f.Close()
+		return nil, ErrNotEncrypted
+	}
+	cf.prefix = header[len(cryptMagic):]
+	cf.info = c.info(pathStr, fi)
+	return cf, nil
+}
+
+func (c *cryptFS) Create(pathStr string) (fs.File, error) {
+	inner, enc, e := c.fs(pathStr)
+	if e != nil {
+		return nil, e
+	}
+	if e := c.writeLongName(pathStr); e != nil {
+		return nil, e
+	}
+	f, e := inner.Create(enc)
+	if e != nil {
+		return nil, e
+	}
+	prefix := make([]byte, 8)
+	rand.Read(prefix)
+	if _, e := f.Write(append([]byte(cryptMagic), prefix...)); e != nil {
+		f.Close()
+		return nil, e
+	}
+	return &cryptFile{c: c, inner: f, name: pathStr, prefix: prefix, writing: true, chunk: -1}, nil
+}
+
+func (c *cryptFS) Stat(pathStr string) (os.FileInfo, error) {
+	inner, enc, e := c.fs(pathStr)
+	if e != nil {
+		return nil, e
+	}
+	fi, e := inner.Stat(enc)
+	if e != nil {
+		return nil, e
+	}
+	return c.info(pathStr, fi), nil
+}
+
+func (c *cryptFS) Mkdir(pathStr string, mode os.FileMode) error {
+	inner, enc, e := c.fs(pathStr)
+	if e != nil {
+		return e
+	}
+	if e := inner.Mkdir(enc, mode); e != nil {
+		return e
+	}
+	return c.writeLongName(pathStr)
+}
+
+func (c *cryptFS) Rename(from, to string) error {
+	inner, enc, e := c.fs(from)
+	if e != nil {
+		return e
+	}
+	toEnc := c.path(to)
+	if e := inner.Rename(enc, toEnc); e != nil || toEnc == enc {
+		return e
+	}
+	if e := c.writeLongName(to); e != nil {
+		return e
+	}
+	return c.removeLongName(from)
+}
+
+func (c *cryptFS) RemoveAll(pathStr string) error {
+	inner, enc, e := c.fs(pathStr)
+	if e != nil {
+		return e
+	}
+	if e := inner.RemoveAll(enc); e != nil {
+		return e
+	}
+	return c.removeLongName(pathStr)
+}
+
+func (c *cryptFS) Remove(pathStr string) error {
+	inner, enc, e := c.fs(pathStr)
+	if e != nil {
+		return e
+	}
+	if e := inner.Remove(enc); e != nil {
+		return e
+	}
+	return c.removeLongName(pathStr)
+}
+
+// plainSize is the size of the contents of a file that's size bytes on disk.
+func plainSize(size int64) int64 {
+	body := size - int64(cryptHeaderLen)
+	per := int64(cryptChunk + cryptOverhead)
+	full, rem := body/per, body%per
+	if rem > cryptOverhead {
+		return full*cryptChunk + rem - cryptOverhead
+	}
+	return full * cryptChunk
+}
+
+const cryptOverhead = 16
+
+// cryptInfo has the plain name and size.
+type cryptInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (c *cryptFS) info(pathStr string, fi os.FileInfo) *cryptInfo {
+	name := strings.TrimSuffix(pathStr, "/")
+	name = name[strings.LastIndex(name, "/")+1:]
+	size := fi.Size()
+	if !fi.IsDir() {
+		size = plainSize(size)
+	}
+	return &cryptInfo{FileInfo: fi, name: name, size: size}
+}
+
+func (fi *cryptInfo) Name() string { return fi.name }
+func (fi *cryptInfo) Size() int64  { return fi.size }
+
+// cryptFile is either read, a chunk at a time, or written from start to
+// end. The last chunk is written by Sync or Close.
+type cryptFile struct {
+	c       *cryptFS
+	inner   fs.File
+	name    string
+	info    *cryptInfo
+	prefix  []byte
+	off     int64
+	chunk   int64 // the chunk in plain
+	plain   []byte
+	writing bool
+	buf     []byte
+	written uint32 // chunks
+	done    bool
+}
+
+func (f *cryptFile) nonce(i uint32) []byte {
+	nonce := make([]byte, f.c.contents.NonceSize())
+	copy(nonce, f.prefix)
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], i)
+	return nonce
+}
+
+var lastChunk = []byte{1}
+
+func (f *cryptFile) lastChunk() int64 {
+	if f.info.size == 0 {
+		return 0
+	}
+	return (f.info.size - 1) / cryptChunk
+}
+
+func (f *cryptFile) load(i int64) error {
+	if _, e := f.inner.Seek(int64(cryptHeaderLen)+i*(cryptChunk+cryptOverhead), io.SeekStart); e != nil {
+		return e
+	}
+	sealed := make([]byte, cryptChunk+cryptOverhead)
+	n, e := io.ReadFull(f.inner, sealed)
+	if e != nil && e != io.ErrUnexpectedEOF {
+		return e
+	}
+	var ad []byte
+	if i == f.lastChunk() {
+		ad = lastChunk
+	}
+	plain, e := f.c.contents.Open(nil, f.nonce(uint32(i)), sealed[:n], ad)
+	if e != nil {
+		return e
+	}
+	f.chunk, f.plain = i, plain
+	return nil
+}
+
+func (f *cryptFile) Read(b []byte) (int, error) {
+	if f.writing || f.info.IsDir() {
+		return 0, errors.New("Can't read " + f.name)
+	}
+	if f.off >= f.info.size {
+		return 0, io.EOF
+	}
+	if i := f.off / cryptChunk; i != f.chunk {
+		if e := f.load(i); e != nil {
+			return 0, e
+		}
+	}
+	n := copy(b, f.plain[f.off-f.chunk*cryptChunk:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *cryptFile) Seek(offset int64, whence int) (int64, error) {
+	if f.writing {
+		return 0, ErrCryptWrite
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return f.off, errors.New("Negative seek")
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// Write seals each chunk once there's more after it, so the last one can be
+// marked.
+func (f *cryptFile) Write(b []byte) (int, error) {
+	if !f.writing || f.done {
+		return 0, ErrCryptWrite
+	}
+	f.buf = append(f.buf, b...)
+	for len(f.buf) > cryptChunk {
+		if e := f.seal(f.buf[:cryptChunk], nil); e != nil {
+			return 0, e
+		}
+		f.buf = f.buf[cryptChunk:]
+	}
+	return len(b), nil
+}
+
+func (f *cryptFile) seal(plain, ad []byte) error {
+	_, e := f.inner.Write(f.c.contents.Seal(nil, f.nonce(f.written), plain, ad))
+	f.written++
+	return e
+}
+
+func (f *cryptFile) finish() error {
+	if !f.writing || f.done {
+		return nil
+	}
+	f.done = true
+	return f.seal(f.buf, lastChunk)
+}
+
+// Sync writes the last chunk, nothing can be written after it.
+func (f *cryptFile) Sync() error {
+	if e := f.finish(); e != nil {
+		return e
+	}
+	return f.inner.Sync()
+}
+
+func (f *cryptFile) Close() error {
+	e := f.finish()
+	if e2 := f.inner.Close(); e == nil {
+		e = e2
+	}
+	return e
+}
+
+func (f *cryptFile) Stat() (os.FileInfo, error) {
+	if f.writing {
+		fi, e := f.inner.Stat()
+		if e != nil {
+			return nil, e
+		}
+		info := f.c.info(f.name, fi)
+		info.size = int64(f.written)*cryptChunk + int64(len(f.buf))
+		return info, nil
+	}
+	return f.info, nil
+}
+
+// Readdir leaves out anything that isn't encrypted, like the marker and the
+// side files of long names.
+func (f *cryptFile) Readdir(n int) ([]os.FileInfo, error) {
+	fis, e := f.inner.Readdir(n)
+	out := make([]os.FileInfo, 0, len(fis))
+	dir := strings.TrimSuffix(f.c.path(f.name), "/")
+	for _, fi := range fis {
+		name, ok := f.c.decryptName(fi.Name())
+		if !ok {
+			name, ok = f.c.readLongName(dir, fi.Name())
+		}
+		if ok {
+			info := &cryptInfo{FileInfo: fi, name: name, size: fi.Size()}
+			if !fi.IsDir() {
+				info.size = plainSize(fi.Size())
+			}
+			out = append(out, info)
+		}
+	}
+	return out, e
+}
+
+// Name is the full plain path
+func (f *cryptFile) Name() string { return f.name }
@@ -0,0 +1,203 @@
+package adasync
+
+import (
+	"bytes"
+	"github.com/adamcolton/fs"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCryptFile(t *testing.T) {
+	tmp := tempInstanceDir(t)
+	key := make([]byte, 32)
+	c, e := newCryptFS(tmp, key, func(string) (fs.FileSystem, error) { return fs.Std, nil })
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if e := c.Mkdir(tmp+"/Music", 0700); e != nil {
+		t.Fatal(e)
+	}
+	data := bytes.Repeat([]byte("0123456789abcdef"), cryptChunk/8) // exactly 2 chunks
+	for _, size := range []int{0, 10, len(data)} {
+		f, e := c.Create(tmp + "/Music/song.mp3")
+		if e != nil {
+			t.Fatal(e)
+		}
+		f.Write(data[:size/2])
+		f.Write(data[size/2 : size])
+		f.Close()
+		if fi, e := c.Stat(tmp + "/Music/song.mp3"); e != nil || fi.Size() != int64(size) || fi.Name() != "song.mp3" {
+			t.Error("Expected plain size and name: ", size, fi, e)
+		}
+		f, _ = c.Open(tmp + "/Music/song.mp3")
+		if buf, e := ioutil.ReadAll(f); e != nil || !bytes.Equal(buf, data[:size]) {
+			t.Error("Expected contents to be decrypted: ", size, e)
+		}
+		f.Close()
+	}
+
+	f, _ := c.Open(tmp + "/Music/song.mp3")
+	f.Seek(cryptChunk+3, io.SeekStart)
+	buf := make([]byte, 4)
+	if _, e := io.ReadFull(f, buf); e != nil || !bytes.Equal(buf, data[cryptChunk+3:cryptChunk+7]) {
+		t.Error("Expected to read from the middle: ", string(buf), e)
+	}
+	f.Close()
+
+	f, _ = c.Open(tmp)
+	fis, _ := f.Readdir(-1)
+	f.Close()
+	if len(fis) != 1 || fis[0].Name() != "Music" || !fis[0].IsDir() {
+		t.Error("Expected directory name to be decrypted: ", fis)
+	}
+	raw, _ := ioutil.ReadDir(tmp)
+	if len(raw) != 1 || strings.Contains(strings.ToLower(raw[0].Name()), "music") {
+		t.Error("Expected name to be encrypted on disk")
+	}
+
+	// a file that's been cut short won't read
+	enc := c.path(tmp + "/Music/song.mp3")
+	os.Truncate(enc, int64(cryptHeaderLen+cryptChunk+cryptOverhead))
+	f, _ = c.Open(tmp + "/Music/song.mp3")
+	if _, e := ioutil.ReadAll(f); e == nil {
+		t.Error("Expected a truncated file to fail")
+	}
+	f.Close()
+}
+
+func TestCryptLongName(t *testing.T) {
+	tmp := tempInstanceDir(t)
+	c, e := newCryptFS(tmp, make([]byte, 32), func(string) (fs.FileSystem, error) { return fs.Std, nil })
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	long := strings.Repeat("a long name ", 17)[:200]
+	dir := tmp + "/" + long
+	if e := c.Mkdir(dir, 0700); e != nil {
+		t.Fatal(e)
+	}
+	f, e := c.Create(dir + "/" + long + ".mp3")
+	if e != nil {
+		t.Fatal(e)
+	}
+	f.Write([]byte("la la la"))
+	f.Close()
+	f, _ = c.Open(dir + "/" + long + ".mp3")
+	if buf, e := ioutil.ReadAll(f); e != nil || string(buf) != "la la la" {
+		t.Error("Expected to read file with a long name: ", e)
+	}
+	f.Close()
+
+	for _, d := range []string{tmp, dir} {
+		f, _ := c.Open(d)
+		fis, _ := f.Readdir(-1)
+		f.Close()
+		if len(fis) != 1 || !strings.HasPrefix(fis[0].Name(), long) {
+			t.Error("Expected long name to be decrypted: ", fis)
+		}
+	}
+	filepath.Walk(tmp, func(path string, fi os.FileInfo, e error) error {
+		if len(fi.Name()) > cryptNameMax {
+			t.Error("Name too long on disk: ", len(fi.Name()))
+		}
+		return nil
+	})
+
+	if e := c.Rename(dir+"/"+long+".mp3", dir+"/short.mp3"); e != nil {
+		t.Fatal(e)
+	}
+	if e := c.Rename(dir+"/short.mp3", dir+"/"+long+".ogg"); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := c.Stat(dir + "/" + long + ".ogg"); e != nil {
+		t.Error("Expected rename to a long name: ", e)
+	}
+	c.Remove(dir + "/" + long + ".ogg")
+	if raw, _ := ioutil.ReadDir(c.path(dir)); len(raw) != 0 {
+		t.Error("Expected side files to be removed: ", len(raw))
+	}
+	c.RemoveAll(dir)
+	if raw, _ := ioutil.ReadDir(tmp); len(raw) != 0 {
+		t.Error("Expected directory side file to be removed: ", len(raw))
+	}
+}
+
+func TestEncryptedInstance(t *testing.T) {
+	tmp := tempInstanceDir(t, "/a/documents", "/drive", "/other")
+	secret := []byte("the family secrets")
+	ioutil.WriteFile(tmp+"/a/documents/taxes.txt", secret, 0600)
+	Settings["collection keys"] = tmp + "/keys"
+	defer delete(Settings, "collection keys")
+
+	a, e := Init(tmp+"/a", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	drive, e := InitEncrypted(tmp+"/drive", a.CollectionId())
+	if e != nil {
+		t.Fatal(e)
+	}
+	SyncInstances(a, drive)
+	if buf, e := readFile(tmp + "/drive/documents/taxes.txt"); e != nil || !bytes.Equal(buf, secret) {
+		t.Fatal("Expected the file to be sync'd to the encrypted instance: ", e)
+	}
+	filepath.Walk(tmp+"/drive", func(pathStr string, fi os.FileInfo, e error) error {
+		if e != nil {
+			return e
+		}
+		name := strings.ToLower(fi.Name())
+		if strings.Contains(name, "taxes") || strings.Contains(name, "documents") || name == ".collection" || name == "config.collection" {
+			t.Error("Expected names to be encrypted: ", pathStr)
+		}
+		if buf, _ := ioutil.ReadFile(pathStr); bytes.Contains(buf, secret) {
+			t.Error("Expected contents to be encrypted: ", pathStr)
+		}
+		return nil
+	})
+	for id, res := range a.resources {
+		if other, ok := drive.resources[id]; !ok || !other.Hash.Equal(res.Hash) {
+			t.Error("Expected the same hash on both instances")
+		}
+	}
+
+	// a change on the drive is found like any other
+	f, _ := filesystem.Create(tmp + "/drive/documents/will.txt")
+	f.Write([]byte("will"))
+	f.Close()
+	SyncInstances(a, drive)
+	if buf, e := ioutil.ReadFile(tmp + "/a/documents/will.txt"); e != nil || string(buf) != "will" {
+		t.Error("Expected file from the encrypted instance")
+	}
+
+	if paths := Scan([]string{tmp}).Slice(); len(paths) != 2 {
+		t.Error("Expected to find both instances: ", paths)
+	}
+
+	// without the right key it won't open
+	other, e := InitEncrypted(tmp+"/other", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e := InitEncrypted(tmp+"/a", ""); e != ErrNotEmpty {
+		t.Error("Expected a folder with files in it to be refused: ", e)
+	}
+	r := filesystem.(*router)
+	r.mux.Lock()
+	delete(r.crypt, tmp+"/other")
+	r.mux.Unlock()
+	delete(collections, other.CollectionId())
+	os.Remove(keyPath(other.CollectionId()))
+	if _, e := Open(tmp + "/other"); e == nil || !strings.HasPrefix(e.Error(), ErrNoCollectionKey.Error()) {
+		t.Error("Expected missing key: ", e)
+	}
+	ioutil.WriteFile(keyPath(other.CollectionId()), []byte("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n"), 0600)
+	if _, e := Open(tmp + "/other"); e != ErrWrongKey {
+		t.Error("Expected wrong key: ", e)
+	}
+}
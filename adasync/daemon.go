@@ -0,0 +1,252 @@
+package adasync
+
+import (
+	"context"
+	"github.com/adamcolton/err"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var serviceDefaults = map[string]string{
+	"shallow check freq":  "30m",
+	"deep check freq":     "2h",
+	"scan freq":           "5m",
+	"mount poll freq":     "2s",
+	"watch delay":         "2s",
+	"watch max delay":     "1m",
+	"peer sync freq":      "5m",
+	"jitter":              "0.1",
+	"listen":              "",
+	"peers":               "",
+	"discovery":           "true",
+	"discovery group":     "239.255.77.77:47077",
+	"discovery interface": "",
+	"announce freq":       "30s",
+	"peer key":            "peer.key",
+	"revoked peers":       "",
+	"collection keys":     "keys",
+}
+
+// GetServiceSetting reads a setting from the global config, falling back to
+// the default.
+func GetServiceSetting(key string) string {
+	if val, ok := Settings[key]; ok {
+		return val
+	}
+	return serviceDefaults[key]
+}
+
+func serviceDuration(key string) time.Duration {
+	d, e := time.ParseDuration(GetServiceSetting(key))
+	if e != nil || d <= 0 {
+		err.Debug("Bad value for ", key, ", using default")
+		d, _ = time.ParseDuration(serviceDefaults[key])
+	}
+	return d
+}
+
+// jittered spreads freq by up to jitter (a fraction of freq) in either
+// direction so that every instance of the daemon doesn't hit the disks at the
+// same moment. r should be in [0,1).
+func jittered(freq time.Duration, jitter, r float64) time.Duration {
+	if jitter <= 0 {
+		return freq
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+	return freq + time.Duration(float64(freq)*jitter*(2*r-1))
+}
+
+// Job is something the daemon runs. Jobs are coalesced by Name, if a job is
+// already waiting to run, adding it again does nothing.
+type Job struct {
+	Name string
+	Run  func(ctx context.Context)
+}
+
+// Daemon runs jobs one at a time. If Idle is set, it's called each time the
+// queue is emptied.
+type Daemon struct {
+	mux     sync.Mutex
+	queue   []*Job
+	pending map[string]bool
+	wake    chan bool
+	Idle    func(ctx context.Context)
+}
+
+func NewDaemon() *Daemon {
+	return &Daemon{
+		pending: make(map[string]bool),
+		wake:    make(chan bool, 1),
+	}
+}
+
+// Add queues a job. It returns false if the same job was already waiting.
+func (d *Daemon) Add(job *Job) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.pending[job.Name] {
+		return false
+	}
+	d.pending[job.Name] = true
+	d.queue = append(d.queue, job)
+	select {
+	case d.wake <- true:
+	default:
+	}
+	return true
+}
+
+func (d *Daemon) next() *Job {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if len(d.queue) == 0 {
+		return nil
+	}
+	job := d.queue[0]
+	d.queue = d.queue[1:]
+	delete(d.pending, job.Name)
+	return job
+}
+
+// Every adds job after each period of freq, with jitter, until ctx is done.
+func (d *Daemon) Every(ctx context.Context, freq time.Duration, jitter float64, job *Job) {
+	for {
+		timer := time.NewTimer(jittered(freq, jitter, rand.Float64()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			d.Add(job)
+		}
+	}
+}
+
+// Run runs jobs as they're added until ctx is done. The job that is running
+// when ctx is done is passed the same ctx, so it can stop cleanly, and Run
+// returns once it has.
+func (d *Daemon) Run(ctx context.Context) {
+	for {
+		for job := d.next(); job != nil && ctx.Err() == nil; job = d.next() {
+			err.Debug("-- Running ", job.Name, " --")
+			job.Run(ctx)
+		}
+		if d.Idle != nil && ctx.Err() == nil {
+			d.Idle(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		}
+	}
+}
+
+// WriteAll writes the state of every open instance that has changed.
+func WriteAll() {
+	for _, c := range collections {
+		for _, ins := range c.instances {
+			ins.Write()
+		}
+	}
+}
+
+// RunDaemon checks for changes and new drives on the schedule in the global
+// settings and syncs every instance it finds, until ctx is done. Before
+// returning it writes the state of every instance.
+//
+// A shallow check syncs the instances that are already open, skipping
+// directories that haven't changed, a scan looks for new drives and a deep
+// check searches everywhere for instances and reads every directory. Once an
+// instance is open it's also watched for changes. If "listen" is set, open
+// instances are shared with peers and announced on the local network, and the
+// ones in "peers" or found on the network are sync'd with.
+func RunDaemon(ctx context.Context) {
+	jitter, e := strconv.ParseFloat(GetServiceSetting("jitter"), 64)
+	if e != nil {
+		jitter = 0
+	}
+	d := NewDaemon()
+	watchers := NewWatchers(d)
+	var server *PeerServer
+	port := 0
+	if addr := GetServiceSetting("listen"); addr != "" {
+		if ln, e := net.Listen("tcp", addr); err.Log(e) {
+			err.Debug("Listening: ", ln.Addr())
+			server = NewPeerServer(d)
+			port = ln.Addr().(*net.TCPAddr).Port
+			go server.Serve(ctx, ln)
+		}
+	}
+	d.Idle = func(ctx context.Context) {
+		watchers.WatchAll(ctx)
+		if server != nil {
+			server.ShareAll()
+		}
+	}
+	deep := &Job{
+		Name: "deep check",
+		Run: func(ctx context.Context) {
+			FullScanContext(ctx)
+			DeepSyncAllContext(ctx)
+		},
+	}
+	shallow := &Job{
+		Name: "shallow check",
+		Run:  SyncAllContext,
+	}
+	scan := &Job{
+		Name: "scan",
+		Run: func(ctx context.Context) {
+			QuickScan()
+			SyncAllContext(ctx)
+		},
+	}
+	d.Add(deep)
+	var dis *Discovery
+	if server != nil && GetServiceSetting("discovery") != "false" {
+		if dis, e = NewDiscovery(server, port); !err.Log(e) {
+			dis = nil
+		}
+	}
+	peers := GetServiceSetting("peers")
+	peerSync := &Job{
+		Name: "peers",
+		Run: func(ctx context.Context) {
+			if server != nil {
+				// so the peers can pull back from anything opened since
+				server.ShareAll()
+			}
+			var addrs []string
+			if peers != "" {
+				addrs = StringList(peers)
+			}
+			if dis != nil {
+				addrs = append(addrs, dis.Peers()...)
+			}
+			for _, addr := range addrs {
+				err.Log(SyncPeer(ctx, addr, port))
+			}
+		},
+	}
+	if dis != nil {
+		dis.Found = func(string) { d.Add(peerSync) }
+		go func() { err.Log(dis.Run(ctx)) }()
+	}
+	if peers != "" || dis != nil {
+		d.Add(peerSync)
+		go d.Every(ctx, serviceDuration("peer sync freq"), jitter, peerSync)
+	}
+	go d.Every(ctx, serviceDuration("deep check freq"), jitter, deep)
+	go d.Every(ctx, serviceDuration("shallow check freq"), jitter, shallow)
+	go d.Every(ctx, serviceDuration("scan freq"), jitter, scan)
+	go watchMounts(ctx, d)
+	d.Run(ctx)
+	err.Debug("Writing state before exiting")
+	WriteAll()
+}
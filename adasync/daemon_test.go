@@ -0,0 +1,132 @@
+package adasync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestJittered(t *testing.T) {
+	freq := time.Hour
+	if d := jittered(freq, 0, 0.9); d != freq {
+		t.Error("No jitter should not change freq")
+	}
+	if d := jittered(freq, 0.1, 0); d != 54*time.Minute {
+		t.Error("Incorrect low jitter: ", d)
+	}
+	if d := jittered(freq, 0.1, 0.5); d != freq {
+		t.Error("Incorrect middle jitter: ", d)
+	}
+	if d := jittered(freq, 2, 0); d != 0 {
+		t.Error("Jitter should be capped at 1: ", d)
+	}
+}
+
+func TestDaemonCoalesce(t *testing.T) {
+	d := NewDaemon()
+	ran := 0
+	job := &Job{
+		Name: "job",
+		Run:  func(context.Context) { ran++ },
+	}
+	if !d.Add(job) {
+		t.Error("First add should queue the job")
+	}
+	if d.Add(job) {
+		t.Error("Second add should be coalesced")
+	}
+	d.next().Run(context.Background())
+	if !d.Add(job) {
+		t.Error("Should be able to add a job once it's running")
+	}
+	if ran != 1 || d.next() != job || d.next() != nil {
+		t.Error("Incorrect queue")
+	}
+}
+
+func TestDaemonShutdown(t *testing.T) {
+	d := NewDaemon()
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan bool)
+	finished := false
+	d.Add(&Job{
+		Name: "long",
+		Run: func(ctx context.Context) {
+			started <- true
+			<-ctx.Done()
+			finished = true
+		},
+	})
+	d.Add(&Job{
+		Name: "never",
+		Run:  func(context.Context) { t.Error("Should not start a job after shutdown") },
+	})
+	done := make(chan bool)
+	go func() {
+		d.Run(ctx)
+		done <- true
+	}()
+	<-started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+	if !finished {
+		t.Error("Running job should finish before Run returns")
+	}
+}
+
+func TestDaemonIdle(t *testing.T) {
+	d := NewDaemon()
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := false
+	d.Add(&Job{
+		Name: "job",
+		Run:  func(context.Context) { ran = true },
+	})
+	d.Idle = func(context.Context) {
+		if !ran {
+			t.Error("Idle should run after the queue is empty")
+		}
+		cancel()
+	}
+	d.Run(ctx)
+}
+
+type testAction func()
+
+func (a testAction) Execute()       { a() }
+func (a testAction) String() string { return "test" }
+
+func TestCancelRunsRenames(t *testing.T) {
+	tmp := tempInstanceDir(t, "/a", "/b")
+	aStr, bStr := tmp+"/a", tmp+"/b"
+	ioutil.WriteFile(aStr+"/song.mp3", []byte("new"), 0600)
+
+	c := New()
+	a := c.AddInstance(aStr)
+	b := c.AddInstance(bStr)
+	a.SelfUpdate()
+	b.SelfUpdate()
+	// the name is taken, so the copy is renamed after everything else
+	ioutil.WriteFile(bStr+"/song.mp3", []byte("old"), 0600)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sync := NewSync(a, b)
+	sync.Diff()
+	// canceled between the copy and the rename
+	sync.addAction(a.Lookup("/song.mp3").Depth(), testAction(func() {
+		os.Remove(bStr + "/song.mp3")
+		cancel()
+	}))
+	sync.RunContext(ctx)
+
+	if data, e := ioutil.ReadFile(bStr + "/song.mp3"); e != nil || string(data) != "new" {
+		t.Error("Copy should have been renamed after cancel")
+	}
+}
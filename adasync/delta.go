@@ -0,0 +1,375 @@
+package adasync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"github.com/adamcolton/err"
+	"github.com/adamcolton/fs"
+	"io"
+	"math"
+)
+
+/*
+When a file is copied over an older version of itself, only the blocks that
+changed are read from the source. The source's block signatures, a rolling
+checksum and part of an md5 for each block, come from it's instance state if
+it caches them ("cache signatures: true"), or from the peer that has it. The
+rolling checksum is run over every offset of the old file to find the blocks
+it already has, wherever they've moved to, and the new file is put together
+from those and the blocks that are missing. It's rsync's algorithm with the
+checksums run on the side that has the old file, so it works with a source
+that can only be read. It pays off when the source is slow to read, like a
+peer or a USB drive, and the old file is local.
+
+The new file is written next to the old one, the same as any other copy, so
+the old version still goes to the trash. It's checked against the hash before
+it's used.
+*/
+
+// deltaMinSize is the smallest file that gets signatures, anything smaller
+// is copied.
+const deltaMinSize = 1 << 20
+
+const sigLen = 4 + 8
+
+// blockSigs are the signatures of each block of a file, the last block can
+// be short.
+type blockSigs struct {
+	blockSize int
+	weak      []uint32
+	strong    [][8]byte
+}
+
+// deltaBlockSize is about the square root of size, that balances the size of
+// the signatures against how much has to be copied for each change.
+func deltaBlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size)))
+	bs = (bs + 1023) &^ 1023
+	if bs < 4096 {
+		bs = 4096
+	}
+	return bs
+}
+
+func weakSum(block []byte) uint32 {
+	var a, b uint32
+	l := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (l - uint32(i)) * uint32(c)
+	}
+	return a&0xffff | b<<16
+}
+
+func strongSum(block []byte) [8]byte {
+	var s [8]byte
+	sum := md5.Sum(block)
+	copy(s[:], sum[:])
+	return s
+}
+
+func (sigs *blockSigs) blocks() int { return len(sigs.weak) }
+
+// fits is true if sigs could be for a file of size.
+func (sigs *blockSigs) fits(size int64) bool {
+	if sigs == nil || sigs.blockSize <= 0 {
+		return false
+	}
+	bs := int64(sigs.blockSize)
+	return int64(sigs.blocks()) == (size+bs-1)/bs
+}
+
+func (sigs *blockSigs) marshal() []byte {
+	if sigs == nil {
+		return nil
+	}
+	buf := make([]byte, sigLen*sigs.blocks())
+	for i, w := range sigs.weak {
+		binary.BigEndian.PutUint32(buf[i*sigLen:], w)
+		copy(buf[i*sigLen+4:], sigs.strong[i][:])
+	}
+	return buf
+}
+
+func unmarshalSigs(blockSize uint32, buf []byte) *blockSigs {
+	if blockSize == 0 || len(buf)%sigLen != 0 {
+		return nil
+	}
+	sigs := &blockSigs{
+		blockSize: int(blockSize),
+		weak:      make([]uint32, len(buf)/sigLen),
+		strong:    make([][8]byte, len(buf)/sigLen),
+	}
+	for i := range sigs.weak {
+		sigs.weak[i] = binary.BigEndian.Uint32(buf[i*sigLen:])
+		copy(sigs.strong[i][:], buf[i*sigLen+4:])
+	}
+	return sigs
+}
+
+// sigWriter finds the signatures of everything written to it.
+type sigWriter struct {
+	sigs *blockSigs
+	buf  []byte
+}
+
+func newSigWriter(size int64) *sigWriter {
+	bs := deltaBlockSize(size)
+	return &sigWriter{
+		sigs: &blockSigs{blockSize: bs},
+		buf:  make([]byte, 0, bs),
+	}
+}
+
+func (w *sigWriter) add(block []byte) {
+	w.sigs.weak = append(w.sigs.weak, weakSum(block))
+	w.sigs.strong = append(w.sigs.strong, strongSum(block))
+}
+
+func (w *sigWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	bs := w.sigs.blockSize
+	for len(b) > 0 {
+		if len(w.buf) == 0 && len(b) >= bs {
+			w.add(b[:bs])
+			b = b[bs:]
+			continue
+		}
+		l := bs - len(w.buf)
+		if l > len(b) {
+			l = len(b)
+		}
+		w.buf = append(w.buf, b[:l]...)
+		b = b[l:]
+		if len(w.buf) == bs {
+			w.add(w.buf)
+			w.buf = w.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// result is finish, but it's nil if w is.
+func (w *sigWriter) result() *blockSigs {
+	if w == nil {
+		return nil
+	}
+	return w.finish()
+}
+
+func (w *sigWriter) finish() *blockSigs {
+	if len(w.buf) > 0 {
+		w.add(w.buf)
+		w.buf = w.buf[:0]
+	}
+	return w.sigs
+}
+
+// readSigs finds the signatures of the plain contents of f.
+func readSigs(f fs.File) (*blockSigs, error) {
+	r, size, e := readContents(f)
+	if e != nil {
+		return nil, e
+	}
+	w := newSigWriter(size)
+	if _, e := io.Copy(w, r); e != nil {
+		return nil, e
+	}
+	return w.finish(), nil
+}
+
+// match rolls over basis looking for the blocks in sigs. For each block it
+// gives the offset it was found at in basis, or -1. Only full blocks are
+// looked for, a short last block is always copied from the source.
+func (sigs *blockSigs) match(basis io.Reader, size int64) ([]int64, error) {
+	bs := sigs.blockSize
+	found := make([]int64, sigs.blocks())
+	index := make(map[uint32][]int)
+	for i, w := range sigs.weak {
+		found[i] = -1
+		if int64(i+1)*int64(bs) <= size {
+			index[w] = append(index[w], i)
+		}
+	}
+
+	r := bufio.NewReaderSize(basis, 1<<16)
+	window := make([]byte, bs)
+	fill := func() (bool, error) {
+		_, e := io.ReadFull(r, window)
+		if e == io.EOF || e == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return e == nil, e
+	}
+	ok, e := fill()
+	if !ok {
+		return found, e
+	}
+	var off int64 // where window starts in basis
+	head := 0     // where window starts in the ring
+	sum := weakSum(window)
+	a, b := sum&0xffff, sum>>16
+	l := uint32(bs)
+	block := make([]byte, bs)
+	for {
+		if is, ok := index[a|b<<16]; ok {
+			copy(block, window[head:])
+			copy(block[bs-head:], window[:head])
+			strong := strongSum(block)
+			matched := false
+			for _, i := range is {
+				if sigs.strong[i] == strong {
+					matched = true
+					if found[i] == -1 {
+						found[i] = off
+					}
+				}
+			}
+			if matched {
+				// skip past it, like rsync
+				off += int64(bs)
+				if ok, e := fill(); !ok {
+					return found, e
+				}
+				head = 0
+				sum = weakSum(window)
+				a, b = sum&0xffff, sum>>16
+				continue
+			}
+		}
+		c, e := r.ReadByte()
+		if e == io.EOF {
+			return found, nil
+		} else if e != nil {
+			return found, e
+		}
+		out := uint32(window[head])
+		window[head] = c
+		head = (head + 1) % bs
+		a = (a - out + uint32(c)) & 0xffff
+		b = (b - l*out + a) & 0xffff
+		off++
+	}
+}
+
+// writeDelta puts the file together from the blocks that were found in basis
+// and the rest from src. Runs of blocks that are next to each other are read
+// together. It returns how many bytes came from basis.
+func writeDelta(dst io.Writer, src, basis io.ReadSeeker, found []int64, blockSize int, size int64) (int64, error) {
+	var reused int64
+	bs := int64(blockSize)
+	for i := 0; i < len(found); {
+		from, start := src, int64(i)*bs
+		if found[i] != -1 {
+			from, start = basis, found[i]
+		}
+		j := i + 1
+		for ; j < len(found); j++ {
+			if found[i] == -1 {
+				if found[j] != -1 {
+					break
+				}
+			} else if found[j] != found[i]+int64(j-i)*bs {
+				break
+			}
+		}
+		length := int64(j-i) * bs
+		if end := int64(i)*bs + length; end > size {
+			length -= end - size
+		}
+		if _, e := from.Seek(start, io.SeekStart); e != nil {
+			return reused, e
+		}
+		if _, e := io.CopyN(dst, from, length); e != nil {
+			return reused, e
+		}
+		if from == basis {
+			reused += length
+		}
+		i = j
+	}
+	return reused, nil
+}
+
+// sourceSigs are the signatures of the contents of res. They're from the
+// state if it's cached them, or from the peer the file is on. If there's no
+// way to get them without reading the whole file, it's nil.
+func sourceSigs(res *Resource, pathStr string) *blockSigs {
+	if res.sigs.fits(res.Size) {
+		return res.sigs
+	}
+	if !IsPeer(pathStr) {
+		return nil
+	}
+	t, e := peerFor(pathStr)
+	if !err.Log(e) {
+		return nil
+	}
+	sigs, e := t.sigs(pathStr)
+	if !err.Log(e) || !sigs.fits(res.Size) {
+		return nil
+	}
+	return sigs
+}
+
+// copyDelta copies res from srcStr to dstStr using the file at basisStr. It's
+// false if it couldn't, and the file should be copied the usual way.
+func (cpRes *CpRes) copyDelta(srcStr, basisStr, dstStr string) bool {
+	res := cpRes.res
+	if res.Size < deltaMinSize || IsRemote(basisStr) || cpRes.ins.compresses(res.PathNodes.Last().Name) {
+		return false
+	}
+	sigs := sourceSigs(res, srcStr)
+	if sigs == nil {
+		return false
+	}
+	basis, e := filesystem.Open(basisStr)
+	if e != nil {
+		return false
+	}
+	defer basis.Close()
+	if r, _, e := readContents(basis); e != nil || r != basis {
+		return false // a compressed file can't be read from the middle
+	}
+	found, e := sigs.match(basis, res.Size)
+	if !err.Log(e) {
+		return false
+	}
+
+	src, e := filesystem.Open(srcStr)
+	if !err.Log(e) {
+		return false
+	}
+	defer src.Close()
+	if r, _, e := readContents(src); e != nil || r != src {
+		return false
+	}
+	dst, e := filesystem.Create(dstStr)
+	if !err.Log(e) {
+		return false
+	}
+	defer dst.Close()
+	hash := md5.New()
+	reused, e := writeDelta(io.MultiWriter(dst, hash), src, basis, found, sigs.blockSize, res.Size)
+	if e == nil && !bytes.Equal(hash.Sum(nil), res.Hash[:]) {
+		e = ErrObjectHash
+	}
+	if !err.Log(e) {
+		dst.Close()
+		filesystem.Remove(dstStr)
+		return false
+	}
+	err.Debug("Delta: ", reused, " of ", res.Size, " bytes were already in ", basisStr)
+	if cpRes.ins.cachesSigs() {
+		cpRes.sigs = sigs
+	}
+	return err.Log(dst.Sync())
+}
+
+// cachesSigs is true if ins keeps the block signatures of it's files in it's
+// state.
+func (ins *Instance) cachesSigs() bool {
+	return ins.GetSetting("cache signatures") == "true"
+}
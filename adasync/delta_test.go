@@ -0,0 +1,123 @@
+package adasync
+
+import (
+	"bytes"
+	"context"
+	"github.com/adamcolton/fs"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDeltaMatch(t *testing.T) {
+	old := make([]byte, 3*deltaMinSize/2)
+	rand.New(rand.NewSource(1)).Read(old)
+	// a few bytes put in at the start, some changed in the middle and some
+	// cut from the end
+	data := append([]byte("new header"), old...)
+	copy(data[len(data)/2:], "changed")
+	data = data[:len(data)-1000]
+
+	w := newSigWriter(int64(len(data)))
+	w.Write(data)
+	sigs := w.finish()
+	if !sigs.fits(int64(len(data))) {
+		t.Fatal("Expected signatures for every block")
+	}
+	sigs = unmarshalSigs(uint32(sigs.blockSize), sigs.marshal())
+
+	found, e := sigs.match(bytes.NewReader(old), int64(len(data)))
+	if e != nil {
+		t.Fatal(e)
+	}
+	var buf bytes.Buffer
+	reused, e := writeDelta(&buf, bytes.NewReader(data), bytes.NewReader(old), found, sigs.blockSize, int64(len(data)))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("Expected delta to rebuild the file")
+	}
+	if max := int64(len(data) - 3*sigs.blockSize); reused < max {
+		t.Error("Expected most of the file to be reused: ", reused, max)
+	}
+}
+
+// countFS counts how much is read from files with a name.
+type countFS struct {
+	fs.FileSystem
+	name string
+	read *int64
+}
+
+type countFile struct {
+	fs.File
+	read *int64
+}
+
+func (c countFS) Open(pathStr string) (fs.File, error) {
+	f, e := c.FileSystem.Open(pathStr)
+	if e == nil && strings.HasSuffix(pathStr, c.name) {
+		f = countFile{f, c.read}
+	}
+	return f, e
+}
+
+func (f countFile) Read(b []byte) (int, error) {
+	n, e := f.File.Read(b)
+	*f.read += int64(n)
+	return n, e
+}
+
+func TestDeltaCopy(t *testing.T) {
+	tmp := tempInstanceDir(t, "/usb", "/laptop")
+	data := make([]byte, 4*deltaMinSize)
+	rand.New(rand.NewSource(2)).Read(data)
+	ioutil.WriteFile(tmp+"/usb/photos.db", data, 0600)
+
+	usb, e := Init(tmp+"/usb", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	laptop, e := Init(tmp+"/laptop", usb.CollectionId())
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, ins := range []*Instance{usb, laptop} {
+		ins.settings["static"] = "false"
+		ins.settings["cache signatures"] = "true"
+	}
+	SyncInstances(usb, laptop)
+	res := laptop.Lookup("/photos.db")
+	if res == nil || !res.sigs.fits(res.Size) {
+		t.Fatal("Expected signatures to be found while copying")
+	}
+	if sRes := res.Serialize(); !bytes.Equal(sRes.unmarshalInto(laptop).sigs.marshal(), res.sigs.marshal()) {
+		t.Error("Expected signatures to be kept in the state")
+	}
+
+	copy(data[deltaMinSize:], "a small change")
+	ioutil.WriteFile(tmp+"/usb/photos.db", data, 0600)
+	usb.SelfUpdate()
+	if res := usb.Lookup("/photos.db"); res == nil || !res.sigs.fits(res.Size) {
+		t.Fatal("Expected signatures to be found by the scan")
+	}
+
+	// a non-static scan reads every file, only count what the sync reads
+	laptop.SelfUpdate()
+	var read int64
+	r := filesystem.(*router)
+	r.local = countFS{fs.Std, "/usb/photos.db", &read}
+	defer func() { r.local = fs.Std }()
+	syncPair(context.Background(), usb, laptop)
+	if buf, e := ioutil.ReadFile(tmp + "/laptop/photos.db"); e != nil || !bytes.Equal(buf, data) {
+		t.Fatal("Expected the change to be copied")
+	}
+	if read >= int64(len(data))/2 {
+		t.Error("Expected only the changed blocks to be read: ", read)
+	}
+	if len(laptop.trash) != 1 {
+		t.Error("Expected the old version in the trash")
+	}
+}
@@ -0,0 +1,212 @@
+package adasync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"github.com/adamcolton/err"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// announcement is what a daemon multicasts to say where it is and what it
+// shares.
+type announcement struct {
+	ID          string
+	Port        int
+	Collections []string
+}
+
+// Discovery finds peers on the local network. Every daemon that shares its
+// instances announces the collections it has to a multicast group, and
+// listens for peers that have the same collections.
+type Discovery struct {
+	Group *net.UDPAddr
+	Iface *net.Interface // nil for the system default
+	Port  int            // where server listens
+	Freq  time.Duration
+	// Found is called from the listener the first time a peer is seen with a
+	// collection we have.
+	Found  func(addr string)
+	server *PeerServer
+	id     string
+	mux    sync.Mutex
+	peers  map[string]*lanPeer // addr -> peer
+}
+
+type lanPeer struct {
+	collections []string
+	seen        time.Time
+}
+
+// NewDiscovery announces what server shares on port, using the "discovery
+// group", "discovery interface" and "announce freq" settings.
+func NewDiscovery(server *PeerServer, port int) (*Discovery, error) {
+	group, e := net.ResolveUDPAddr("udp4", GetServiceSetting("discovery group"))
+	if e != nil {
+		return nil, e
+	}
+	var iface *net.Interface
+	if name := GetServiceSetting("discovery interface"); name != "" {
+		if iface, e = net.InterfaceByName(name); e != nil {
+			return nil, e
+		}
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Discovery{
+		Group:  group,
+		Iface:  iface,
+		Port:   port,
+		Freq:   serviceDuration("announce freq"),
+		server: server,
+		id:     base64.StdEncoding.EncodeToString(id),
+		peers:  make(map[string]*lanPeer),
+	}, nil
+}
+
+// Run announces every Freq and listens for other daemons until ctx is done.
+func (dis *Discovery) Run(ctx context.Context) error {
+	conn, e := net.ListenMulticastUDP("udp4", dis.Iface, dis.Group)
+	if e != nil {
+		return e
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go dis.listen(conn)
+	for {
+		err.Log(dis.announce())
+		timer := time.NewTimer(dis.Freq)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+func (dis *Discovery) collections() []string {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, shared := range dis.server.list(nil) {
+		if !seen[shared.Collection] {
+			seen[shared.Collection] = true
+			ids = append(ids, shared.Collection)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// announce sends from an address on Iface, which is how the interface a
+// multicast goes out on is picked.
+func (dis *Discovery) announce() error {
+	ids := dis.collections()
+	if len(ids) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	e := gob.NewEncoder(&buf).Encode(&announcement{
+		ID:          dis.id,
+		Port:        dis.Port,
+		Collections: ids,
+	})
+	if e != nil {
+		return e
+	}
+	var from *net.UDPAddr
+	if dis.Iface != nil {
+		addrs, e := dis.Iface.Addrs()
+		if e != nil {
+			return e
+		}
+		for _, addr := range addrs {
+			if ip, ok := addr.(*net.IPNet); ok && ip.IP.To4() != nil {
+				from = &net.UDPAddr{IP: ip.IP}
+				break
+			}
+		}
+	}
+	conn, e := net.DialUDP("udp4", from, dis.Group)
+	if e != nil {
+		return e
+	}
+	defer conn.Close()
+	_, e = conn.Write(buf.Bytes())
+	return e
+}
+
+func (dis *Discovery) listen(conn *net.UDPConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, e := conn.ReadFromUDP(buf)
+		if e != nil {
+			return
+		}
+		ann := &announcement{}
+		if gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(ann) != nil || ann.ID == dis.id || ann.Port <= 0 {
+			continue
+		}
+		dis.heard(net.JoinHostPort(from.IP.String(), strconv.Itoa(ann.Port)), ann.Collections, time.Now())
+	}
+}
+
+// heard records an announcement, and calls Found if it's a new peer with a
+// collection we have.
+func (dis *Discovery) heard(addr string, collections []string, t time.Time) {
+	mine := make(map[string]bool)
+	for _, id := range dis.collections() {
+		mine[id] = true
+	}
+	var shared []string
+	for _, id := range collections {
+		if mine[id] {
+			shared = append(shared, id)
+		}
+	}
+	dis.mux.Lock()
+	peer, known := dis.peers[addr]
+	if len(shared) == 0 {
+		delete(dis.peers, addr)
+	} else {
+		dis.peers[addr] = &lanPeer{collections: shared, seen: t}
+	}
+	dis.mux.Unlock()
+	if len(shared) > 0 && (!known || dis.expired(peer, t)) {
+		err.Debug("Found peer: ", addr)
+		if dis.Found != nil {
+			dis.Found(addr)
+		}
+	}
+}
+
+// a peer that's missed 3 announcements is gone
+func (dis *Discovery) expired(peer *lanPeer, t time.Time) bool {
+	return t.Sub(peer.seen) > 3*dis.Freq
+}
+
+// Peers are the addresses of the peers that have a collection we have, that
+// have been heard from recently.
+func (dis *Discovery) Peers() []string {
+	t := time.Now()
+	dis.mux.Lock()
+	defer dis.mux.Unlock()
+	var addrs []string
+	for addr, peer := range dis.peers {
+		if dis.expired(peer, t) {
+			delete(dis.peers, addr)
+		} else {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
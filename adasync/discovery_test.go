@@ -0,0 +1,98 @@
+package adasync
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func loopback(t *testing.T) *net.Interface {
+	ifaces, e := net.Interfaces()
+	if e != nil {
+		t.Skip(e)
+	}
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback != 0 && ifaces[i].Flags&net.FlagUp != 0 {
+			return &ifaces[i]
+		}
+	}
+	t.Skip("No loopback interface")
+	return nil
+}
+
+func TestDiscovery(t *testing.T) {
+	lo := loopback(t)
+	free, e := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if e != nil {
+		t.Fatal(e)
+	}
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 77, 78), Port: free.LocalAddr().(*net.UDPAddr).Port}
+	free.Close()
+
+	// the servers need a key, it's kept out of the source tree
+	Settings["peer key"] = tempInstanceDir(t) + "/peer.key"
+	defer delete(Settings, "peer key")
+
+	music := New()
+	photos := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mux sync.Mutex
+	found := make(map[int][]string)
+	var daemons []*Discovery
+	for i, c := range []*Collection{music, music, photos} {
+		s := NewPeerServer(nil)
+		s.Share(c.AddInstance("/daemon" + strconv.Itoa(i)))
+		port := 1000 + i
+		dis := &Discovery{
+			Group:  group,
+			Iface:  lo,
+			Port:   port,
+			Freq:   20 * time.Millisecond,
+			server: s,
+			id:     strconv.Itoa(i),
+			peers:  make(map[string]*lanPeer),
+			Found: func(addr string) {
+				mux.Lock()
+				found[port] = append(found[port], addr)
+				mux.Unlock()
+			},
+		}
+		if conn, e := net.ListenMulticastUDP("udp4", lo, group); e != nil {
+			t.Skip("No multicast on loopback: ", e)
+		} else {
+			conn.Close()
+		}
+		go dis.Run(ctx)
+		daemons = append(daemons, dis)
+	}
+
+	for i := 0; i < 100 && (len(daemons[0].Peers()) == 0 || len(daemons[1].Peers()) == 0); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if peers := daemons[0].Peers(); len(peers) != 1 || peers[0] != "127.0.0.1:1001" {
+		t.Error("Expected the first daemon to find the second: ", peers)
+	}
+	if peers := daemons[1].Peers(); len(peers) != 1 || peers[0] != "127.0.0.1:1000" {
+		t.Error("Expected the second daemon to find the first: ", peers)
+	}
+	if peers := daemons[2].Peers(); len(peers) != 0 {
+		t.Error("Should only find peers with the same collections: ", peers)
+	}
+	mux.Lock()
+	if len(found[1000]) != 1 || len(found[1002]) != 0 {
+		t.Error("Found should be called once for each new peer: ", found)
+	}
+	mux.Unlock()
+
+	// a peer that stops announcing is dropped
+	daemons[0].heard("127.0.0.1:2000", []string{music.IdStr()}, time.Now().Add(-time.Second))
+	for _, addr := range daemons[0].Peers() {
+		if addr == "127.0.0.1:2000" {
+			t.Error("Expected old peer to expire")
+		}
+	}
+}
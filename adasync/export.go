@@ -0,0 +1,388 @@
+package adasync
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	proto "github.com/golang/protobuf/proto"
+	"io"
+	"time"
+)
+
+// ExportInstance is a human readable form of a SerialInstance. It's meant for
+// debugging, hand repair and writing test fixtures, ImportCollection will turn
+// it back into a .collection file.
+type ExportInstance struct {
+	Collection  string               `json:"collection"`
+	Instance    string               `json:"instance"`
+	Directories []*ExportResource    `json:"directories"`
+	Resources   []*ExportResource    `json:"resources"`
+	Trash       []*ExportTrash       `json:"trash,omitempty"`
+	Registry    []*ExportInstanceRef `json:"registry,omitempty"`
+	Forgotten   []string             `json:"forgotten,omitempty"`
+}
+
+type ExportResource struct {
+	ID         string            `json:"id"`
+	Hash       string            `json:"hash"`
+	Size       int64             `json:"size,omitempty"`
+	Offset     uint32            `json:"offset,omitempty"`
+	Checkpoint uint32            `json:"checkpoint,omitempty"`
+	History    []*ExportPathNode `json:"history"`
+	SeenBy     []string          `json:"seenBy,omitempty"`
+}
+
+// ExportPathNode is one entry in a resource's history. Path is fully
+// resolved using the current names of the directories. Parent is the
+// directory ID, if it's left out when importing, the directory is found by
+// the path.
+type ExportPathNode struct {
+	Path   string            `json:"path"`
+	Parent string            `json:"parent,omitempty"`
+	Clock  map[string]uint64 `json:"clock,omitempty"`
+	Time   *time.Time        `json:"time,omitempty"`
+}
+
+type ExportTrash struct {
+	ID      string    `json:"id"`
+	Deleted time.Time `json:"deleted"`
+	Size    int64     `json:"size,omitempty"`
+}
+
+type ExportInstanceRef struct {
+	ID       string    `json:"id"`
+	Label    string    `json:"label,omitempty"`
+	LastSync time.Time `json:"lastSync,omitempty"`
+	Device   string    `json:"device,omitempty"`
+	Path     string    `json:"path,omitempty"`
+}
+
+// rootId is the ID every instance gives it's root directory
+func rootId() *Hash {
+	id := Hash(md5.Sum(append(make([]byte, md5.Size), '/')))
+	return &id
+}
+
+// ExportCollection writes the state of the instance at pathStr as JSON.
+func ExportCollection(pathStr string, w io.Writer) error {
+	buf, e := readFile(pathStr + "/.collection")
+	if e != nil {
+		return e
+	}
+	data, e := verifyChecksum(buf)
+	if e != nil && e != ErrNoChecksum {
+		return e
+	}
+	wrapper := &VersionWrapper{}
+	if e := proto.Unmarshal(data, wrapper); e != nil {
+		return e
+	}
+	sIns, e := migrate(wrapper)
+	if e != nil {
+		return e
+	}
+	out, e := json.MarshalIndent(sIns.Export(), "", "  ")
+	if e != nil {
+		return e
+	}
+	_, e = w.Write(append(out, '\n'))
+	return e
+}
+
+// ImportCollection reads JSON written by ExportCollection and writes it to
+// the .collection file at pathStr. The current file is kept as the previous
+// generation.
+func ImportCollection(pathStr string, r io.Reader) error {
+	exp := &ExportInstance{}
+	if e := json.NewDecoder(r).Decode(exp); e != nil {
+		return e
+	}
+	sIns, e := exp.Serial()
+	if e != nil {
+		return e
+	}
+	data, e := proto.Marshal(sIns)
+	if e != nil {
+		return e
+	}
+	data, e = proto.Marshal(&VersionWrapper{
+		Version:  version,
+		Instance: data,
+	})
+	if e != nil {
+		return e
+	}
+	return writeAtomic(pathStr+"/.collection", withChecksum(data), pathStr+"/.prev.collection")
+}
+
+// pathResolver turns parent IDs into directory paths
+type pathResolver struct {
+	dirs map[string]*SerialResource
+}
+
+func (pr *pathResolver) dirPath(parentID []byte, depth int) string {
+	dir, ok := pr.dirs[encode(parentID)]
+	if !ok || depth > len(pr.dirs) {
+		return "/"
+	}
+	// a deleted directory is shown where it was before it was deleted
+	for i := len(dir.PathNodes) - 1; i >= 0; i-- {
+		if spn := dir.PathNodes[i]; len(spn.ParentID) == md5.Size {
+			return pr.dirPath(spn.ParentID, depth+1) + string(spn.Name)
+		}
+	}
+	return "/"
+}
+
+func (pr *pathResolver) nodePath(spn *SerialPathNode) string {
+	if len(spn.ParentID) != md5.Size {
+		return string(spn.Name)
+	}
+	return pr.dirPath(spn.ParentID, 0) + string(spn.Name)
+}
+
+func encode(bs []byte) string {
+	return base64.StdEncoding.EncodeToString(bs)
+}
+
+func exportId(bs []byte) string {
+	if len(bs) != md5.Size {
+		return ""
+	}
+	return formatUUID(HashFromBytes(bs))
+}
+
+// Export converts the instance to it's human readable form
+func (sIns *SerialInstance) Export() *ExportInstance {
+	pr := &pathResolver{
+		dirs: make(map[string]*SerialResource),
+	}
+	for _, sDir := range sIns.Directories {
+		pr.dirs[encode(sDir.ID)] = sDir
+	}
+	seen := make(map[string][]string)
+	for _, sTomb := range sIns.Tombstones {
+		for _, id := range sTomb.SeenBy {
+			seen[encode(sTomb.ID)] = append(seen[encode(sTomb.ID)], exportId(id))
+		}
+	}
+	exportRes := func(sRes *SerialResource) *ExportResource {
+		res := &ExportResource{
+			ID:         encode(sRes.ID),
+			Hash:       encode(sRes.Hash),
+			Size:       sRes.Size,
+			Offset:     sRes.Offset,
+			Checkpoint: sRes.Checkpoint,
+			SeenBy:     seen[encode(sRes.ID)],
+		}
+		for _, spn := range sRes.PathNodes {
+			pn := &ExportPathNode{
+				Path: pr.nodePath(spn),
+			}
+			if len(spn.ParentID) == md5.Size {
+				pn.Parent = encode(spn.ParentID)
+			}
+			if len(spn.Clock) > 0 {
+				pn.Clock = make(map[string]uint64)
+				for _, entry := range spn.Clock {
+					pn.Clock[exportId(entry.Instance)] = entry.Count
+				}
+			}
+			if spn.Time != 0 {
+				t := time.Unix(0, spn.Time).UTC()
+				pn.Time = &t
+			}
+			res.History = append(res.History, pn)
+		}
+		return res
+	}
+
+	exp := &ExportInstance{
+		Collection: sIns.IdStr(),
+		Instance:   exportId(sIns.InstanceId),
+	}
+	for _, sDir := range sIns.Directories {
+		exp.Directories = append(exp.Directories, exportRes(sDir))
+	}
+	for _, sRes := range sIns.Resources {
+		exp.Resources = append(exp.Resources, exportRes(sRes))
+	}
+	for _, sEntry := range sIns.Trash {
+		exp.Trash = append(exp.Trash, &ExportTrash{
+			ID:      encode(sEntry.ID),
+			Deleted: time.Unix(sEntry.Deleted, 0).UTC(),
+			Size:    sEntry.Size,
+		})
+	}
+	for _, sInfo := range sIns.Registry {
+		info := sInfo.unmarshal()
+		exp.Registry = append(exp.Registry, &ExportInstanceRef{
+			ID:       info.UUID(),
+			Label:    info.Label,
+			LastSync: info.LastSync.UTC(),
+			Device:   info.Device,
+			Path:     info.Path,
+		})
+	}
+	for _, id := range sIns.ForgottenInstances {
+		exp.Forgotten = append(exp.Forgotten, exportId(id))
+	}
+	return exp
+}
+
+func importHash(str string) ([]byte, error) {
+	bs, e := base64.StdEncoding.DecodeString(str)
+	if e == nil && len(bs) != md5.Size {
+		e = errors.New("Incorrect hash length: " + str)
+	}
+	return bs, e
+}
+
+func importId(str string) ([]byte, error) {
+	id, e := parseInstanceId(str)
+	if e != nil {
+		return nil, e
+	}
+	return id[:], nil
+}
+
+// Serial converts the human readable form back into a SerialInstance. Any
+// history node without a parent is placed in the directory that currently
+// has the path of it's parent.
+func (exp *ExportInstance) Serial() (*SerialInstance, error) {
+	sIns := &SerialInstance{}
+	var e error
+	if sIns.CollectionId, e = base64.StdEncoding.DecodeString(exp.Collection); e != nil {
+		return nil, e
+	}
+	if exp.Instance != "" {
+		if sIns.InstanceId, e = importId(exp.Instance); e != nil {
+			return nil, e
+		}
+	}
+
+	// directories by their current path, so paths can be turned back into
+	// parent IDs
+	dirsByPath := map[string][]byte{
+		"/": rootId()[:],
+	}
+	for _, dir := range exp.Directories {
+		if l := len(dir.History); l > 0 {
+			if dirsByPath[dir.History[l-1].Path], e = importHash(dir.ID); e != nil {
+				return nil, e
+			}
+		}
+	}
+
+	importRes := func(res *ExportResource) (*SerialResource, error) {
+		sRes := &SerialResource{
+			Size:       res.Size,
+			Offset:     res.Offset,
+			Checkpoint: res.Checkpoint,
+		}
+		var e error
+		if sRes.ID, e = importHash(res.ID); e != nil {
+			return nil, e
+		}
+		if sRes.Hash, e = importHash(res.Hash); e != nil {
+			return nil, e
+		}
+		for _, pn := range res.History {
+			dir, name := split(pn.Path)
+			spn := &SerialPathNode{
+				Name:     []byte(name),
+				ParentID: []byte{0},
+			}
+			if pn.Parent != "" {
+				if spn.ParentID, e = importHash(pn.Parent); e != nil {
+					return nil, e
+				}
+			} else if dir != "" {
+				parentID, ok := dirsByPath[dir]
+				if !ok {
+					return nil, errors.New("No directory for: " + pn.Path)
+				}
+				spn.ParentID = parentID
+			}
+			for insId, count := range pn.Clock {
+				id, e := importId(insId)
+				if e != nil {
+					return nil, e
+				}
+				spn.Clock = append(spn.Clock, &SerialClockEntry{
+					Instance: id,
+					Count:    count,
+				})
+			}
+			if pn.Time != nil {
+				spn.Time = pn.Time.UnixNano()
+			}
+			sRes.PathNodes = append(sRes.PathNodes, spn)
+		}
+		if len(res.SeenBy) > 0 {
+			sTomb := &SerialTombstone{
+				ID: sRes.ID,
+			}
+			for _, insId := range res.SeenBy {
+				id, e := importId(insId)
+				if e != nil {
+					return nil, e
+				}
+				sTomb.SeenBy = append(sTomb.SeenBy, id)
+			}
+			sIns.Tombstones = append(sIns.Tombstones, sTomb)
+		}
+		return sRes, nil
+	}
+
+	for _, dir := range exp.Directories {
+		sDir, e := importRes(dir)
+		if e != nil {
+			return nil, e
+		}
+		sIns.Directories = append(sIns.Directories, sDir)
+	}
+	for _, res := range exp.Resources {
+		sRes, e := importRes(res)
+		if e != nil {
+			return nil, e
+		}
+		sIns.Resources = append(sIns.Resources, sRes)
+	}
+	for _, entry := range exp.Trash {
+		id, e := importHash(entry.ID)
+		if e != nil {
+			return nil, e
+		}
+		sIns.Trash = append(sIns.Trash, &SerialTrashEntry{
+			ID:      id,
+			Deleted: entry.Deleted.Unix(),
+			Size:    entry.Size,
+		})
+	}
+	for _, ref := range exp.Registry {
+		id, e := importId(ref.ID)
+		if e != nil {
+			return nil, e
+		}
+		info := &SerialInstanceInfo{
+			ID:     id,
+			Label:  ref.Label,
+			Device: ref.Device,
+			Path:   ref.Path,
+		}
+		if !ref.LastSync.IsZero() {
+			info.LastSync = ref.LastSync.Unix()
+		}
+		sIns.Registry = append(sIns.Registry, info)
+	}
+	for _, insId := range exp.Forgotten {
+		id, e := importId(insId)
+		if e != nil {
+			return nil, e
+		}
+		sIns.ForgottenInstances = append(sIns.ForgottenInstances, id)
+	}
+	return sIns, nil
+}
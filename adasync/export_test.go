@@ -0,0 +1,88 @@
+package adasync
+
+import (
+	"bytes"
+	"encoding/json"
+	proto "github.com/golang/protobuf/proto"
+	"testing"
+)
+
+func exportTestInstance(t *testing.T) *SerialInstance {
+	c := New()
+	a := c.AddInstance("/a")
+	if !a.root.ID.Equal(rootId()) {
+		t.Error("Root ID does not match rootId()")
+	}
+	music := a.AddDirectory(&Hash{}, a.root, "music/")
+	rock := a.AddDirectory(&Hash{}, music, "rock/")
+	hash := HashFromBytes([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	song := a.AddResource(hash, 100, music, "song.mp3")
+	song.PathNodes.Record(a.PathNode(rock, "song.mp3"))
+
+	wrapper := &VersionWrapper{}
+	if e := proto.Unmarshal(a.Marshal(), wrapper); e != nil {
+		t.Fatal(e)
+	}
+	sIns, e := migrate(wrapper)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return sIns
+}
+
+func TestExport(t *testing.T) {
+	exp := exportTestInstance(t).Export()
+	if len(exp.Resources) != 1 {
+		t.Fatal("Expected 1 resource")
+	}
+	history := exp.Resources[0].History
+	if len(history) != 2 || history[0].Path != "/music/song.mp3" || history[1].Path != "/music/rock/song.mp3" {
+		t.Error("Incorrect history paths")
+	}
+	if len(history[1].Clock) != 1 {
+		t.Error("Expected clock to be exported")
+	}
+
+	buf, e := json.Marshal(exp)
+	if e != nil {
+		t.Fatal(e)
+	}
+	imp := &ExportInstance{}
+	if e := json.Unmarshal(buf, imp); e != nil {
+		t.Fatal(e)
+	}
+	sIns, e := imp.Serial()
+	if e != nil {
+		t.Fatal(e)
+	}
+	again, _ := json.Marshal(sIns.Export())
+	if !bytes.Equal(buf, again) {
+		t.Error("Export did not round trip:\n" + string(buf) + "\n" + string(again))
+	}
+}
+
+func TestImportByPath(t *testing.T) {
+	sIns := exportTestInstance(t)
+	exp := sIns.Export()
+	for _, res := range append(exp.Directories, exp.Resources...) {
+		for _, pn := range res.History {
+			pn.Parent = ""
+		}
+	}
+	imp, e := exp.Serial()
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i, sRes := range sIns.Resources {
+		for j, spn := range sRes.PathNodes {
+			if !bytes.Equal(spn.ParentID, imp.Resources[i].PathNodes[j].ParentID) {
+				t.Error("Parent not resolved from path: " + exp.Resources[i].History[j].Path)
+			}
+		}
+	}
+
+	exp.Resources[0].History[0].Path = "/nowhere/song.mp3"
+	if _, e := exp.Serial(); e == nil {
+		t.Error("Expected error for unknown directory")
+	}
+}
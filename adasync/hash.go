@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/base64"
+	"errors"
 )
 
 type Hash [md5.Size]byte
@@ -21,6 +22,18 @@ func (hash *Hash) String() string {
 	return base64.StdEncoding.EncodeToString(hash[:])
 }
 
+// DecodeHash is the inverse of Hash.String
+func DecodeHash(str string) (*Hash, error) {
+	bs, e := base64.StdEncoding.DecodeString(str)
+	if e != nil {
+		return nil, e
+	}
+	if len(bs) != md5.Size {
+		return nil, errors.New("Incorrect hash length")
+	}
+	return HashFromBytes(bs), nil
+}
+
 func (hash *Hash) Bytes() []byte {
 	return hash[:]
 }
@@ -0,0 +1,24 @@
+package adasync
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// tempInstanceDir makes a temp directory with dirs in it, like "/a/music",
+// that's removed when the test is done. The path has forward slashes.
+func tempInstanceDir(t *testing.T, dirs ...string) string {
+	tmp, e := ioutil.TempDir("", "adasync")
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmp) })
+	tmp = toSlash(tmp)
+	for _, dir := range dirs {
+		if e := os.MkdirAll(tmp+dir, 0700); e != nil {
+			t.Fatal(e)
+		}
+	}
+	return tmp
+}
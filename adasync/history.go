@@ -0,0 +1,126 @@
+package adasync
+
+import (
+	"strconv"
+)
+
+// checkpoint finds every resource that has the same history in all the open
+// instances of the collection and records how long that shared history is.
+// Only history before the checkpoint can be compacted, so nothing is dropped
+// until every instance we know about has it, including ".deleted" nodes. If
+// an instance in the registry isn't open, like a drive in a drawer, we can't
+// know what it has, so the checkpoint isn't moved until it's back.
+func (c *Collection) checkpoint() {
+	if len(c.instances) < 2 || !c.allOpen() {
+		return
+	}
+	var first *Instance
+	for _, ins := range c.instances {
+		first = ins
+		break
+	}
+	for id := range first.resources {
+		histories := make([]*PathNodes, 0, len(c.instances))
+		for _, ins := range c.instances {
+			if res, ok := ins.resources[id]; ok {
+				histories = append(histories, res.PathNodes)
+			}
+		}
+		setCheckpoint(histories, len(c.instances))
+	}
+	for id, dir := range first.directories {
+		if dir == first.root {
+			continue
+		}
+		histories := make([]*PathNodes, 0, len(c.instances))
+		for _, ins := range c.instances {
+			if dir, ok := ins.directories[id]; ok {
+				histories = append(histories, dir.PathNodes)
+			}
+		}
+		setCheckpoint(histories, len(c.instances))
+	}
+}
+
+// allOpen is true if every instance in the registry that hasn't been
+// forgotten is open.
+func (c *Collection) allOpen() bool {
+	open := make(map[string]bool, len(c.instances))
+	for _, ins := range c.instances {
+		open[ins.id.String()] = true
+	}
+	for _, info := range c.Registry() {
+		idStr := info.ID.String()
+		if open[idStr] {
+			continue
+		}
+		forgotten := false
+		for _, ins := range c.instances {
+			if _, ok := ins.forgotten[idStr]; ok {
+				forgotten = true
+				break
+			}
+		}
+		if !forgotten {
+			return false
+		}
+	}
+	return true
+}
+
+func setCheckpoint(histories []*PathNodes, instances int) {
+	if len(histories) != instances {
+		return
+	}
+	for _, pns := range histories[1:] {
+		if histories[0].DiffAt(pns) != -1 {
+			return
+		}
+	}
+	l := histories[0].Len()
+	for _, pns := range histories {
+		if pns.checkpoint != l {
+			pns.checkpoint = l
+			pns.Last().Instance.dirty = true
+		}
+	}
+}
+
+// CompactHistory drops the oldest nodes from the history of any resource that
+// is longer than the "max history size" setting. History after the checkpoint
+// is always kept. A max history size of 0 turns off compaction.
+func (ins *Instance) CompactHistory() {
+	max, _ := strconv.Atoi(ins.GetSetting("max history size"))
+	if max <= 0 {
+		return
+	}
+	for _, res := range ins.resources {
+		if res.PathNodes.compact(max) {
+			ins.dirty = true
+		}
+	}
+	for _, dir := range ins.directories {
+		if dir.PathNodes.compact(max) {
+			ins.dirty = true
+		}
+	}
+}
+
+// compact keeps at most max nodes, but won't drop anything at or after the
+// checkpoint. It returns true if any nodes were dropped.
+func (pns *PathNodes) compact(max int) bool {
+	if last := pns.Last(); last != nil && last.IsDeleted() && max < 2 {
+		// keep where it was deleted from so it can still be restored
+		max = 2
+	}
+	offset := pns.Len() - max
+	if offset > pns.checkpoint {
+		offset = pns.checkpoint
+	}
+	if offset <= pns.offset {
+		return false
+	}
+	pns.nodes = append([]*PathNode(nil), pns.nodes[offset-pns.offset:]...)
+	pns.offset = offset
+	return true
+}
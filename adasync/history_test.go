@@ -0,0 +1,139 @@
+package adasync
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testHistory(names ...string) *PathNodes {
+	pns := NewPathNodes(len(names))
+	for i, name := range names {
+		pns.nodes[i] = &PathNode{Name: name}
+	}
+	return pns
+}
+
+func TestCompact(t *testing.T) {
+	pns := testHistory("a", "b", "c", "d", "e")
+	if pns.compact(2) {
+		t.Error("Should not compact without a checkpoint")
+	}
+	pns.checkpoint = 2
+	if !pns.compact(2) {
+		t.Error("Expected compaction")
+	}
+	if pns.offset != 2 || pns.Len() != 5 || pns.nodes[0].Name != "c" {
+		t.Error("Should only compact up to the checkpoint")
+	}
+	pns.checkpoint = 5
+	pns.compact(2)
+	if pns.offset != 3 || pns.Len() != 5 || pns.nodes[0].Name != "d" {
+		t.Error("Should keep max nodes")
+	}
+
+	deleted := testHistory("a", "b", "c", ".deleted")
+	deleted.checkpoint = 4
+	deleted.compact(1)
+	if len(deleted.nodes) != 2 || deleted.nodes[0].Name != "c" {
+		t.Error("Should keep the location a deleted resource can be restored to")
+	}
+}
+
+func TestDiffAtCompacted(t *testing.T) {
+	a := testHistory("a", "b", "c", "d")
+	b := testHistory("a", "b", "c", "d", "e")
+	a.checkpoint = 4
+	a.compact(1)
+	if i := a.DiffAt(b); i != 4 {
+		t.Error("Expected 4, got ", i)
+	}
+	b.checkpoint = 4
+	b.compact(2)
+	if i := a.DiffAt(b); i != 4 {
+		t.Error("Expected 4, got ", i)
+	}
+	b.nodes[len(b.nodes)-2] = &PathNode{Name: "x"}
+	if i := a.DiffAt(b); i != 3 {
+		t.Error("Expected 3, got ", i)
+	}
+
+	// a history that ends before the compacted part isn't a prefix
+	short := testHistory("a", "b")
+	if i := a.DiffAt(short); i == -1 || i == short.Len() || i == a.Len() {
+		t.Error("Expected a difference, got ", i)
+	}
+	short = testHistory("a", "b", "c")
+	if i := a.DiffAt(short); i != 3 {
+		t.Error("Expected 3, got ", i)
+	}
+}
+
+func TestCopyNodesCompacted(t *testing.T) {
+	ins := &Instance{}
+	from := testHistory("a", "b", "c", "d", "e")
+	from.checkpoint = 4
+	from.compact(2)
+	to := testHistory("a", "b", "c", "d")
+	to.nodes[3].Instance = ins
+	copyNodes(from, to, 4)
+	if to.Len() != 5 || to.DiffAt(from) != -1 {
+		t.Error("Expected histories to match")
+	}
+
+	to = testHistory("a")
+	to.nodes[0].Instance = ins
+	copyNodes(from, to, 1)
+	if to.Len() != 5 || to.offset != from.offset || to.DiffAt(from) != -1 {
+		t.Error("Expected to take compacted history")
+	}
+}
+
+func TestCheckpointWaitsForOffline(t *testing.T) {
+	tmp := tempInstanceDir(t, "/a", "/b", "/usb")
+	ioutil.WriteFile(tmp+"/a/song.mp3", []byte("song"), 0600)
+	a, e := Init(tmp+"/a", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, _ := Init(tmp+"/b", a.CollectionId())
+	usb, _ := Init(tmp+"/usb", a.CollectionId())
+	SyncInstances(a, b)
+	SyncInstances(a, usb)
+	SyncInstances(a, b)
+	var id string
+	for id = range usb.resources {
+	}
+	known := usb.resources[id].PathNodes.Len()
+
+	// the usb drive is put in a drawer while the others keep changing
+	c := a.collection
+	delete(c.instances, usb.pathStr)
+	usb.offline = true
+	for _, ins := range []*Instance{a, b} {
+		ins.settings["max history size"] = "1"
+	}
+	for _, name := range []string{"/one.mp3", "/two.mp3", "/three.mp3"} {
+		old := a.resources[id].FullPath()
+		os.Rename(old, tmp+"/a"+name)
+		SyncInstances(a, b)
+	}
+	for _, ins := range []*Instance{a, b} {
+		if pns := ins.resources[id].PathNodes; pns.offset > known {
+			t.Error("Compacted history the offline instance hasn't seen: ", pns.offset, known)
+		}
+	}
+
+	// it was moved on the drive too, so the histories have to be compared
+	os.Rename(tmp+"/usb/song.mp3", tmp+"/usb/usb.mp3")
+	usb.offline = false
+	c.instances[usb.pathStr] = usb
+	usb.SelfUpdate()
+	if i := a.resources[id].PathNodes.DiffAt(usb.resources[id].PathNodes); i == -1 || i == usb.resources[id].PathNodes.Len() {
+		t.Error("The drive's history should not look like a prefix: ", i)
+	}
+	SyncInstances(a, usb)
+	if a.resources[id].PathNodes.DiffAt(usb.resources[id].PathNodes) != -1 {
+		t.Error("Expected the histories to agree after the sync")
+	}
+}
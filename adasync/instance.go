@@ -3,26 +3,37 @@ package adasync
 import (
 	"crypto/md5"
 	"encoding/base64"
+	"errors"
 	"github.com/adamcolton/err"
 	proto "github.com/golang/protobuf/proto"
 	"math/rand"
+	"os"
 	"strings"
+	"time"
 )
 
 const readOnlyIdLen = 10
-const version = uint32(1)
+const version = uint32(2)
 
 var instances = make(map[Path]*Instance)
 
 type Instance struct {
+	id          *Hash
 	collection  *Collection
 	pathStr     string
 	resources   map[string]*Resource
 	directories map[string]*Directory
 	root        *Directory
 	settings    map[string]string
+	trash       map[string]*TrashEntry
+	registry    map[string]*InstanceInfo // other instances of the collection
+	lastSync    time.Time
+	forgotten   map[string]*Hash
+	tombstones  map[string]map[string]*Hash // resource id -> instances that have seen the delete
 	dirty       bool
 	isNew       bool
+	offline     bool // the drive it's on was unmounted
+	statsDirty  bool // only the directory stats changed, written but not sync'd
 }
 
 // generateResourceId takes a resource hash and path and will generate an ID
@@ -93,11 +104,25 @@ func (ins *Instance) Marshal() []byte {
 			i++
 		}
 	}
-	sIns, e := proto.Marshal(&SerialInstance{
+	sStats := make([]*SerialDirStat, 0, len(ins.directories))
+	for _, dir := range ins.directories {
+		if dir.modTime != 0 {
+			sStats = append(sStats, dir.serializeStat())
+		}
+	}
+	sTrash := make([]*SerialTrashEntry, 0, len(ins.trash))
+	for _, entry := range ins.trash {
+		sTrash = append(sTrash, entry.Serialize())
+	}
+	serial := &SerialInstance{
 		CollectionId: ins.collection.id[:],
 		Resources:    sRes,
 		Directories:  sDirs,
-	})
+		Trash:        sTrash,
+		DirStats:     sStats,
+	}
+	ins.serializePeers(serial)
+	sIns, e := proto.Marshal(serial)
 	err.Warn(e)
 	sIns, e = proto.Marshal(&VersionWrapper{
 		Version:  version,
@@ -111,22 +136,29 @@ func (sIns *SerialInstance) IdStr() string {
 	return base64.StdEncoding.EncodeToString(sIns.CollectionId)
 }
 
-func Unmarshal(buf []byte, pathStr string) *Instance {
+// Unmarshal reads an instance from the contents of a .collection file,
+// upgrading it if it was written by an older version.
+func Unmarshal(buf []byte, pathStr string) (*Instance, error) {
+	ins, _, e := unmarshal(buf, pathStr)
+	return ins, e
+}
+
+// unmarshal also returns the version the instance was written with
+func unmarshal(buf []byte, pathStr string) (*Instance, uint32, error) {
 	versionWrapper := &VersionWrapper{}
-	proto.Unmarshal(buf, versionWrapper)
-	if versionWrapper.Version != version {
-		// In the future, this will handle updating between versions
-		// but right now there is only version 1
-		err.Debug("Version) Expected: ", version, " Got:", versionWrapper.Version)
-	}
-	sIns := &SerialInstance{}
-	proto.Unmarshal(versionWrapper.Instance, sIns)
+	if e := proto.Unmarshal(buf, versionWrapper); e != nil {
+		return nil, 0, e
+	}
+	sIns, e := migrate(versionWrapper)
+	if e != nil {
+		return nil, versionWrapper.Version, e
+	}
 	collection, ok := collections[sIns.IdStr()]
 	if !ok {
 		collection = New(sIns.CollectionId...)
 	} else if ins, ok := collection.instances[pathStr]; ok {
 		// oh, we already had a handle to that instance
-		return ins
+		return ins, versionWrapper.Version, nil
 	}
 	// --- populate instance ---
 	ins := collection.AddInstance(pathStr)
@@ -141,24 +173,31 @@ func Unmarshal(buf []byte, pathStr string) *Instance {
 	for _, sRes := range sIns.Resources {
 		sRes.unmarshalInto(ins)
 	}
-	return ins
+	for _, sEntry := range sIns.Trash {
+		sEntry.unmarshalInto(ins)
+	}
+	for _, sStat := range sIns.DirStats {
+		sStat.unmarshalInto(ins)
+	}
+	sIns.unmarshalPeersInto(ins)
+	return ins, versionWrapper.Version, nil
 }
 
 func (ins *Instance) Write() {
-	if !ins.dirty {
+	if !(ins.dirty || ins.statsDirty) || ins.offline {
 		return
 	}
-	if colFile, e := filesystem.Create(ins.pathStr + "/.collection"); err.Log(e) {
-		err.Debug("Writing: ", ins.pathStr)
-		defer colFile.Close()
-		colFile.Write(ins.Marshal())
+	err.Debug("Writing: ", ins.pathStr)
+	e := writeAtomic(ins.pathStr+"/.collection", withChecksum(ins.Marshal()), ins.pathStr+"/.prev.collection")
+	if err.Log(e) {
 		for _, dir := range ins.directories {
-			if dir != ins.root {
+			if dir != ins.root && !ins.isObjectStore() {
 				dir.WriteTag()
 			}
 		}
 		ins.writeConfig()
 		ins.dirty = false
+		ins.statsDirty = false
 	}
 }
 
@@ -176,8 +215,20 @@ func (ins *Instance) writeConfig() {
 	}
 }
 
-func Open(pathStr string) *Instance {
-	ins := loadInstance(pathStr)
+// Open loads the instance at pathStr, or creates it if AdaSync hasn't run on
+// it yet. If the .collection file can't be read, the instance is not opened
+// so that the file isn't overwritten.
+func Open(pathStr string) (*Instance, error) {
+	if IsPeer(pathStr) {
+		return nil, ErrPeerPath
+	}
+	if e := openCrypt(pathStr); e != nil {
+		return nil, e
+	}
+	ins, e := loadInstance(pathStr)
+	if e != nil {
+		return nil, e
+	}
 	settings, _ := LoadConfig(pathStr + "/config.collection")
 	if ins == nil {
 		var c *Collection
@@ -204,21 +255,130 @@ func Open(pathStr string) *Instance {
 		}
 		settings["read only"] = string(readOnlyId)
 	}
+	if forget, ok := settings["forget instances"]; ok && forget != "" {
+		for _, name := range StringList(forget) {
+			if info := ins.collection.FindInstance(name); info != nil {
+				ins.forget(info.ID)
+			} else if id, e := parseInstanceId(name); err.Log(e) {
+				ins.forget(id)
+			}
+		}
+	}
 
-	return ins
+	return ins, nil
 }
 
-func loadInstance(pathStr string) *Instance {
-	if colFile, e := filesystem.Open(pathStr + "/.collection"); err.Check(e) {
-		defer colFile.Close()
-		if stat, e := colFile.Stat(); err.Log(e) {
-			b := make([]byte, stat.Size())
-			if l, e := colFile.Read(b); err.Log(e) {
-				return Unmarshal(b[:l], pathStr)
+var ErrAlreadyInstance = errors.New("Path is already an instance")
+
+// Init makes pathStr an instance and records it's contents. If id is not
+// empty, the instance joins the collection with that id, otherwise it starts
+// a new collection.
+func Init(pathStr, id string) (*Instance, error) {
+	if _, e := filesystem.Stat(pathStr + "/.collection"); e == nil {
+		return nil, ErrAlreadyInstance
+	}
+	if id != "" {
+		if _, e := base64.StdEncoding.DecodeString(id); e != nil {
+			return nil, e
+		}
+		settings, _ := LoadConfig(pathStr + "/config.collection")
+		if cur, ok := settings["id"]; ok && cur != id {
+			return nil, errors.New("config.collection already has id " + cur)
+		}
+		settings["id"] = id
+		if e := writeSettings(pathStr+"/config.collection", settings); e != nil {
+			return nil, e
+		}
+	}
+	ins, e := Open(pathStr)
+	if e != nil {
+		return nil, e
+	}
+	ins.SelfUpdate()
+	ins.Write()
+	return ins, nil
+}
+
+// InitObjectStore is Init for an instance that keeps files by their hash
+// instead of their path.
+func InitObjectStore(pathStr, id string) (*Instance, error) {
+	if _, e := filesystem.Stat(pathStr + "/.collection"); e == nil {
+		return nil, ErrAlreadyInstance
+	}
+	settings, _ := LoadConfig(pathStr + "/config.collection")
+	settings["layout"] = "objects"
+	if e := writeSettings(pathStr+"/config.collection", settings); e != nil {
+		return nil, e
+	}
+	return Init(pathStr, id)
+}
+
+func writeSettings(pathStr string, settings map[string]string) error {
+	configFile, e := filesystem.Create(pathStr)
+	if e != nil {
+		return e
+	}
+	for key, val := range settings {
+		configFile.Write([]byte(key + ":" + val + "\n"))
+	}
+	return configFile.Close()
+}
+
+// loadInstance reads the .collection file. If it's damaged, the previous
+// generation is used instead and the instance will be rewritten.
+func loadInstance(pathStr string) (*Instance, error) {
+	var eOut error
+	for i, name := range []string{"/.collection", "/.prev.collection"} {
+		buf, e := readFile(pathStr + name)
+		if e != nil {
+			if !os.IsNotExist(e) && eOut == nil {
+				eOut = e
+			}
+			continue
+		}
+		ins, e := loadFrom(pathStr, buf)
+		if _, ok := e.(*VersionError); ok {
+			return nil, e
+		}
+		if e == nil {
+			if i > 0 {
+				err.Debug("Recovered previous state: ", pathStr)
+				ins.dirty = true
 			}
+			return ins, nil
+		}
+		err.Debug("Could not read ", pathStr+name, ": ", e)
+		if eOut == nil {
+			eOut = e
+		}
+	}
+	return nil, eOut
+}
+
+func loadFrom(pathStr string, buf []byte) (*Instance, error) {
+	data, e := verifyChecksum(buf)
+	if e == ErrNoChecksum {
+		// only version 1 was written without a checksum, anything else
+		// was cut off
+		wrapper := &VersionWrapper{}
+		if proto.Unmarshal(data, wrapper) != nil || wrapper.Version != 1 {
+			return nil, e
+		}
+	} else if e != nil {
+		return nil, e
+	}
+	ins, v, e := unmarshal(data, pathStr)
+	if e != nil {
+		return nil, e
+	}
+	if v != version {
+		// keep a copy in case the upgrade went wrong
+		if e := writeBackup(pathStr, v, buf); e != nil {
+			return nil, e
 		}
+		ins.dirty = true
 	}
-	return nil
+	return ins, nil
 }
 
 func (p *PathNode) getRoot() (*PathNode, bool) {
@@ -240,6 +400,13 @@ var instanceDefaults = map[string]string{
 	"static":           "true",
 	"read only":        "false",
 	"allow duplicates": "true",
+	"trash days":       "30",
+	"trash max bytes":  "0",
+	"max history size": "0",
+	"watch":            "true",
+	"layout":           "tree",
+	"compress":         "false",
+	"cache signatures": "false",
 }
 
 // GetSetting will return the setting for the instance. If the instance does
@@ -269,6 +436,8 @@ func (ins *Instance) pathEqualsResource(res *Resource, pathStr string) bool {
 			pathSize := stat.Size()
 			if stat.IsDir() {
 				pathSize = 0
+			} else if ins.GetSetting("compress") == "true" {
+				pathSize = contentSize(pathStr, stat)
 			}
 			if pathSize != res.Size {
 				err.Debug("Size did not match", stat.Size(), res.Size, pathStr)
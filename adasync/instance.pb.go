@@ -9,8 +9,13 @@ It is generated from these files:
 	instance.proto
 
 It has these top-level messages:
+	SerialClockEntry
 	SerialPathNode
 	SerialResource
+	SerialTrashEntry
+	SerialTombstone
+	SerialInstanceInfo
+	SerialDirStat
 	SerialInstance
 	VersionWrapper
 */
@@ -25,20 +30,42 @@ var _ = proto.Marshal
 var _ = fmt.Errorf
 var _ = math.Inf
 
+type SerialClockEntry struct {
+	Instance []byte `protobuf:"bytes,1,opt,name=Instance,proto3" json:"Instance,omitempty"`
+	Count    uint64 `protobuf:"varint,2,opt,name=Count" json:"Count,omitempty"`
+}
+
+func (m *SerialClockEntry) Reset()         { *m = SerialClockEntry{} }
+func (m *SerialClockEntry) String() string { return proto.CompactTextString(m) }
+func (*SerialClockEntry) ProtoMessage()    {}
+
 type SerialPathNode struct {
-	Name     []byte `protobuf:"bytes,1,opt,name=Name,proto3" json:"Name,omitempty"`
-	ParentID []byte `protobuf:"bytes,2,opt,name=ParentID,proto3" json:"ParentID,omitempty"`
+	Name     []byte              `protobuf:"bytes,1,opt,name=Name,proto3" json:"Name,omitempty"`
+	ParentID []byte              `protobuf:"bytes,2,opt,name=ParentID,proto3" json:"ParentID,omitempty"`
+	Clock    []*SerialClockEntry `protobuf:"bytes,3,rep,name=Clock" json:"Clock,omitempty"`
+	Time     int64               `protobuf:"varint,4,opt,name=Time" json:"Time,omitempty"`
 }
 
 func (m *SerialPathNode) Reset()         { *m = SerialPathNode{} }
 func (m *SerialPathNode) String() string { return proto.CompactTextString(m) }
 func (*SerialPathNode) ProtoMessage()    {}
 
+func (m *SerialPathNode) GetClock() []*SerialClockEntry {
+	if m != nil {
+		return m.Clock
+	}
+	return nil
+}
+
 type SerialResource struct {
-	ID        []byte            `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
-	Hash      []byte            `protobuf:"bytes,2,opt,name=Hash,proto3" json:"Hash,omitempty"`
-	PathNodes []*SerialPathNode `protobuf:"bytes,3,rep,name=PathNodes" json:"PathNodes,omitempty"`
-	Size      int64             `protobuf:"varint,4,opt,name=Size" json:"Size,omitempty"`
+	ID         []byte            `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	Hash       []byte            `protobuf:"bytes,2,opt,name=Hash,proto3" json:"Hash,omitempty"`
+	PathNodes  []*SerialPathNode `protobuf:"bytes,3,rep,name=PathNodes" json:"PathNodes,omitempty"`
+	Size       int64             `protobuf:"varint,4,opt,name=Size" json:"Size,omitempty"`
+	Offset     uint32            `protobuf:"varint,5,opt,name=Offset" json:"Offset,omitempty"`
+	Checkpoint uint32            `protobuf:"varint,6,opt,name=Checkpoint" json:"Checkpoint,omitempty"`
+	BlockSize  uint32            `protobuf:"varint,7,opt,name=BlockSize" json:"BlockSize,omitempty"`
+	BlockSigs  []byte            `protobuf:"bytes,8,opt,name=BlockSigs,proto3" json:"BlockSigs,omitempty"`
 }
 
 func (m *SerialResource) Reset()         { *m = SerialResource{} }
@@ -52,10 +79,58 @@ func (m *SerialResource) GetPathNodes() []*SerialPathNode {
 	return nil
 }
 
+type SerialTrashEntry struct {
+	ID      []byte `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	Deleted int64  `protobuf:"varint,2,opt,name=Deleted" json:"Deleted,omitempty"`
+	Size    int64  `protobuf:"varint,3,opt,name=Size" json:"Size,omitempty"`
+}
+
+func (m *SerialTrashEntry) Reset()         { *m = SerialTrashEntry{} }
+func (m *SerialTrashEntry) String() string { return proto.CompactTextString(m) }
+func (*SerialTrashEntry) ProtoMessage()    {}
+
+type SerialTombstone struct {
+	ID     []byte   `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	SeenBy [][]byte `protobuf:"bytes,2,rep,name=SeenBy,proto3" json:"SeenBy,omitempty"`
+}
+
+func (m *SerialTombstone) Reset()         { *m = SerialTombstone{} }
+func (m *SerialTombstone) String() string { return proto.CompactTextString(m) }
+func (*SerialTombstone) ProtoMessage()    {}
+
+type SerialInstanceInfo struct {
+	ID       []byte `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	Label    string `protobuf:"bytes,2,opt,name=Label" json:"Label,omitempty"`
+	LastSync int64  `protobuf:"varint,3,opt,name=LastSync" json:"LastSync,omitempty"`
+	Device   string `protobuf:"bytes,4,opt,name=Device" json:"Device,omitempty"`
+	Path     string `protobuf:"bytes,5,opt,name=Path" json:"Path,omitempty"`
+}
+
+func (m *SerialInstanceInfo) Reset()         { *m = SerialInstanceInfo{} }
+func (m *SerialInstanceInfo) String() string { return proto.CompactTextString(m) }
+func (*SerialInstanceInfo) ProtoMessage()    {}
+
+type SerialDirStat struct {
+	ID       []byte `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	ModTime  int64  `protobuf:"varint,2,opt,name=ModTime" json:"ModTime,omitempty"`
+	Children uint32 `protobuf:"varint,3,opt,name=Children" json:"Children,omitempty"`
+}
+
+func (m *SerialDirStat) Reset()         { *m = SerialDirStat{} }
+func (m *SerialDirStat) String() string { return proto.CompactTextString(m) }
+func (*SerialDirStat) ProtoMessage()    {}
+
 type SerialInstance struct {
-	CollectionId []byte            `protobuf:"bytes,1,opt,name=CollectionId,proto3" json:"CollectionId,omitempty"`
-	Resources    []*SerialResource `protobuf:"bytes,2,rep,name=Resources" json:"Resources,omitempty"`
-	Directories  []*SerialResource `protobuf:"bytes,3,rep,name=Directories" json:"Directories,omitempty"`
+	CollectionId       []byte                `protobuf:"bytes,1,opt,name=CollectionId,proto3" json:"CollectionId,omitempty"`
+	Resources          []*SerialResource     `protobuf:"bytes,2,rep,name=Resources" json:"Resources,omitempty"`
+	Directories        []*SerialResource     `protobuf:"bytes,3,rep,name=Directories" json:"Directories,omitempty"`
+	Trash              []*SerialTrashEntry   `protobuf:"bytes,4,rep,name=Trash" json:"Trash,omitempty"`
+	InstanceId         []byte                `protobuf:"bytes,5,opt,name=InstanceId,proto3" json:"InstanceId,omitempty"`
+	KnownInstances     [][]byte              `protobuf:"bytes,6,rep,name=KnownInstances,proto3" json:"KnownInstances,omitempty"`
+	ForgottenInstances [][]byte              `protobuf:"bytes,7,rep,name=ForgottenInstances,proto3" json:"ForgottenInstances,omitempty"`
+	Tombstones         []*SerialTombstone    `protobuf:"bytes,8,rep,name=Tombstones" json:"Tombstones,omitempty"`
+	Registry           []*SerialInstanceInfo `protobuf:"bytes,9,rep,name=Registry" json:"Registry,omitempty"`
+	DirStats           []*SerialDirStat      `protobuf:"bytes,10,rep,name=DirStats" json:"DirStats,omitempty"`
 }
 
 func (m *SerialInstance) Reset()         { *m = SerialInstance{} }
@@ -76,6 +151,34 @@ func (m *SerialInstance) GetDirectories() []*SerialResource {
 	return nil
 }
 
+func (m *SerialInstance) GetTrash() []*SerialTrashEntry {
+	if m != nil {
+		return m.Trash
+	}
+	return nil
+}
+
+func (m *SerialInstance) GetTombstones() []*SerialTombstone {
+	if m != nil {
+		return m.Tombstones
+	}
+	return nil
+}
+
+func (m *SerialInstance) GetRegistry() []*SerialInstanceInfo {
+	if m != nil {
+		return m.Registry
+	}
+	return nil
+}
+
+func (m *SerialInstance) GetDirStats() []*SerialDirStat {
+	if m != nil {
+		return m.DirStats
+	}
+	return nil
+}
+
 type VersionWrapper struct {
 	Version  uint32 `protobuf:"varint,1,opt,name=Version" json:"Version,omitempty"`
 	Instance []byte `protobuf:"bytes,2,opt,name=Instance,proto3" json:"Instance,omitempty"`
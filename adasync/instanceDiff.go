@@ -5,16 +5,36 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"time"
 )
 
+// SelfUpdate records changes made to the instance since it was last scanned.
+// Directories that haven't changed since they were last read are skipped.
 func (ins *Instance) SelfUpdate() {
+	ins.selfUpdate(false)
+}
+
+// DeepSelfUpdate is SelfUpdate, but every directory is read.
+func (ins *Instance) DeepSelfUpdate() {
+	ins.selfUpdate(true)
+}
+
+func (ins *Instance) selfUpdate(deep bool) {
+	if ins.isObjectStore() {
+		// there's no tree to read, it's only in the state
+		return
+	}
 	err.Debug("Self Update: ", ins.pathStr)
 	diff := ins.SelfDiff()
+	diff.deep = deep
+	diff.scan()
 	// directories need to be resolved first, otherwise if a directory was
 	// renamed, every file will think it was moved.
 	diff.resolveDirectories()
 	diff.resolveFiles()
 	diff.resolveDeleted()
+	diff.recordStats()
 }
 
 // SelfDiff
@@ -27,37 +47,46 @@ func (ins *Instance) SelfDiff() *deltaSelf {
 		removedByHash: make(map[string]*Resource),
 		ins:           ins,
 		deleted:       make(map[string]*Resource),
+		removedPaths:  make(map[*Resource]string),
+		stats:         make(map[string]*dirStat),
 	}
 	return diff
 }
 
 //both are used as sets, not maps
 type deltaSelf struct {
+	dirs          []string // every directory found by scan
+	files         []string // every file found by scan
 	added         []string
 	removed       map[string]*Resource // path -> resource
 	removedByHash map[string]*Resource // hash -> resource
+	removedPaths  map[*Resource]string // directory -> it's path in removed
 	ins           *Instance
 	deleted       map[string]*Resource // id -> resource
+	deep          bool                 // read every directory
+	stats         map[string]*dirStat  // path -> directories that were read
+	known         map[string]*Directory
+	childDirs     map[*Directory][]*Directory
+	childFiles    map[*Directory][]*Resource
 }
 
-// addDirs is used to walk the directory
-func (d *deltaSelf) addDirs(pathStr string, fi os.FileInfo, _ error) error {
-	if !fi.IsDir() {
-		return nil
-	}
-
-	// sanitize pathStr
-	pathStr = PathFromString(endingSlash(pathStr), d.ins.pathStr).String()
-
-	d.checkFile(pathStr)
-	return nil
+// scan walks the instance once, collecting the directories and files so they
+// can be resolved in order.
+func (d *deltaSelf) scan() {
+	d.dirs = make([]string, 0)
+	d.files = make([]string, 0)
+	d.walk(d.collect)
 }
 
-// add adds a path to a deltaSelf. If the path is in "removed"
-// then it's a known resource and it's removed from removed
-// if not, then it's a new resources and is added to added.
-func (d *deltaSelf) addFiles(pathStr string, fi os.FileInfo, _ error) error {
+// collect is used to walk the directory
+func (d *deltaSelf) collect(pathStr string, fi os.FileInfo, _ error) error {
+	if isTrash(fi) {
+		return filepath.SkipDir
+	}
 	if fi.IsDir() {
+		// sanitize pathStr
+		pathStr = PathFromString(endingSlash(pathStr), d.ins.pathStr).String()
+		d.dirs = append(d.dirs, pathStr)
 		return nil
 	}
 	path := PathFromString(pathStr, d.ins.pathStr)
@@ -65,11 +94,13 @@ func (d *deltaSelf) addFiles(pathStr string, fi os.FileInfo, _ error) error {
 	if endsWith(path.name, ".collection") {
 		return nil
 	}
-	pathStr = path.String()
-	d.checkFile(pathStr)
+	d.files = append(d.files, path.String())
 	return nil
 }
 
+// checkFile checks a path found by scan. If the path is in "removed"
+// then it's a known resource and it's removed from removed
+// if not, then it's a new resources and is added to added.
 func (d *deltaSelf) checkFile(pathStr string) {
 	if res, ok := d.removed[pathStr]; ok && d.ins.pathEqualsResource(res, pathStr) {
 		delete(d.removed, pathStr)
@@ -82,7 +113,7 @@ func (d *deltaSelf) checkFile(pathStr string) {
 func (d *deltaSelf) resolveDeleted() {
 	for _, res := range d.removed {
 		d.ins.dirty = true
-		res.PathNodes.Add(d.ins.PathNodeFromHash(nil, ".deleted"))
+		res.PathNodes.Record(d.ins.PathNodeFromHash(nil, ".deleted"))
 	}
 }
 
@@ -94,13 +125,16 @@ func (d *deltaSelf) resolveDirectories() {
 		if pn := dir.PathNodes.Last(); pn.ParentID != nil || pn.Name != ".deleted" {
 			d.removed[pn.FullPath()] = dir.Resource
 			d.removedByHash[dir.ID.String()] = dir.Resource
+			d.removedPaths[dir.Resource] = pn.FullPath()
 		} else if pn.Name == ".deleted" {
 			d.deleted[dir.ID.String()] = dir.Resource
 		}
 	}
 
 	d.added = make([]string, 0)
-	filepath.Walk(d.ins.pathStr, d.addDirs)
+	for _, pathStr := range d.dirs {
+		d.checkFile(pathStr)
+	}
 
 	// We sort so that files will be added in an order such that a child can
 	// always add itself to it's parent. But there may be cases involving moving
@@ -118,16 +152,20 @@ func (d *deltaSelf) resolveDirectories() {
 		err.Debug(hash, newPathStr)
 		if res, ok := d.removedByHash[hash.String()]; ok {
 
+			delete(d.removed, d.removedPaths[res])
+			delete(d.removedByHash, hash.String())
+			if res.FullPath() == newPathStr {
+				// it's parent was moved, so it's already here
+				continue
+			}
+
 			// resource was moved
 			err.Debug("Moved: ", res.FullPath())
 			err.Debug("To: ", newPathStr)
-			delete(d.removed, res.FullPath())
-			delete(d.removedByHash, hash.String())
-
 			parent := res.PathNodes.Last().Parent()
 			delete(parent.directories, res.RelativePath().name)
-			res.PathNodes.Add(pathNode)
-			parent.directories[res.RelativePath().name] = d.ins.directories[res.ID.String()]
+			res.PathNodes.Record(pathNode)
+			pathNode.Parent().directories[res.RelativePath().name] = d.ins.directories[res.ID.String()]
 		} else {
 			// resource is new
 			err.Debug("Added: ", newPathStr)
@@ -152,65 +190,219 @@ func (d *deltaSelf) resolveFiles() {
 	}
 
 	d.added = make([]string, 0)
-	filepath.Walk(d.ins.pathStr, d.addFiles)
+	for _, pathStr := range d.files {
+		d.checkFile(pathStr)
+	}
 
 	for _, newPathStr := range d.added {
 		d.ins.dirty = true
 		newPath := PathFromString(newPathStr, d.ins.pathStr) //*Path
 		pathNode := d.ins.PathToNode(newPath)                //*PathNode
-		hash, _, size := newPath.Stat()
+		hash, _, size, sigs := newPath.stat(d.ins.cachesSigs())
 		if res, ok := d.removedByHash[hash.String()]; ok {
 			// resource was moved
 			err.Debug("Moved: ", res.FullPath())
 			err.Debug("To: ", newPathStr)
 			delete(d.removed, res.FullPath())
 			delete(d.removedByHash, hash.String())
-			res.PathNodes.Add(pathNode)
+			res.PathNodes.Record(pathNode)
+			if sigs != nil {
+				res.sigs = sigs
+			}
 		} else {
 			// resource is new
 			err.Debug("Added: ", newPathStr)
 			r := d.ins.AddResourceWithPath(hash, size, pathNode)
+			r.sigs = sigs
 			err.Debug(r.Size, size)
 		}
 	}
 }
 
-// BadInstanceScan this is a debugging tool
-// despite my best efforts, unit testing has not caught all the errors, this
-// can help find additional errors under real conditions
-func (ins *Instance) BadInstanceScan() {
+// racyStat is how close to the time it's read a directory can have changed
+// and still be trusted. Anything newer could change again without the mtime
+// changing, some filesystems only keep it to the nearest 2 seconds.
+const racyStat = 3 * time.Second
 
-	for _, d := range ins.directories {
-		pathNode := d.PathNodes.Last()
-		name := pathNode.Name
-		if name[len(name)-1] != '/' {
-			err.Debug("--- Bad Directory Name", d.FullPath())
+type dirStat struct {
+	modTime  int64
+	children int
+}
+
+// knownFile stands in for the FileInfo of a file in a directory that wasn't
+// read. collect only looks at the name and if it's a directory.
+type knownFile string
+
+func (f knownFile) Name() string       { return string(f) }
+func (f knownFile) Size() int64        { return 0 }
+func (f knownFile) Mode() os.FileMode  { return 0 }
+func (f knownFile) ModTime() time.Time { return time.Time{} }
+func (f knownFile) IsDir() bool        { return false }
+func (f knownFile) Sys() interface{}   { return nil }
+
+// index the live directories by full path and what's in each of them. It's
+// redone after resolving because that can move directories.
+func (d *deltaSelf) index() {
+	d.known = make(map[string]*Directory)
+	d.childDirs = make(map[*Directory][]*Directory)
+	d.childFiles = make(map[*Directory][]*Resource)
+	for _, dir := range d.ins.directories {
+		if pn := dir.PathNodes.Last(); !pn.IsDeleted() {
+			d.known[pn.FullPath()] = dir
+			if parent := pn.Parent(); parent != nil {
+				d.childDirs[parent] = append(d.childDirs[parent], dir)
+			}
 		}
-		if name != ".deleted" {
-			if root, ok := pathNode.getRoot(); !ok || root != ins.root.PathNodes.Last() {
-				err.Debug("--- Bad root", d.FullPath())
+	}
+	for _, res := range d.ins.resources {
+		if pn := res.PathNodes.Last(); !pn.IsDeleted() {
+			if parent := pn.Parent(); parent != nil {
+				d.childFiles[parent] = append(d.childFiles[parent], res)
 			}
 		}
-		if pathNode.ParentID != nil {
-			if _, ok := ins.directories[pathNode.ParentID.String()]; !ok {
-				err.Debug("--- Did not find parent", d.FullPath())
+	}
+}
+
+// walk works like filepath.Walk, except that a directory that hasn't changed
+// since it was last read isn't read again, what's in it comes from the state.
+// Directories under it are still checked, a change further down doesn't
+// change the mtime of the directories above it.
+func (d *deltaSelf) walk(fn filepath.WalkFunc) {
+	d.index()
+	fi, e := filesystem.Stat(d.ins.pathStr)
+	if err.Log(e) {
+		d.walkDir(d.ins.pathStr, fi, fn)
+	}
+}
+
+func (d *deltaSelf) walkDir(pathStr string, fi os.FileInfo, fn filepath.WalkFunc) {
+	if e := fn(pathStr, fi, nil); e != nil || !fi.IsDir() {
+		return
+	}
+	// joined by hand, filepath.Join would clean "sftp://" down to "sftp:/"
+	pathStr = strings.TrimSuffix(pathStr, "/") + "/"
+	for _, child := range d.readDir(pathStr, fi) {
+		d.walkDir(pathStr+child.Name(), child, fn)
+	}
+}
+
+// readDir returns what's in a directory sorted by name. If it's unchanged,
+// only the directories in it are stat'd.
+func (d *deltaSelf) readDir(pathStr string, fi os.FileInfo) []os.FileInfo {
+	key := endingSlash(toSlash(pathStr))
+	if dir, ok := d.known[key]; ok && !d.deep && dir.modTime != 0 && dir.modTime == fi.ModTime().UnixNano() &&
+		dir.children == len(d.childDirs[dir])+len(d.childFiles[dir]) {
+		children := make([]os.FileInfo, 0, dir.children)
+		for _, child := range d.childDirs[dir] {
+			if fi, e := filesystem.Stat(child.FullPath()); e == nil {
+				children = append(children, fi)
 			}
 		}
+		for _, res := range d.childFiles[dir] {
+			children = append(children, knownFile(res.PathNodes.Last().Name))
+		}
+		sort.Sort(byName(children))
+		return children
+	}
+
+	f, e := filesystem.Open(pathStr)
+	if !err.Log(e) {
+		return nil
+	}
+	children, e := f.Readdir(-1)
+	f.Close()
+	err.Log(e)
+	sort.Sort(byName(children))
+	stat := &dirStat{modTime: fi.ModTime().UnixNano()}
+	// a directory without a modtime, like a prefix in s3, is always read
+	if fi.ModTime().IsZero() || time.Since(fi.ModTime()) < racyStat {
+		stat.modTime = 0
 	}
+	for _, child := range children {
+		if child.IsDir() && !isTrash(child) || !child.IsDir() && !endsWith(child.Name(), ".collection") {
+			stat.children++
+		}
+	}
+	d.stats[key] = stat
+	return children
+}
+
+type byName []os.FileInfo
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name() < a[j].Name() }
 
-	for _, d := range ins.resources {
-		pathNode := d.PathNodes.Last()
+// recordStats saves the stat of every directory that was read, once they've
+// all been resolved.
+func (d *deltaSelf) recordStats() {
+	d.index()
+	for pathStr, stat := range d.stats {
+		if dir, ok := d.known[pathStr]; ok && (dir.modTime != stat.modTime || dir.children != stat.children) {
+			dir.modTime = stat.modTime
+			dir.children = stat.children
+			d.ins.statsDirty = true
+		}
+	}
+}
+
+// BadInstanceScan this is a debugging tool
+// despite my best efforts, unit testing has not caught all the errors, this
+// can help find additional errors under real conditions
+func (ins *Instance) BadInstanceScan() {
+	for _, problem := range ins.Fsck() {
+		err.Debug("--- ", problem)
+	}
+}
+
+// Fsck checks that the instance state is consistent with itself and with the
+// files on disk. It returns a description of each problem found.
+func (ins *Instance) Fsck() []string {
+	var problems []string
+	check := func(res *Resource, isDir bool) {
+		pathNode := res.PathNodes.Last()
 		name := pathNode.Name
-		if name != ".deleted" {
-			if root, ok := pathNode.getRoot(); !ok || root != ins.root.PathNodes.Last() {
-				err.Debug("--- Bad root", d.FullPath())
+		if pathNode.IsDeleted() {
+			if _, ok := ins.trash[res.ID.String()]; ok && !(isDir && ins.isObjectStore()) {
+				trashed := ins.trashPath(res.ID)
+				if ins.isObjectStore() {
+					trashed = res.dataPath()
+				}
+				if _, e := filesystem.Stat(trashed); e != nil {
+					problems = append(problems, "Missing from trash: "+res.ID.String())
+				}
 			}
+			return
+		}
+		if isDir && name[len(name)-1] != '/' {
+			problems = append(problems, "Bad directory name: "+res.FullPath())
 		}
 		if pathNode.ParentID != nil {
 			if _, ok := ins.directories[pathNode.ParentID.String()]; !ok {
-				err.Debug("--- Did not find parent", d.FullPath(), pathNode.ParentID)
+				problems = append(problems, "Did not find parent: "+res.FullPath())
+				return
 			}
 		}
+		if root, ok := pathNode.getRoot(); !ok || root != ins.root.PathNodes.Last() {
+			problems = append(problems, "Bad root: "+res.FullPath())
+			return
+		}
+		if isDir && ins.isObjectStore() {
+			return
+		}
+		if _, e := filesystem.Stat(res.dataPath()); e != nil {
+			problems = append(problems, "Missing: "+res.FullPath())
+		}
 	}
 
+	for _, d := range ins.directories {
+		if d != ins.root {
+			check(d.Resource, true)
+		}
+	}
+	for _, res := range ins.resources {
+		check(res, false)
+	}
+	sort.Strings(problems)
+	return problems
 }
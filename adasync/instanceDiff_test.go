@@ -0,0 +1,109 @@
+package adasync
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIncrementalSelfUpdate(t *testing.T) {
+	pathStr := tempInstanceDir(t, "/music/rock")
+	ioutil.WriteFile(pathStr+"/music/rock/song.mp3", []byte("song"), 0600)
+	ioutil.WriteFile(pathStr+"/notes.txt", []byte("notes"), 0600)
+	old := time.Now().Add(-time.Hour)
+	for _, dir := range []string{"", "/music", "/music/rock"} {
+		os.Chtimes(pathStr+dir, old, old)
+	}
+
+	c := New()
+	ins := c.AddInstance(pathStr)
+	ins.SelfUpdate()
+	if len(ins.resources) != 2 || ins.root.modTime != old.UnixNano() || ins.root.children != 2 {
+		t.Fatal("Expected first scan to read everything")
+	}
+
+	diff := ins.SelfDiff()
+	diff.scan()
+	diff.resolveDirectories()
+	diff.resolveFiles()
+	if len(diff.stats) != 0 || len(diff.added) != 0 || len(diff.removed) != 0 {
+		t.Error("Nothing should have been read")
+	}
+
+	ioutil.WriteFile(pathStr+"/music/rock/new.mp3", []byte("new song"), 0600)
+	diff = ins.SelfDiff()
+	diff.scan()
+	diff.resolveDirectories()
+	diff.resolveFiles()
+	if _, ok := diff.stats[pathStr+"/music/rock/"]; !ok || len(diff.stats) != 1 {
+		t.Error("Only the changed directory should be read")
+	}
+	if len(ins.resources) != 3 {
+		t.Error("Expected to find new file")
+	}
+	diff.recordStats()
+	if dir := diff.known[pathStr+"/music/rock/"]; dir.modTime != 0 {
+		t.Error("A directory that just changed should not be trusted")
+	}
+
+	diff = ins.SelfDiff()
+	diff.deep = true
+	diff.scan()
+	if len(diff.stats) != 3 {
+		t.Error("Deep scan should read every directory")
+	}
+
+	cp, e := Unmarshal(ins.Marshal(), "/copy")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if cp.root.modTime != ins.root.modTime || cp.root.children != 2 {
+		t.Error("Directory stats should be saved")
+	}
+}
+
+func TestSelfUpdateDirectoryMove(t *testing.T) {
+	pathStr := tempInstanceDir(t, "/music/rock/live")
+	ioutil.WriteFile(pathStr+"/music/rock/song.mp3", []byte("song"), 0600)
+	ioutil.WriteFile(pathStr+"/music/rock/live/track.mp3", []byte("track"), 0600)
+	ioutil.WriteFile(pathStr+"/music/other.mp3", []byte("other"), 0600)
+
+	c := New()
+	ins := c.AddInstance(pathStr)
+	diff := ins.SelfDiff()
+	diff.scan()
+	if len(diff.dirs) != 4 || len(diff.files) != 3 {
+		t.Fatal("Expected one walk to find every directory and file")
+	}
+	ins.SelfUpdate()
+	// directories are tracked by their tags once they've been written
+	ins.Write()
+	song := (&liveUpdate{ins: ins}).file("/music/rock/song.mp3")
+	rock := (&liveUpdate{ins: ins}).dir("/music/rock/")
+	live := (&liveUpdate{ins: ins}).dir("/music/rock/live/")
+
+	os.MkdirAll(pathStr+"/new", 0700)
+	os.Rename(pathStr+"/music/rock", pathStr+"/new/rock")
+	os.Rename(pathStr+"/music/other.mp3", pathStr+"/new/rock/other.mp3")
+	ins.SelfUpdate()
+	if p := rock.RelativePath().String(); p != "/new/rock/" {
+		t.Error("Incorrect directory path: " + p)
+	}
+	if live.PathNodes.Len() != 1 || live.RelativePath().String() != "/new/rock/live/" {
+		t.Error("Directory should move with it's parent without a move of it's own")
+	}
+	if song.PathNodes.Len() != 1 || song.RelativePath().String() != "/new/rock/song.mp3" {
+		t.Error("File should move with it's directory without a move of it's own")
+	}
+	if len(ins.resources) != 3 || len(ins.directories) != 5 {
+		t.Error("Only the new directory should be added")
+	}
+	if problems := ins.Fsck(); len(problems) != 0 {
+		t.Error(problems)
+	}
+	other := (&liveUpdate{ins: ins}).file("/new/rock/other.mp3")
+	if other == nil || other.PathNodes.Len() != 2 {
+		t.Error("Expected other to be moved")
+	}
+}
@@ -13,3 +13,33 @@ func TestGetSetting(t *testing.T) {
 		t.Error("Default static setting should be true")
 	}
 }
+
+func TestLookup(t *testing.T) {
+	c := New()
+	ins := c.AddInstance("/a")
+	music := ins.AddDirectory(&Hash{}, ins.root, "music/")
+	hash := HashFromBytes([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	song := ins.AddResource(hash, 100, music, "song.mp3")
+	song.PathNodes.Record(ins.PathNode(ins.root, "song.mp3"))
+	other := ins.AddResource(&Hash{}, 10, music, "other.mp3")
+	other.PathNodes.Record(ins.PathNode(music, "song.mp3"))
+
+	if ins.Lookup("/music/song.mp3") != other {
+		t.Error("Current location should win")
+	}
+	if ins.Lookup("/song.mp3") != song {
+		t.Error("Expected to find song")
+	}
+	if ins.Lookup("/music/other.mp3") != other {
+		t.Error("Expected to find by past location")
+	}
+	if ins.Lookup("/music/") != music.Resource {
+		t.Error("Expected to find directory")
+	}
+	if ins.Lookup("/nothing") != nil {
+		t.Error("Expected nil")
+	}
+	if h := song.PathHistory(); len(h) != 2 || h[0] != "/music/song.mp3" || h[1] != "/song.mp3" {
+		t.Error("Incorrect path history")
+	}
+}
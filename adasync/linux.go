@@ -3,10 +3,14 @@
 package adasync
 
 import (
+	"context"
 	"github.com/adamcolton/err"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
+	"unsafe"
 )
 
 var DefaultIgnore = ""
@@ -61,3 +65,270 @@ func (lp *linuxPaths) getMedia(subPath string, _ os.FileInfo, _ error) error {
 	}
 	return nil
 }
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+// watchMounts adds a job to the daemon for each mount and unmount. The kernel
+// flags /proc/self/mountinfo with POLLPRI when the mount table changes, but
+// it's also reread every "mount poll freq" in case that isn't available.
+func watchMounts(ctx context.Context, d *Daemon) {
+	mounts, e := readMountInfo(mountInfoPath)
+	if !err.Log(e) {
+		return
+	}
+	wait, done := mountWaiter(mountInfoPath)
+	defer done()
+	freq := serviceDuration("mount poll freq")
+	for ctx.Err() == nil {
+		wait(freq)
+		cur, e := readMountInfo(mountInfoPath)
+		if !err.Log(e) {
+			continue
+		}
+		added, removed := diffMounts(mounts, cur)
+		mounts = cur
+		mountJobs(d, added, removed)
+	}
+}
+
+// mountWaiter returns a function that blocks until the mount table changes or
+// the timeout passes. If epoll can't be used, it just sleeps.
+func mountWaiter(pathStr string) (func(time.Duration), func()) {
+	sleep := func(timeout time.Duration) { time.Sleep(timeout) }
+	f, e := os.Open(pathStr)
+	if !err.Log(e) {
+		return sleep, func() {}
+	}
+	epfd, e := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if !err.Log(e) {
+		f.Close()
+		return sleep, func() {}
+	}
+	fd := int(f.Fd())
+	event := &syscall.EpollEvent{
+		Events: syscall.EPOLLPRI | syscall.EPOLLERR,
+		Fd:     int32(fd),
+	}
+	if e := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, event); !err.Log(e) {
+		syscall.Close(epfd)
+		f.Close()
+		return sleep, func() {}
+	}
+	events := make([]syscall.EpollEvent, 1)
+	wait := func(timeout time.Duration) {
+		syscall.EpollWait(epfd, events, int(timeout/time.Millisecond))
+	}
+	done := func() {
+		syscall.Close(epfd)
+		f.Close()
+	}
+	return wait, done
+}
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW
+
+// inotify turns raw inotify events for one instance into FileEvents.
+type inotify struct {
+	fd     int
+	root   string                // instance path
+	rootWd int32                 // watch on the root directory
+	wds    map[int32]string      // watch -> full path of directory, ending in /
+	moves  map[uint32]*FileEvent // cookie -> remove waiting for the other half
+	closed bool                  // the instance is gone or unmounted
+}
+
+// watch adds a watch on a directory. If tree is true, it also watches every
+// directory under it, which is only done for new directories.
+func (in *inotify) watch(pathStr string, tree bool) {
+	if ignoreEvent(strings.TrimPrefix(pathStr, in.root)) {
+		return
+	}
+	wd, e := syscall.InotifyAddWatch(in.fd, pathStr, watchMask)
+	if !err.Log(e) {
+		return
+	}
+	in.wds[int32(wd)] = pathStr
+	if !tree {
+		return
+	}
+	if f, e := filesystem.Open(pathStr); err.Log(e) {
+		fis, e := f.Readdir(-1)
+		f.Close()
+		err.Log(e)
+		for _, fi := range fis {
+			if fi.IsDir() {
+				in.watch(pathStr+fi.Name()+"/", true)
+			}
+		}
+	}
+}
+
+// unwatch drops the watches on a directory that was moved out of the
+// instance and everything under it.
+func (in *inotify) unwatch(pathStr string) {
+	for wd, dir := range in.wds {
+		if strings.HasPrefix(dir, pathStr) {
+			syscall.InotifyRmWatch(in.fd, uint32(wd))
+			delete(in.wds, wd)
+		}
+	}
+}
+
+// moved updates the watches under a directory that was renamed.
+func (in *inotify) moved(from, to string) {
+	for wd, dir := range in.wds {
+		if strings.HasPrefix(dir, from) {
+			in.wds[wd] = to + dir[len(from):]
+		}
+	}
+}
+
+// parse reads the events in buf. Moves are added as removes and changed to
+// renames when the other half shows up.
+func (in *inotify) parse(buf []byte) []*FileEvent {
+	var events []*FileEvent
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameBuf := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(raw.Len)]
+		offset += syscall.SizeofInotifyEvent + int(raw.Len)
+		name := strings.TrimRight(string(nameBuf), "\x00")
+
+		if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			events = append(events, &FileEvent{Kind: EventOverflow})
+			continue
+		}
+		if raw.Mask&syscall.IN_UNMOUNT != 0 || (raw.Mask&syscall.IN_IGNORED != 0 && raw.Wd == in.rootWd) {
+			in.closed = true
+			continue
+		}
+		if raw.Mask&syscall.IN_IGNORED != 0 {
+			delete(in.wds, raw.Wd)
+			continue
+		}
+		dir, ok := in.wds[raw.Wd]
+		if !ok {
+			continue
+		}
+		pathStr := dir + name
+		isDir := raw.Mask&syscall.IN_ISDIR != 0
+		if isDir {
+			pathStr += "/"
+		}
+		relPath := strings.TrimPrefix(pathStr, in.root)
+
+		switch {
+		case raw.Mask&syscall.IN_CREATE != 0:
+			// files are picked up when they're closed, otherwise we could hash
+			// one that's half written
+			if isDir {
+				in.watch(pathStr, true)
+				events = append(events, &FileEvent{Kind: EventWrite, Path: relPath})
+			}
+		case raw.Mask&syscall.IN_CLOSE_WRITE != 0:
+			events = append(events, &FileEvent{Kind: EventWrite, Path: relPath})
+		case raw.Mask&syscall.IN_DELETE != 0:
+			events = append(events, &FileEvent{Kind: EventRemove, Path: relPath})
+		case raw.Mask&syscall.IN_MOVED_FROM != 0:
+			ev := &FileEvent{Kind: EventRemove, Path: relPath}
+			in.moves[raw.Cookie] = ev
+			events = append(events, ev)
+		case raw.Mask&syscall.IN_MOVED_TO != 0:
+			if ev, ok := in.moves[raw.Cookie]; ok {
+				delete(in.moves, raw.Cookie)
+				if isDir {
+					in.moved(in.root+ev.Path, pathStr)
+				}
+				ev.Kind, ev.From, ev.Path = EventRename, ev.Path, relPath
+			} else {
+				if isDir {
+					in.watch(pathStr, true)
+				}
+				events = append(events, &FileEvent{Kind: EventWrite, Path: relPath})
+			}
+		}
+	}
+	return events
+}
+
+// flushMoves is called before a batch is handed off. Anything that was moved
+// out without the other half showing up has left the instance.
+func (in *inotify) flushMoves() {
+	for cookie, ev := range in.moves {
+		in.unwatch(in.root + ev.Path)
+		delete(in.moves, cookie)
+	}
+}
+
+// watchInstance watches the directories of an instance with inotify and
+// passes batches of events to flush. It returns when ctx is done or the
+// instance is removed or unmounted.
+func watchInstance(ctx context.Context, root string, dirs []string, flush func([]*FileEvent)) {
+	fd, e := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if !err.Log(e) {
+		return
+	}
+	defer syscall.Close(fd)
+	epfd, e := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if !err.Log(e) {
+		return
+	}
+	defer syscall.Close(epfd)
+	event := &syscall.EpollEvent{
+		Events: syscall.EPOLLIN,
+		Fd:     int32(fd),
+	}
+	if e := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, event); !err.Log(e) {
+		return
+	}
+
+	in := &inotify{
+		fd:    fd,
+		root:  root,
+		wds:   make(map[int32]string),
+		moves: make(map[uint32]*FileEvent),
+	}
+	wd, e := syscall.InotifyAddWatch(fd, root+"/", watchMask)
+	if !err.Log(e) {
+		return
+	}
+	in.rootWd = int32(wd)
+	in.wds[in.rootWd] = root + "/"
+	for _, dir := range dirs {
+		in.watch(dir, false)
+	}
+	err.Debug("Watching: ", root)
+
+	batch := &eventBatch{
+		quiet: serviceDuration("watch delay"),
+		max:   serviceDuration("watch max delay"),
+	}
+	events := make([]syscall.EpollEvent, 1)
+	buf := make([]byte, 64*1024)
+	for ctx.Err() == nil && !in.closed {
+		// wake up at least once a second to check ctx
+		timeout := time.Second
+		if len(batch.events) > 0 {
+			if due := batch.due(time.Now()); due < timeout {
+				timeout = due
+			}
+		}
+		if timeout > 0 {
+			syscall.EpollWait(epfd, events, int(timeout/time.Millisecond)+1)
+		}
+		for {
+			n, e := syscall.Read(fd, buf)
+			if e != nil || n <= 0 {
+				break
+			}
+			if parsed := in.parse(buf[:n]); len(parsed) > 0 {
+				batch.add(time.Now(), parsed...)
+			}
+		}
+		if len(batch.events) > 0 && batch.due(time.Now()) <= 0 {
+			in.flushMoves()
+			flush(batch.take())
+		}
+	}
+	err.Debug("Stopped watching: ", root)
+}
@@ -3,10 +3,81 @@
 package adasync
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestLinux(t *testing.T) {
 	quick()
 	quick()
 }
+
+func TestMountWaiter(t *testing.T) {
+	wait, done := mountWaiter(mountInfoPath)
+	defer done()
+	start := time.Now()
+	wait(10 * time.Millisecond)
+	if time.Since(start) > time.Second {
+		t.Error("Wait should return after the timeout")
+	}
+}
+
+func TestWatchInstance(t *testing.T) {
+	root := tempInstanceDir(t, "/music")
+	Settings["watch delay"] = "500ms"
+	defer delete(Settings, "watch delay")
+
+	batches := make(chan []*FileEvent, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		watchInstance(ctx, root, []string{root + "/music/"}, func(events []*FileEvent) {
+			batches <- events
+		})
+		done <- true
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// each step waits so the new directory is watched before it's used
+	steps := []func(){
+		func() { os.Mkdir(root+"/music/rock", 0700) },
+		func() { ioutil.WriteFile(root+"/music/rock/song.mp3", []byte("song"), 0600) },
+		func() { os.Rename(root+"/music/rock", root+"/rock") },
+		func() { os.Remove(root + "/rock/song.mp3") },
+	}
+	for _, step := range steps {
+		step()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	var events []*FileEvent
+	select {
+	case events = <-batches:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a batch")
+	}
+	expected := []FileEvent{
+		{Kind: EventWrite, Path: "/music/rock/"},
+		{Kind: EventWrite, Path: "/music/rock/song.mp3"},
+		{Kind: EventRename, From: "/music/rock/", Path: "/rock/"},
+		{Kind: EventRemove, Path: "/rock/song.mp3"},
+	}
+	if len(events) != len(expected) {
+		t.Fatal("Incorrect number of events: ", len(events))
+	}
+	for i, ev := range events {
+		if *ev != expected[i] {
+			t.Errorf("Event %d: expected %+v got %+v", i, expected[i], *ev)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watcher did not stop")
+	}
+}
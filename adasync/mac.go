@@ -3,6 +3,7 @@
 package adasync
 
 import (
+	"context"
 	"github.com/adamcolton/err"
 	"os"
 	"path/filepath"
@@ -61,3 +62,10 @@ func (lp *linuxPaths) getMedia(subPath string, _ os.FileInfo, _ error) error {
 	}
 	return nil
 }
+
+// watchMounts only works on linux, elsewhere the scan job finds new drives
+func watchMounts(ctx context.Context, d *Daemon) {}
+
+// watchInstance only works on linux, elsewhere changes are found by the
+// shallow check
+func watchInstance(ctx context.Context, root string, dirs []string, flush func([]*FileEvent)) {}
@@ -0,0 +1,90 @@
+package adasync
+
+import (
+	"errors"
+	"fmt"
+	"github.com/adamcolton/err"
+	proto "github.com/golang/protobuf/proto"
+)
+
+// Migration upgrades an instance written by one version of the .collection
+// format to the next.
+type Migration func(sIns *SerialInstance) error
+
+// migrations is keyed by the version being upgraded from
+var migrations = map[uint32]Migration{
+	1: migrateV1,
+}
+
+// RegisterMigration sets the Migration used to upgrade from version "from" to
+// from + 1.
+func RegisterMigration(from uint32, migration Migration) {
+	migrations[from] = migration
+}
+
+var ErrNoVersion = errors.New("Not a valid .collection file")
+
+// VersionError is returned when a .collection file was written by a newer
+// version of AdaSync. We refuse to open those rather than risk damaging them.
+type VersionError struct {
+	Version uint32
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("Written by a newer version of AdaSync (format %d), this version only understands up to %d", e.Version, version)
+}
+
+// migrate unmarshals the instance in the wrapper and upgrades it to the
+// current version.
+func migrate(wrapper *VersionWrapper) (*SerialInstance, error) {
+	if wrapper.Version == 0 {
+		return nil, ErrNoVersion
+	}
+	if wrapper.Version > version {
+		return nil, &VersionError{Version: wrapper.Version}
+	}
+	sIns := &SerialInstance{}
+	if e := proto.Unmarshal(wrapper.Instance, sIns); e != nil {
+		return nil, e
+	}
+	for v := wrapper.Version; v < version; v++ {
+		migration, ok := migrations[v]
+		if !ok {
+			return nil, fmt.Errorf("No migration from version %d", v)
+		}
+		err.Debug("Migrating from version ", v)
+		if e := migration(sIns); e != nil {
+			return nil, e
+		}
+	}
+	return sIns, nil
+}
+
+// backupName is where the .collection file is copied to before it's rewritten
+// in a newer version.
+func backupName(pathStr string, v uint32) string {
+	return fmt.Sprintf("%s/.backup-v%d.collection", pathStr, v)
+}
+
+func writeBackup(pathStr string, v uint32, buf []byte) error {
+	name := backupName(pathStr, v)
+	if _, e := filesystem.Stat(name); e == nil {
+		// keep the oldest backup
+		return nil
+	}
+	f, e := filesystem.Create(name)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	if _, e = f.Write(buf); e != nil {
+		return e
+	}
+	return f.Sync()
+}
+
+// migrateV1 gives the instance an ID, version 1 did not have them.
+func migrateV1(sIns *SerialInstance) error {
+	sIns.InstanceId = newInstanceId()[:]
+	return nil
+}
@@ -0,0 +1,42 @@
+package adasync
+
+import (
+	proto "github.com/golang/protobuf/proto"
+	"testing"
+)
+
+func TestMigrateNewerVersion(t *testing.T) {
+	_, e := migrate(&VersionWrapper{Version: version + 1})
+	if _, ok := e.(*VersionError); !ok {
+		t.Error("Expected a VersionError, got: ", e)
+	}
+	if _, e := migrate(&VersionWrapper{}); e != ErrNoVersion {
+		t.Error("Expected ErrNoVersion, got: ", e)
+	}
+}
+
+func TestMigrateV1(t *testing.T) {
+	buf, _ := proto.Marshal(&SerialInstance{
+		CollectionId: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+	})
+	sIns, e := migrate(&VersionWrapper{
+		Version:  1,
+		Instance: buf,
+	})
+	if e != nil {
+		t.Error(e)
+		return
+	}
+	if len(sIns.InstanceId) != 16 {
+		t.Error("Expected version 1 instance to be given an ID")
+	}
+}
+
+func TestMissingMigration(t *testing.T) {
+	v1 := migrations[1]
+	defer RegisterMigration(1, v1)
+	delete(migrations, 1)
+	if _, e := migrate(&VersionWrapper{Version: 1}); e == nil {
+		t.Error("Expected an error for a missing migration")
+	}
+}
@@ -0,0 +1,182 @@
+package adasync
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/adamcolton/err"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MountPoint is one line of /proc/self/mountinfo
+type MountPoint struct {
+	ID     int
+	Path   string
+	FSType string
+	Source string
+}
+
+// pseudoFS are filesystems that never hold a collection, changes to them are
+// ignored.
+var pseudoFS = map[string]bool{
+	"autofs":      true,
+	"binfmt_misc": true,
+	"bpf":         true,
+	"cgroup":      true,
+	"cgroup2":     true,
+	"configfs":    true,
+	"debugfs":     true,
+	"devpts":      true,
+	"devtmpfs":    true,
+	"fusectl":     true,
+	"hugetlbfs":   true,
+	"mqueue":      true,
+	"nsfs":        true,
+	"proc":        true,
+	"pstore":      true,
+	"securityfs":  true,
+	"sysfs":       true,
+	"tracefs":     true,
+}
+
+var ErrBadMountInfo = errors.New("Bad mountinfo line")
+
+// parseMountInfo reads the format of /proc/<pid>/mountinfo, see proc(5).
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+//
+// The optional fields end at "-", then comes the filesystem type and source.
+func parseMountInfo(r io.Reader) ([]*MountPoint, error) {
+	var mounts []*MountPoint
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep == -1 || sep+2 >= len(fields) {
+			return nil, ErrBadMountInfo
+		}
+		id, e := strconv.Atoi(fields[0])
+		if e != nil {
+			return nil, ErrBadMountInfo
+		}
+		mounts = append(mounts, &MountPoint{
+			ID:     id,
+			Path:   unescapeMount(fields[4]),
+			FSType: fields[sep+1],
+			Source: unescapeMount(fields[sep+2]),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMount undoes the octal escapes the kernel uses for spaces, tabs,
+// newlines and backslashes in paths.
+func unescapeMount(str string) string {
+	if !strings.Contains(str, "\\") {
+		return str
+	}
+	out := make([]byte, 0, len(str))
+	for i := 0; i < len(str); i++ {
+		if str[i] == '\\' && i+3 < len(str) {
+			if c, e := strconv.ParseUint(str[i+1:i+4], 8, 8); e == nil {
+				out = append(out, byte(c))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, str[i])
+	}
+	return string(out)
+}
+
+func readMountInfo(pathStr string) ([]*MountPoint, error) {
+	f, e := os.Open(pathStr)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+// diffMounts compares two reads of the mount table by path. Pseudo
+// filesystems are ignored.
+func diffMounts(prev, cur []*MountPoint) (added, removed []*MountPoint) {
+	prevPaths := make(map[string]bool)
+	for _, mp := range prev {
+		prevPaths[mp.Path] = true
+	}
+	curPaths := make(map[string]bool)
+	for _, mp := range cur {
+		curPaths[mp.Path] = true
+		if !prevPaths[mp.Path] && !pseudoFS[mp.FSType] {
+			added = append(added, mp)
+		}
+	}
+	for _, mp := range prev {
+		if !curPaths[mp.Path] && !pseudoFS[mp.FSType] {
+			removed = append(removed, mp)
+		}
+	}
+	return
+}
+
+// mountJobs turns changes to the mount table into jobs for the daemon, so
+// they never run at the same time as a sync.
+func mountJobs(d *Daemon, added, removed []*MountPoint) {
+	for _, mp := range removed {
+		mountPath := mp.Path
+		err.Debug("Unmounted: ", mountPath)
+		d.Add(&Job{
+			Name: "unmount " + mountPath,
+			Run: func(context.Context) {
+				Unmount(mountPath)
+			},
+		})
+	}
+	for _, mp := range added {
+		mountPath := mp.Path
+		err.Debug("Mounted: ", mountPath)
+		d.Add(&Job{
+			Name: "mount " + mountPath,
+			Run: func(ctx context.Context) {
+				SyncPaths(ctx, []string{mountPath})
+			},
+		})
+	}
+}
+
+// underPath checks if pathStr is dir or is inside it
+func underPath(pathStr, dir string) bool {
+	dir = strings.TrimSuffix(toSlash(dir), "/")
+	return pathStr == dir || strings.HasPrefix(pathStr, dir+"/")
+}
+
+// Unmount takes every open instance under mountPath offline. They're dropped
+// from their collections so nothing tries to sync with a drive that's gone,
+// the other instances still have them in their registry.
+func Unmount(mountPath string) []*Instance {
+	var offline []*Instance
+	for _, c := range collections {
+		for pathStr, ins := range c.instances {
+			if underPath(pathStr, mountPath) {
+				err.Debug("Offline: ", ins.Name())
+				ins.offline = true
+				delete(c.instances, pathStr)
+				offline = append(offline, ins)
+			}
+		}
+	}
+	return offline
+}
@@ -0,0 +1,60 @@
+package adasync
+
+import (
+	"strings"
+	"testing"
+)
+
+const testMountInfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+23 22 0:21 / /proc rw,nosuid shared:12 - proc proc rw
+60 22 8:17 / /media/alice/My\040Drive rw,nosuid shared:30 master:2 - vfat /dev/sdb1 rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, e := parseMountInfo(strings.NewReader(testMountInfo))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(mounts) != 3 {
+		t.Fatal("Expected 3 mounts")
+	}
+	mp := mounts[2]
+	if mp.ID != 60 || mp.Path != "/media/alice/My Drive" || mp.FSType != "vfat" || mp.Source != "/dev/sdb1" {
+		t.Errorf("Incorrect mount: %+v", mp)
+	}
+	if _, e := parseMountInfo(strings.NewReader("22 1 8:1 / / rw\n")); e != ErrBadMountInfo {
+		t.Error("Expected ErrBadMountInfo")
+	}
+	if str := unescapeMount(`a\134b\04`); str != `a\b\04` {
+		t.Error("Incorrect unescape: " + str)
+	}
+}
+
+func TestDiffMounts(t *testing.T) {
+	prev, _ := parseMountInfo(strings.NewReader(testMountInfo))
+	cur := []*MountPoint{
+		prev[0],
+		{ID: 24, Path: "/sys", FSType: "sysfs"},
+		{ID: 61, Path: "/media/bob", FSType: "ext4"},
+	}
+	added, removed := diffMounts(prev, cur)
+	if len(added) != 1 || added[0].Path != "/media/bob" {
+		t.Error("Incorrect added mounts")
+	}
+	if len(removed) != 1 || removed[0].Path != "/media/alice/My Drive" {
+		t.Error("Incorrect removed mounts")
+	}
+}
+
+func TestUnmount(t *testing.T) {
+	c := New()
+	gone := c.AddInstance("/media/usb/music")
+	c.AddInstance("/media/usb2/music")
+	offline := Unmount("/media/usb/")
+	if len(offline) != 1 || offline[0] != gone || gone.Online() {
+		t.Error("Expected instance to be taken offline")
+	}
+	if _, ok := c.instances["/media/usb/music"]; ok || len(c.instances) != 1 {
+		t.Error("Expected instance to be dropped from the collection")
+	}
+}
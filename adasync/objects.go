@@ -0,0 +1,106 @@
+package adasync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+An instance with "layout: objects" keeps each file by the hash of it's
+contents, in objects/ab/cdef..., instead of at it's path. The tree, and every
+place a file has been, is only in the state. Files with the same contents are
+stored once, and moving or deleting something only changes the state. Syncing
+it with an empty instance rebuilds the tree.
+*/
+
+const objectsDir = "/objects/"
+
+var ErrObjectHash = errors.New("Contents did not match hash")
+
+// isObjectStore is true if ins keeps files by hash.
+func (ins *Instance) isObjectStore() bool {
+	return ins.GetSetting("layout") == "objects"
+}
+
+func (ins *Instance) objectPath(hash *Hash) string {
+	str := hex.EncodeToString(hash[:])
+	return ins.pathStr + objectsDir + str[:2] + "/" + str[2:]
+}
+
+// dataPath is where the contents of res are, which is it's path unless it's
+// in an object store.
+func (res *Resource) dataPath() string {
+	if ins := res.PathNodes.Last().Instance; ins.isObjectStore() {
+		return ins.objectPath(res.Hash)
+	}
+	return res.FullPath()
+}
+
+// storeObject copies the contents of res into the object store, unless
+// something with the same contents is already there. The contents are
+// checked against the hash as they're copied, so a file that changed since it
+// was scanned isn't stored under the wrong name.
+func (ins *Instance) storeObject(res *Resource) error {
+	dst := ins.objectPath(res.Hash)
+	if _, e := filesystem.Stat(dst); e == nil {
+		return nil
+	}
+	filesystem.Mkdir(ins.pathStr+objectsDir, 0700)
+	filesystem.Mkdir(dst[:strings.LastIndex(dst, "/")], 0700)
+
+	src, e := filesystem.Open(res.dataPath())
+	if e != nil {
+		return e
+	}
+	defer src.Close()
+	plain, size, e := readContents(src)
+	if e != nil {
+		return e
+	}
+	tmp := tmpName(dst)
+	f, e := filesystem.Create(tmp)
+	if e != nil {
+		return e
+	}
+	hash := md5.New()
+	if e = ins.writeContents(f, io.TeeReader(plain, hash), size, res.PathNodes.Last().Name); e == nil {
+		if !bytes.Equal(hash.Sum(nil), res.Hash[:]) {
+			e = ErrObjectHash
+		} else {
+			e = f.Sync()
+		}
+	}
+	f.Close()
+	if e != nil {
+		filesystem.Remove(tmp)
+		return e
+	}
+	return filesystem.Rename(tmp, dst)
+}
+
+// removeObject deletes the contents of the resource with id, if nothing else
+// in the instance or it's trash has the same contents.
+func (ins *Instance) removeObject(id *Hash) error {
+	res, ok := ins.resources[id.String()]
+	if !ok {
+		return nil // directories don't have contents
+	}
+	for _, other := range ins.resources {
+		if other == res || !other.Hash.Equal(res.Hash) {
+			continue
+		}
+		if _, inTrash := ins.trash[other.ID.String()]; inTrash || !other.PathNodes.Last().IsDeleted() {
+			return nil
+		}
+	}
+	e := filesystem.Remove(ins.objectPath(res.Hash))
+	if e != nil && !os.IsNotExist(e) {
+		return e
+	}
+	return nil
+}
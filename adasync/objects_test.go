@@ -0,0 +1,108 @@
+package adasync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func countObjects(t *testing.T, dir string) int {
+	count := 0
+	filepath.Walk(dir+objectsDir, func(pathStr string, fi os.FileInfo, e error) error {
+		if e == nil && !fi.IsDir() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+func TestObjectStore(t *testing.T) {
+	tmp := tempInstanceDir(t, "/a/photos", "/archive", "/c")
+	ioutil.WriteFile(tmp+"/a/photos/beach.jpg", []byte("beach"), 0600)
+	ioutil.WriteFile(tmp+"/a/photos/copy.jpg", []byte("beach"), 0600)
+	ioutil.WriteFile(tmp+"/a/notes.txt", []byte("notes"), 0600)
+
+	a, e := Init(tmp+"/a", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	archive, e := InitObjectStore(tmp+"/archive", a.CollectionId())
+	if e != nil {
+		t.Fatal(e)
+	}
+	SyncInstances(a, archive)
+	if n := countObjects(t, tmp+"/archive"); n != 2 {
+		t.Error("Expected the same contents to be stored once: ", n)
+	}
+	if _, e := os.Stat(tmp + "/archive/photos"); !os.IsNotExist(e) {
+		t.Error("Directories shouldn't be made in an object store")
+	}
+	var notes *Resource
+	for _, res := range archive.resources {
+		if res.PathNodes.Last().Name == "notes.txt" {
+			notes = res
+		}
+	}
+	if notes == nil {
+		t.Fatal("Expected notes in the state")
+	}
+	if buf, e := ioutil.ReadFile(archive.objectPath(notes.Hash)); e != nil || string(buf) != "notes" {
+		t.Error("Expected notes to be stored by hash")
+	}
+
+	// moves only change the state
+	os.Rename(tmp+"/a/photos", tmp+"/a/pictures")
+	os.Remove(tmp + "/a/notes.txt")
+	before, _ := os.Stat(archive.objectPath(notes.Hash))
+	SyncInstances(a, archive)
+	if problems := archive.Fsck(); len(problems) != 0 {
+		t.Error(problems)
+	}
+	if n := countObjects(t, tmp+"/archive"); n != 2 {
+		t.Error("Expected nothing to be copied for a move: ", n)
+	}
+	if !notes.PathNodes.Last().IsDeleted() {
+		t.Error("Expected notes to be deleted in the state")
+	}
+	if after, e := os.Stat(archive.objectPath(notes.Hash)); e != nil || !after.ModTime().Equal(before.ModTime()) {
+		t.Error("Expected deleted contents to be kept in the trash")
+	}
+
+	// a restore is only a change to the state, and is sync'd like a move
+	if e := archive.Restore(notes.ID); e != nil {
+		t.Fatal(e)
+	}
+	SyncInstances(a, archive)
+	if buf, e := ioutil.ReadFile(tmp + "/a/notes.txt"); e != nil || string(buf) != "notes" {
+		t.Error("Expected restored notes to be copied from the archive")
+	}
+
+	os.Remove(tmp + "/a/notes.txt")
+	os.Remove(tmp + "/a/pictures/copy.jpg")
+	SyncInstances(a, archive)
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Now().AddDate(0, 0, 31) }
+	archive.PurgeTrash()
+	if _, e := os.Stat(archive.objectPath(notes.Hash)); !os.IsNotExist(e) {
+		t.Error("Expected contents to be removed when the trash is emptied")
+	}
+	if n := countObjects(t, tmp+"/archive"); n != 1 {
+		t.Error("Expected contents that are still used to be kept: ", n)
+	}
+
+	// any tree can be rebuilt from the archive
+	c, e := Init(tmp+"/c", a.CollectionId())
+	if e != nil {
+		t.Fatal(e)
+	}
+	SyncInstances(archive, c)
+	if buf, e := ioutil.ReadFile(tmp + "/c/pictures/beach.jpg"); e != nil || string(buf) != "beach" {
+		t.Error("Expected to rebuild the tree")
+	}
+	if _, e := os.Stat(tmp + "/c/notes.txt"); !os.IsNotExist(e) {
+		t.Error("Deleted file shouldn't be rebuilt")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	"fmt"
 	"github.com/adamcolton/err"
+	"io"
 	"path/filepath"
 	"strings"
 )
@@ -54,24 +55,42 @@ var blocksize = int64(md5.BlockSize)
 
 //MD5 efficiently finds the MD5 hash of the file at path
 func (p *Path) Stat() (*Hash, bool, int64) {
+	hash, isDir, size, _ := p.stat(false)
+	return hash, isDir, size
+}
+
+// stat is Stat, if sigs is true it also finds the block signatures of a file
+// that's big enough to have them.
+func (p *Path) stat(sigs bool) (*Hash, bool, int64, *blockSigs) {
 	file, e := filesystem.Open(p.String())
 	err.Panic(e)
 	defer file.Close()
 	stat, e := file.Stat()
 	err.Panic(e)
 	if stat.IsDir() {
-		if file, e := filesystem.Open(p.String() + ".tag.collection"); e == nil {
-			defer file.Close()
-			buf := make([]byte, 16)
-			file.Read(buf)
-			h := HashFromBytes(buf)
+		if h, e := readTag(p.String() + ".tag.collection"); e == nil {
 			err.Debug(h)
-			return h, true, 0
+			return h, true, 0, nil
 		}
 		ret := Hash(md5.Sum([]byte(p.relDir + p.name)))
-		return &ret, true, 0
+		return &ret, true, 0, nil
 	}
 	hash := md5.New()
+	var sw *sigWriter
+	r, size, e := readContents(file)
+	if sigs && e == nil && size >= deltaMinSize {
+		sw = newSigWriter(size)
+	}
+	if err.Log(e) && r != file {
+		if sw != nil {
+			r = io.TeeReader(r, sw)
+		}
+		_, e = io.Copy(hash, r)
+		err.Log(e)
+		ret := Hash{}
+		copy(ret[:], hash.Sum(nil))
+		return &ret, false, size, sw.result()
+	}
 	blocks := stat.Size() / blocksize
 	if stat.Size()%blocksize != 0 {
 		blocks++
@@ -83,23 +102,34 @@ func (p *Path) Stat() (*Hash, bool, int64) {
 		err.Log(e)
 		_, e = hash.Write(buf[:l])
 		err.Warn(e)
+		if sw != nil {
+			sw.Write(buf[:l])
+		}
 	}
 	sliceHash := hash.Sum(nil)
 	ret := Hash{}
 	for i, b := range sliceHash {
 		ret[i] = b
 	}
-	return &ret, false, stat.Size()
+	return &ret, false, stat.Size(), sw.result()
 }
 
 type PathNode struct {
 	Name     string
 	ParentID *Hash
 	Instance *Instance
+	Clock    Clock
+	Time     int64 // when the change was made in unix nanoseconds, 0 if it's from before that was kept
 }
 
+// PathNodes is the history of a resource. If the history has been compacted,
+// offset is how many of the oldest nodes were dropped, so nodes[0] is at
+// position offset in the full history. Checkpoint is the length of history
+// that was last known to be the same across every instance of the collection.
 type PathNodes struct {
-	nodes []*PathNode
+	nodes      []*PathNode
+	offset     int
+	checkpoint int
 }
 
 func NewPathNodes(l int, pns ...*PathNode) *PathNodes {
@@ -121,6 +151,11 @@ func (pns *PathNodes) Add(pn ...*PathNode) {
 	pns.nodes = append(pns.nodes, pn...)
 }
 
+// Len is the length of the full history, including any compacted nodes
+func (pns *PathNodes) Len() int {
+	return pns.offset + len(pns.nodes)
+}
+
 func (pn *PathNode) IsDeleted() bool {
 	return pn.ParentID == nil && pn.Name == ".deleted"
 }
@@ -134,8 +169,8 @@ func (pn *PathNode) Parent() *Directory {
 }
 
 func (a *PathNodes) DiffAt(b *PathNodes) int {
-	la := len(a.nodes)
-	lb := len(b.nodes)
+	la := a.Len()
+	lb := b.Len()
 	ret := -1
 	l := la
 	if la != lb {
@@ -145,9 +180,24 @@ func (a *PathNodes) DiffAt(b *PathNodes) int {
 		}
 		ret = l
 	}
-	for i := 0; i < l; i++ {
-		na := a.nodes[i]
-		nb := b.nodes[i]
+	// anything before the larger offset was compacted away on at least one
+	// side, it was the same on both when it was compacted.
+	start := a.offset
+	if b.offset > start {
+		start = b.offset
+	}
+	if start > l {
+		// the shorter one ends before history that every instance had when
+		// the other was compacted, so it can't just be behind. It's reported
+		// as a difference, not a prefix, so the clocks decide.
+		if l == 0 {
+			return 0
+		}
+		return l - 1
+	}
+	for i := start; i < l; i++ {
+		na := a.nodes[i-a.offset]
+		nb := b.nodes[i-b.offset]
 		if na.Name != nb.Name || !na.ParentID.Equal(nb.ParentID) {
 			err.Debug(na.Name, nb.Name)
 			err.Debug(na.ParentID, nb.ParentID)
@@ -186,7 +236,28 @@ func (pn *PathNode) Serialize() *SerialPathNode {
 	return &SerialPathNode{
 		Name:     []byte(pn.Name),
 		ParentID: parentID,
+		Clock:    pn.Clock.marshal(),
+		Time:     pn.Time,
+	}
+}
+
+// clone copies the history for use in another instance
+func (pns *PathNodes) clone(ins *Instance) *PathNodes {
+	cp := &PathNodes{
+		nodes:      make([]*PathNode, len(pns.nodes)),
+		offset:     pns.offset,
+		checkpoint: pns.checkpoint,
+	}
+	for i, srcN := range pns.nodes {
+		cp.nodes[i] = &PathNode{
+			Name:     srcN.Name,
+			ParentID: srcN.ParentID,
+			Instance: ins,
+			Clock:    srcN.Clock,
+			Time:     srcN.Time,
+		}
 	}
+	return cp
 }
 
 func (pns *PathNodes) marshal() []*SerialPathNode {
@@ -207,6 +278,8 @@ func (spn *SerialPathNode) unmarshal(ins *Instance) *PathNode {
 		Name:     string(spn.Name),
 		ParentID: hash,
 		Instance: ins,
+		Clock:    unmarshalClock(spn.Clock),
+		Time:     spn.Time,
 	}
 }
 
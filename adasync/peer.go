@@ -0,0 +1,743 @@
+package adasync
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/gob"
+	"errors"
+	"github.com/adamcolton/err"
+	"github.com/adamcolton/fs"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Peers are other AdaSync daemons on the network. A daemon shares it's
+instances as adasync://host:port/path, but a peer can only be read. Syncing
+with a peer pulls from it's state into one of our instances, then asks it to
+pull from us, so each daemon only ever changes it's own instances. Peers only
+see the instances that trust them (see secure.go).
+*/
+
+// peerBlockSize is how much of a file is sent at a time. If the connection is
+// lost, the transfer picks up again at the block it was on.
+var peerBlockSize = 64 * 1024
+
+const (
+	peerRetries = 3
+	peerTimeout = 30 * time.Second
+)
+
+var ErrReadOnlyPeer = errors.New("Peers can only be read")
+var ErrNotShared = errors.New("Path is not in a shared instance")
+var ErrPeerFileChanged = errors.New("File changed on the peer while it was read")
+var ErrPeerPath = errors.New("Peers are sync'd with PullPeer, not opened")
+
+// IsPeer is true if pathStr is an instance shared by another daemon.
+func IsPeer(pathStr string) bool {
+	return strings.HasPrefix(pathStr, "adasync://")
+}
+
+type peerRequest struct {
+	Op         string
+	Path       string
+	Offset     int64
+	Size       int
+	Collection string
+	Port       int
+}
+
+type peerResponse struct {
+	Err       string
+	NotExist  bool
+	Info      *peerFileInfo
+	Data      []byte
+	BlockSize int
+	Shared    []*SharedInstance
+}
+
+func (resp *peerResponse) err(pathStr string) error {
+	if resp.NotExist {
+		return &os.PathError{Op: "open", Path: pathStr, Err: os.ErrNotExist}
+	}
+	if resp.Err != "" {
+		return errors.New(resp.Err)
+	}
+	return nil
+}
+
+// SharedInstance is an instance a peer shares.
+type SharedInstance struct {
+	Collection string
+	Path       string
+}
+
+// peerFileInfo is an os.FileInfo that can be sent to a peer.
+type peerFileInfo struct {
+	FileName    string
+	FileSize    int64
+	FileMode    os.FileMode
+	FileModTime time.Time
+}
+
+func newPeerFileInfo(fi os.FileInfo) *peerFileInfo {
+	return &peerFileInfo{
+		FileName:    fi.Name(),
+		FileSize:    fi.Size(),
+		FileMode:    fi.Mode(),
+		FileModTime: fi.ModTime(),
+	}
+}
+
+func (fi *peerFileInfo) Name() string       { return fi.FileName }
+func (fi *peerFileInfo) Size() int64        { return fi.FileSize }
+func (fi *peerFileInfo) Mode() os.FileMode  { return fi.FileMode }
+func (fi *peerFileInfo) ModTime() time.Time { return fi.FileModTime }
+func (fi *peerFileInfo) IsDir() bool        { return fi.FileMode.IsDir() }
+func (fi *peerFileInfo) Sys() interface{}   { return nil }
+
+func (fi *peerFileInfo) same(other *peerFileInfo) bool {
+	return other != nil && fi.FileSize == other.FileSize && fi.FileModTime.Equal(other.FileModTime)
+}
+
+// urlPath is the path of a root in a url, it always starts with a slash.
+func urlPath(root string) string {
+	if strings.HasPrefix(root, "/") {
+		return root
+	}
+	return "/" + root
+}
+
+// PeerServer shares instances with peers. It only reads what's on disk, the
+// state it serves is whatever was last written, so it never has to wait for
+// the daemon.
+type PeerServer struct {
+	d      *Daemon
+	key    ed25519.PrivateKey
+	mux    sync.Mutex
+	shared map[string]*sharedRoot // by root
+}
+
+// sharedRoot is what the server needs to know about an instance without
+// touching it.
+type sharedRoot struct {
+	collection string
+	trusted    string
+	revoked    string
+}
+
+func (root *sharedRoot) trusts(key ed25519.PublicKey) bool {
+	return keyIn(key, root.trusted) && !keyIn(key, root.revoked)
+}
+
+func NewPeerServer(d *Daemon) *PeerServer {
+	key, e := PeerIdentity()
+	err.Log(e)
+	return &PeerServer{
+		d:      d,
+		key:    key,
+		shared: make(map[string]*sharedRoot),
+	}
+}
+
+func newSharedRoot(ins *Instance) *sharedRoot {
+	return &sharedRoot{
+		collection: ins.CollectionId(),
+		trusted:    ins.GetSetting("trusted peers"),
+		revoked:    GetServiceSetting("revoked peers"),
+	}
+}
+
+// Share lets the peers ins trusts read it.
+func (s *PeerServer) Share(ins *Instance) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.shared[ins.pathStr] = newSharedRoot(ins)
+}
+
+// ShareAll shares every open local instance that's online and stops sharing
+// the rest. It reads the collections, so it has to be run by the daemon.
+func (s *PeerServer) ShareAll() {
+	shared := make(map[string]*sharedRoot)
+	for _, c := range collections {
+		for _, ins := range c.instances {
+			if ins.Online() && !IsRemote(ins.pathStr) {
+				shared[ins.pathStr] = newSharedRoot(ins)
+			}
+		}
+	}
+	s.mux.Lock()
+	s.shared = shared
+	s.mux.Unlock()
+}
+
+// list is what's shared with peer, or everything if peer is nil.
+func (s *PeerServer) list(peer ed25519.PublicKey) []*SharedInstance {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	list := make([]*SharedInstance, 0, len(s.shared))
+	for root, shared := range s.shared {
+		if peer == nil || shared.trusts(peer) {
+			list = append(list, &SharedInstance{
+				Collection: shared.collection,
+				Path:       urlPath(root),
+			})
+		}
+	}
+	sort.Sort(byShared(list))
+	return list
+}
+
+type byShared []*SharedInstance
+
+func (a byShared) Len() int           { return len(a) }
+func (a byShared) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byShared) Less(i, j int) bool { return a[i].Path < a[j].Path }
+
+// sharedPath cleans a path from a peer and checks that it's inside an
+// instance we share with it.
+func (s *PeerServer) sharedPath(peer ed25519.PublicKey, pathStr string) (string, error) {
+	pathStr = path.Clean("/" + pathStr)
+	if p := pathStr[1:]; filepath.VolumeName(p) != "" {
+		pathStr = p
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for root, shared := range s.shared {
+		if pathStr == root || strings.HasPrefix(pathStr, strings.TrimSuffix(root, "/")+"/") {
+			if !shared.trusts(peer) {
+				return "", ErrUntrustedPeer
+			}
+			return pathStr, nil
+		}
+	}
+	return "", ErrNotShared
+}
+
+// rootFor is the instance of a collection we share with peer.
+func (s *PeerServer) rootFor(peer ed25519.PublicKey, id string) string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for root, shared := range s.shared {
+		if shared.collection == id && shared.trusts(peer) {
+			return root
+		}
+	}
+	return ""
+}
+
+// trustedAnywhere is true if any instance we share trusts peer, otherwise
+// there's no reason to let it connect.
+func (s *PeerServer) trustedAnywhere(peer ed25519.PublicKey) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, shared := range s.shared {
+		if shared.trusts(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve answers peers until ctx is done.
+func (s *PeerServer) Serve(ctx context.Context, ln net.Listener) {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, e := ln.Accept()
+		if e != nil {
+			return
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+func (s *PeerServer) serveConn(ctx context.Context, conn net.Conn) {
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+	sc, e := secureHandshake(conn, s.key, false, s.trustedAnywhere)
+	if e != nil {
+		err.Debug("Rejected peer ", conn.RemoteAddr(), ": ", e)
+		return
+	}
+	dec := gob.NewDecoder(sc)
+	enc := gob.NewEncoder(sc)
+	for {
+		req := &peerRequest{}
+		if dec.Decode(req) != nil {
+			return
+		}
+		if enc.Encode(s.handle(sc, req)) != nil {
+			return
+		}
+	}
+}
+
+func (s *PeerServer) handle(sc *secureConn, req *peerRequest) *peerResponse {
+	resp := &peerResponse{}
+	var e error
+	switch req.Op {
+	case "list":
+		resp.Shared = s.list(sc.peer)
+	case "stat":
+		e = s.stat(sc.peer, req, resp)
+	case "read":
+		e = s.read(sc.peer, req, resp)
+	case "sigs":
+		e = s.sigs(sc.peer, req, resp)
+	case "pull":
+		e = s.pull(sc, req)
+	default:
+		e = errors.New("Unknown request: " + req.Op)
+	}
+	if e != nil {
+		resp.Err = e.Error()
+		resp.NotExist = os.IsNotExist(e)
+	}
+	return resp
+}
+
+func (s *PeerServer) stat(peer ed25519.PublicKey, req *peerRequest, resp *peerResponse) error {
+	pathStr, e := s.sharedPath(peer, req.Path)
+	if e != nil {
+		return e
+	}
+	fi, e := filesystem.Stat(pathStr)
+	if e != nil {
+		return e
+	}
+	resp.Info = newPeerFileInfo(fi)
+	return nil
+}
+
+// read sends a block of a file along with it's size and mtime, so the peer
+// can tell if it changed part way through.
+func (s *PeerServer) read(peer ed25519.PublicKey, req *peerRequest, resp *peerResponse) error {
+	pathStr, e := s.sharedPath(peer, req.Path)
+	if e != nil {
+		return e
+	}
+	f, e := filesystem.Open(pathStr)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	fi, e := f.Stat()
+	if e != nil {
+		return e
+	}
+	resp.Info = newPeerFileInfo(fi)
+	if _, e = f.Seek(req.Offset, io.SeekStart); e != nil {
+		return e
+	}
+	size := req.Size
+	if size > peerBlockSize || size <= 0 {
+		size = peerBlockSize
+	}
+	resp.Data = make([]byte, size)
+	n, e := io.ReadFull(f, resp.Data)
+	resp.Data = resp.Data[:n]
+	if e == io.EOF || e == io.ErrUnexpectedEOF {
+		e = nil
+	}
+	return e
+}
+
+// sigs sends the block signatures of a file, so the peer only has to read the
+// blocks it doesn't already have.
+func (s *PeerServer) sigs(peer ed25519.PublicKey, req *peerRequest, resp *peerResponse) error {
+	pathStr, e := s.sharedPath(peer, req.Path)
+	if e != nil {
+		return e
+	}
+	f, e := filesystem.Open(pathStr)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	sigs, e := readSigs(f)
+	if e != nil {
+		return e
+	}
+	resp.BlockSize = sigs.blockSize
+	resp.Data = sigs.marshal()
+	return nil
+}
+
+// pull asks the daemon to pull from the peer that sent the request. The peer
+// says what port it's listening on, the address comes from the connection.
+func (s *PeerServer) pull(sc *secureConn, req *peerRequest) error {
+	if s.d == nil {
+		return errors.New("Not running a daemon")
+	}
+	root := s.rootFor(sc.peer, req.Collection)
+	if root == "" {
+		return ErrNotShared
+	}
+	host, _, e := net.SplitHostPort(sc.RemoteAddr().String())
+	if e != nil {
+		return e
+	}
+	url := "adasync://" + net.JoinHostPort(host, strconv.Itoa(req.Port)) + urlPath(req.Path)
+	s.d.Add(&Job{
+		Name: "pull " + url,
+		Run: func(ctx context.Context) {
+			if c, ok := collections[req.Collection]; ok {
+				if ins, ok := c.instances[root]; ok && ins.Online() {
+					err.Log(PullPeer(ctx, ins, url))
+				}
+			}
+		},
+	})
+	return nil
+}
+
+// peerTransport reads from another daemon. Every request can be repeated, so
+// if the connection is lost it's dialed again and the request is retried.
+type peerTransport struct {
+	addr   string
+	mux    sync.Mutex
+	peer   ed25519.PublicKey // the key the peer proved it has
+	conn   net.Conn
+	enc    *gob.Encoder
+	dec    *gob.Decoder
+	closed bool
+}
+
+// DialPeer connects to the daemon in a prefix like "adasync://host:port".
+func DialPeer(prefix string) (Transport, error) {
+	return dialPeer(strings.TrimPrefix(prefix, "adasync://"))
+}
+
+func dialPeer(addr string) (*peerTransport, error) {
+	t := &peerTransport{addr: addr}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t, t.connect()
+}
+
+// connect dials the peer. If it's been connected to before, it has to have
+// the same key.
+func (t *peerTransport) connect() error {
+	key, e := PeerIdentity()
+	if e != nil {
+		return e
+	}
+	conn, e := net.DialTimeout("tcp", t.addr, peerTimeout)
+	if e != nil {
+		return e
+	}
+	sc, e := secureHandshake(conn, key, true, func(peer ed25519.PublicKey) bool {
+		return !revoked(peer) && (t.peer == nil || sameKey(peer, t.peer))
+	})
+	if e != nil {
+		conn.Close()
+		return e
+	}
+	err.Debug("Connected: ", t.addr)
+	t.peer = sc.peer
+	t.conn = sc
+	t.enc = gob.NewEncoder(sc)
+	t.dec = gob.NewDecoder(sc)
+	return nil
+}
+
+func (t *peerTransport) call(req *peerRequest) (*peerResponse, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	var e error
+	for i := 0; i < peerRetries && !t.closed; i++ {
+		if t.conn == nil {
+			if e = t.connect(); e != nil {
+				continue
+			}
+		}
+		t.conn.SetDeadline(time.Now().Add(peerTimeout))
+		resp := &peerResponse{}
+		if e = t.enc.Encode(req); e == nil {
+			e = t.dec.Decode(resp)
+		}
+		if e == nil {
+			return resp, resp.err(req.Path)
+		}
+		err.Debug("Lost connection to ", t.addr, ": ", e)
+		t.conn.Close()
+		t.conn = nil
+	}
+	if e == nil {
+		e = io.ErrClosedPipe
+	}
+	return nil, e
+}
+
+func (t *peerTransport) peerKey() ed25519.PublicKey {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.peer
+}
+
+func (t *peerTransport) Alive() bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return !t.closed
+}
+
+func (t *peerTransport) Close() error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.closed = true
+	if t.conn != nil {
+		return t.conn.Close()
+	}
+	return nil
+}
+
+func (t *peerTransport) stat(pathStr string) (*peerFileInfo, error) {
+	_, _, p := splitRemote(pathStr)
+	resp, e := t.call(&peerRequest{Op: "stat", Path: p})
+	if e != nil {
+		return nil, e
+	}
+	return resp.Info, nil
+}
+
+func (t *peerTransport) sigs(pathStr string) (*blockSigs, error) {
+	_, _, p := splitRemote(pathStr)
+	resp, e := t.call(&peerRequest{Op: "sigs", Path: p})
+	if e != nil {
+		return nil, e
+	}
+	return unmarshalSigs(uint32(resp.BlockSize), resp.Data), nil
+}
+
+func (t *peerTransport) Open(pathStr string) (fs.File, error) {
+	fi, e := t.stat(pathStr)
+	if e != nil {
+		return nil, e
+	}
+	_, _, p := splitRemote(pathStr)
+	return &peerFile{t: t, path: p, name: pathStr, info: fi}, nil
+}
+
+func (t *peerTransport) Stat(pathStr string) (os.FileInfo, error) {
+	fi, e := t.stat(pathStr)
+	if e != nil {
+		return nil, e
+	}
+	return fi, nil
+}
+
+func (t *peerTransport) Create(string) (fs.File, error)  { return nil, ErrReadOnlyPeer }
+func (t *peerTransport) Mkdir(string, os.FileMode) error { return ErrReadOnlyPeer }
+func (t *peerTransport) Rename(string, string) error     { return ErrReadOnlyPeer }
+func (t *peerTransport) RemoveAll(string) error          { return ErrReadOnlyPeer }
+func (t *peerTransport) Remove(string) error             { return ErrReadOnlyPeer }
+
+// peerFile reads a file from a peer a block at a time.
+type peerFile struct {
+	t      *peerTransport
+	path   string
+	name   string
+	info   *peerFileInfo
+	offset int64
+}
+
+func (f *peerFile) Read(b []byte) (int, error) {
+	if f.offset >= f.info.FileSize {
+		return 0, io.EOF
+	}
+	resp, e := f.t.call(&peerRequest{Op: "read", Path: f.path, Offset: f.offset, Size: len(b)})
+	if e != nil {
+		return 0, e
+	}
+	if !f.info.same(resp.Info) {
+		return 0, ErrPeerFileChanged
+	}
+	if len(resp.Data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(b, resp.Data)
+	f.offset += int64(n)
+	return n, nil
+}
+
+// WriteTo lets io.Copy read whole blocks.
+func (f *peerFile) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, peerBlockSize)
+	var total int64
+	for {
+		n, e := f.Read(buf)
+		if n > 0 {
+			n, e := w.Write(buf[:n])
+			total += int64(n)
+			if e != nil {
+				return total, e
+			}
+		}
+		if e == io.EOF {
+			return total, nil
+		} else if e != nil {
+			return total, e
+		}
+	}
+}
+
+func (f *peerFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.FileSize
+	}
+	if offset < 0 {
+		return f.offset, os.ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *peerFile) Write([]byte) (int, error)          { return 0, ErrReadOnlyPeer }
+func (f *peerFile) Readdir(int) ([]os.FileInfo, error) { return nil, ErrReadOnlyPeer }
+func (f *peerFile) Stat() (os.FileInfo, error)         { return f.info, nil }
+func (f *peerFile) Sync() error                        { return nil }
+func (f *peerFile) Close() error                       { return nil }
+func (f *peerFile) Name() string                       { return f.name }
+
+// peerFor finds the transport for a peer.
+func peerFor(pathStr string) (*peerTransport, error) {
+	_, prefix, _ := splitRemote(pathStr)
+	if r, ok := filesystem.(*router); ok {
+		t, e := r.route(prefix)
+		if e != nil {
+			return nil, e
+		}
+		if t, ok := t.(*peerTransport); ok {
+			return t, nil
+		}
+	}
+	return dialPeer(strings.TrimPrefix(prefix, "adasync://"))
+}
+
+// OpenPeer loads the state of an instance shared by a peer. It isn't kept in
+// it's collection, it's only used to pull from and is never written.
+func OpenPeer(url string) (*Instance, error) {
+	url = strings.TrimSuffix(url, "/")
+	ins, e := loadInstance(url)
+	if e != nil {
+		return nil, e
+	}
+	if ins == nil {
+		return nil, ErrNotShared
+	}
+	c := ins.collection
+	delete(c.instances, url)
+	if len(c.instances) == 0 {
+		delete(collections, c.IdStr())
+	}
+	ins.settings, _ = LoadConfig(url + "/config.collection")
+	return ins, nil
+}
+
+// PullPeer syncs the instance at url into ins. Only ins is changed, the peer
+// gets our changes when it pulls from us.
+func PullPeer(ctx context.Context, ins *Instance, url string) error {
+	t, e := peerFor(url)
+	if e != nil {
+		return e
+	}
+	if !ins.trusts(t.peerKey()) {
+		return ErrUntrustedPeer
+	}
+	peer, e := OpenPeer(url)
+	if e != nil {
+		return e
+	}
+	if peer.collection != ins.collection {
+		return ErrDifferentCollections
+	}
+	ins.SelfUpdate()
+	sync := NewSync(peer, ins)
+	sync.only = ins
+	err.Debug("Pulling: ", url)
+	err.Debug("   Into: ", ins.pathStr)
+	sync.Diff()
+	sync.RunContext(ctx)
+	if ctx.Err() == nil {
+		mergePeers(peer, ins)
+	}
+	ins.collection.checkpoint()
+	ins.maintain()
+	ins.Write()
+	return nil
+}
+
+// PushPeer asks the peer at url to pull from ins, which has to be shared by
+// our PeerServer listening on port.
+func PushPeer(ins *Instance, url string, port int) error {
+	t, e := peerFor(url)
+	if e != nil {
+		return e
+	}
+	_, e = t.call(&peerRequest{
+		Op:         "pull",
+		Path:       urlPath(ins.pathStr),
+		Collection: ins.CollectionId(),
+		Port:       port,
+	})
+	return e
+}
+
+// SyncPeer pulls every instance the peer at addr shares that's in a
+// collection we have open, then if port isn't 0, asks the peer to pull from
+// us.
+func SyncPeer(ctx context.Context, addr string, port int) error {
+	t, e := peerFor("adasync://" + addr)
+	if e != nil {
+		return e
+	}
+	resp, e := t.call(&peerRequest{Op: "list"})
+	if e != nil {
+		return e
+	}
+	for _, shared := range resp.Shared {
+		if ctx.Err() != nil {
+			break
+		}
+		c, ok := collections[shared.Collection]
+		if !ok {
+			continue
+		}
+		var ins *Instance
+		for _, cur := range c.sortedInstances() {
+			if cur.Online() && !IsRemote(cur.pathStr) {
+				ins = cur
+				break
+			}
+		}
+		if ins == nil {
+			continue
+		}
+		url := "adasync://" + addr + shared.Path
+		if err.Log(PullPeer(ctx, ins, url)) && port != 0 {
+			err.Log(PushPeer(ins, url, port))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package adasync
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// trust makes a key for this process and has every instance trust it.
+func trust(t *testing.T, dir string, inss ...*Instance) ed25519.PrivateKey {
+	Settings["peer key"] = dir + "/peer.key"
+	key, e := PeerIdentity()
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, ins := range inss {
+		ins.settings["trusted peers"] = PeerKeyString(key.Public().(ed25519.PublicKey))
+	}
+	return key
+}
+
+// startPeer runs a daemon that shares ins on loopback.
+func startPeer(ctx context.Context, t *testing.T, ins *Instance) (*PeerServer, int) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	d := NewDaemon()
+	s := NewPeerServer(d)
+	s.Share(ins)
+	go d.Run(ctx)
+	go s.Serve(ctx, ln)
+	return s, ln.Addr().(*net.TCPAddr).Port
+}
+
+// dropProxy forwards to addr, but the first connection is cut after limit
+// bytes have come back from addr.
+func dropProxy(ctx context.Context, t *testing.T, addr string, limit int64) (string, *int32) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	conns := new(int32)
+	go func() {
+		for {
+			client, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			server, e := net.Dial("tcp", addr)
+			if e != nil {
+				client.Close()
+				continue
+			}
+			go io.Copy(server, client)
+			if atomic.AddInt32(conns, 1) == 1 {
+				go func() {
+					io.CopyN(client, server, limit)
+					client.Close()
+					server.Close()
+				}()
+			} else {
+				go io.Copy(client, server)
+			}
+		}
+	}()
+	return ln.Addr().String(), conns
+}
+
+func TestPeerSync(t *testing.T) {
+	tmp := tempInstanceDir(t, "/a/music", "/b")
+	big := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	ioutil.WriteFile(tmp+"/a/music/big.flac", big, 0600)
+	ioutil.WriteFile(tmp+"/a/notes.txt", []byte("notes"), 0600)
+
+	a, e := Init(tmp+"/a", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, e := Init(tmp+"/b", a.CollectionId())
+	if e != nil {
+		t.Fatal(e)
+	}
+	trust(t, tmp, a, b)
+	defer delete(Settings, "peer key")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer CloseTransports()
+	_, portA := startPeer(ctx, t, a)
+	_, portB := startPeer(ctx, t, b)
+	addrA := net.JoinHostPort("127.0.0.1", strconv.Itoa(portA))
+
+	// the first connection is lost part way through big.flac
+	proxy, conns := dropProxy(ctx, t, addrA, 150000)
+	if e := PullPeer(ctx, b, "adasync://"+proxy+tmp+"/a"); e != nil {
+		t.Fatal(e)
+	}
+	if buf, e := ioutil.ReadFile(tmp + "/b/music/big.flac"); e != nil || !bytes.Equal(buf, big) {
+		t.Fatal("Expected big.flac to be pulled")
+	}
+	if atomic.LoadInt32(conns) != 2 {
+		t.Error("Expected the transfer to resume on a new connection")
+	}
+	if buf, e := ioutil.ReadFile(tmp + "/b/notes.txt"); e != nil || string(buf) != "notes" {
+		t.Error("Expected notes.txt to be pulled")
+	}
+	if len(a.resources) != 2 {
+		t.Error("Pulling should not change the peer")
+	}
+
+	// a push asks a to pull from b
+	ioutil.WriteFile(tmp+"/b/fromb.txt", []byte("from b"), 0600)
+	b.SelfUpdate()
+	b.Write()
+	if e := PushPeer(b, "adasync://"+addrA+tmp+"/a", portB); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 100; i++ {
+		if _, e := os.Stat(tmp + "/a/fromb.txt"); e == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if buf, e := ioutil.ReadFile(tmp + "/a/fromb.txt"); e != nil || string(buf) != "from b" {
+		t.Error("Expected a to pull fromb.txt")
+	}
+
+	if _, e := filesystem.Stat("adasync://" + addrA + tmp + "/b/notes.txt"); e == nil {
+		t.Error("Should not read outside of what's shared")
+	}
+	if _, e := filesystem.Create("adasync://" + addrA + tmp + "/a/new.txt"); e != ErrReadOnlyPeer {
+		t.Error("Peers should be read only")
+	}
+
+	// the peer finds the block signatures so only the changes are read
+	url := "adasync://" + addrA + tmp + "/a/music/big.flac"
+	pt, e := peerFor(url)
+	if e != nil {
+		t.Fatal(e)
+	}
+	sigs, e := pt.sigs(url)
+	w := newSigWriter(int64(len(big)))
+	w.Write(big)
+	if e != nil || !bytes.Equal(sigs.marshal(), w.finish().marshal()) {
+		t.Error("Expected signatures from the peer: ", e)
+	}
+}
@@ -0,0 +1,216 @@
+package adasync
+
+import (
+	"math"
+	"sort"
+)
+
+// HistoryEvent is one entry in the history of a resource.
+type HistoryEvent struct {
+	// Kind is "created", "moved", "renamed", "deleted" or "restored"
+	Kind string
+	// Path is where the resource ended up, for a delete it's where the
+	// resource was deleted from.
+	Path string
+	// Instance made the change, it's nil for history from before vector
+	// clocks.
+	Instance *InstanceInfo
+	Clock    Clock
+	// Directory is set when a directory the resource was in was moved, it's
+	// where the directory ended up.
+	Directory string
+	time      int64
+}
+
+// ResourceHistory answers "where did my file go?".
+type ResourceHistory struct {
+	ID      *Hash
+	Path    string
+	Deleted bool
+	// Compacted is how many of the oldest entries were dropped by "max history
+	// size".
+	Compacted int
+	Events    []*HistoryEvent
+}
+
+// History finds the resource at relPath, or that was at relPath, and
+// describes every change in it's history. Each path is where everything was
+// when the change was made, and moves of the directories the resource was in
+// are included.
+func (ins *Instance) History(relPath string) (*ResourceHistory, error) {
+	res := ins.Lookup(relPath)
+	if res == nil {
+		return nil, ErrUnknownRes
+	}
+	infos := make(map[string]*InstanceInfo)
+	for _, info := range ins.collection.Registry() {
+		infos[info.ID.String()] = info
+	}
+	changedBy := func(prev, cur *PathNode) *InstanceInfo {
+		var prevClock Clock
+		if prev != nil {
+			prevClock = prev.Clock
+		}
+		idStr := changedBy(prevClock, cur.Clock)
+		if idStr == "" {
+			return nil
+		}
+		if info, ok := infos[idStr]; ok {
+			return info
+		}
+		if id, e := DecodeHash(idStr); e == nil {
+			return &InstanceInfo{ID: id}
+		}
+		return nil
+	}
+	rh := &ResourceHistory{
+		ID:        res.ID,
+		Compacted: res.PathNodes.offset,
+	}
+	nodes := res.PathNodes.nodes
+	var prev *PathNode
+	for i, pn := range nodes {
+		event := &HistoryEvent{
+			Path:     pn.pathAt(pn.Time, 0),
+			Clock:    pn.Clock,
+			Instance: changedBy(prev, pn),
+		}
+		switch {
+		case pn.IsDeleted():
+			event.Kind = "deleted"
+			if prev != nil {
+				event.Path = prev.pathAt(pn.Time, 0)
+			}
+		case prev == nil:
+			event.Kind = "created"
+			if rh.Compacted > 0 {
+				event.Kind = "moved"
+			}
+		case prev.IsDeleted():
+			event.Kind = "restored"
+		case prev.ParentID.Equal(pn.ParentID):
+			event.Kind = "renamed"
+		default:
+			event.Kind = "moved"
+		}
+		rh.Events = append(rh.Events, event)
+
+		if parent := pn.Parent(); parent != nil && !pn.IsDeleted() {
+			to := int64(math.MaxInt64)
+			if i+1 < len(nodes) {
+				to = nodes[i+1].Time
+			}
+			var moves []*HistoryEvent
+			dirMoves(parent, pn.Time, to, 0, func(dirPn, dirPrev *PathNode) {
+				moves = append(moves, &HistoryEvent{
+					Kind:      "moved",
+					Path:      pn.pathAt(dirPn.Time, 0),
+					Directory: dirPn.pathAt(dirPn.Time, 0),
+					Instance:  changedBy(dirPrev, dirPn),
+					Clock:     dirPn.Clock,
+					time:      dirPn.Time,
+				})
+			})
+			sort.Sort(byEventTime(moves))
+			rh.Events = append(rh.Events, moves...)
+		}
+		prev = pn
+	}
+	if prev != nil {
+		rh.Path = prev.livePath(0)
+		rh.Deleted = prev.IsDeleted()
+		if rh.Deleted {
+			rh.Path = rh.Events[len(rh.Events)-1].Path
+		}
+	}
+	return rh, nil
+}
+
+// dirMoves calls fn for each time dir, or a directory it was in, was moved or
+// renamed after from and no later than to.
+func dirMoves(dir *Directory, from, to int64, depth int, fn func(pn, prev *PathNode)) {
+	if depth > len(dir.PathNodes.Last().Instance.directories) {
+		return
+	}
+	nodes := dir.PathNodes.nodes
+	for j, pn := range nodes {
+		if pn.IsDeleted() {
+			continue
+		}
+		start, end := pn.Time, int64(math.MaxInt64)
+		if j+1 < len(nodes) {
+			end = nodes[j+1].Time
+		}
+		if j > 0 && !nodes[j-1].IsDeleted() && start != 0 && start > from && start <= to {
+			fn(pn, nodes[j-1])
+		}
+		if start < from {
+			start = from
+		}
+		if end > to {
+			end = to
+		}
+		if parent := pn.Parent(); parent != nil && start < end {
+			dirMoves(parent, start, end, depth+1, fn)
+		}
+	}
+}
+
+type byEventTime []*HistoryEvent
+
+func (a byEventTime) Len() int           { return len(a) }
+func (a byEventTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byEventTime) Less(i, j int) bool { return a[i].time < a[j].time }
+
+// changedBy finds the instance that ticked the clock
+func changedBy(prev, cur Clock) string {
+	var ids []string
+	for id, count := range cur {
+		if count > prev[id] {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return ""
+	}
+	sort.Strings(ids)
+	return ids[0]
+}
+
+// at is the node that was current at t, leaving out deletes. If t is 0 or
+// none of the nodes are from before t, it's the last one.
+func (pns *PathNodes) at(t int64) *PathNode {
+	var live, before *PathNode
+	for _, pn := range pns.nodes {
+		if pn.IsDeleted() {
+			continue
+		}
+		live = pn
+		if t != 0 && pn.Time <= t {
+			before = pn
+		}
+	}
+	if before != nil {
+		return before
+	}
+	return live
+}
+
+// pathAt is like RelativePath, but each directory is placed where it was at
+// t. If a directory was deleted, it's placed where it was before it was
+// deleted.
+func (pn *PathNode) pathAt(t int64, depth int) string {
+	parent := pn.Parent()
+	if parent == nil || depth > len(pn.Instance.directories) {
+		return pn.Name
+	}
+	if at := parent.PathNodes.at(t); at != nil {
+		return at.pathAt(t, depth+1) + pn.Name
+	}
+	return pn.Name
+}
+
+// livePath is pathAt for the current location of every directory.
+func (pn *PathNode) livePath(depth int) string {
+	return pn.pathAt(0, depth)
+}
@@ -0,0 +1,79 @@
+package adasync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	// every change is a second after the last
+	clock := time.Now()
+	defer func() { now = time.Now }()
+	now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	c := New()
+	a := c.AddInstance("/a")
+	b := c.AddInstance("/b")
+	b.settings["label"] = "Bob"
+	music := a.AddDirectory(&Hash{}, a.root, "music/")
+	album := a.AddDirectory(&Hash{}, music, "album/")
+	hash := HashFromBytes([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	song := a.AddResource(hash, 100, music, "song.mp3")
+
+	// Bob's reorganization
+	byBob := func(pns *PathNodes, pn *PathNode) {
+		pn.Clock = pns.Last().Clock.tick(b.id)
+		pn.Time = now().UnixNano()
+		pns.Add(pn)
+	}
+	byBob(song.PathNodes, a.PathNode(album, "song.mp3"))
+	byBob(song.PathNodes, a.PathNode(album, "track1.mp3"))
+
+	song.PathNodes.Record(a.PathNodeFromHash(nil, ".deleted"))
+	song.PathNodes.Record(a.PathNode(music, "song.mp3"))
+	album.PathNodes.Record(a.PathNodeFromHash(nil, ".deleted"))
+
+	// Bob moves /music to /archive/music
+	archive := a.AddDirectory(&Hash{1}, a.root, "archive/")
+	byBob(music.PathNodes, a.PathNode(archive, "music/"))
+
+	rh, e := a.History("/music/album/track1.mp3")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !rh.ID.Equal(song.ID) || rh.Path != "/archive/music/song.mp3" || rh.Deleted {
+		t.Error("Incorrect resource")
+	}
+	expected := []struct {
+		kind, path, dir, by string
+	}{
+		{"created", "/music/song.mp3", "", a.Name()},
+		{"moved", "/music/album/song.mp3", "", "Bob"},
+		{"renamed", "/music/album/track1.mp3", "", "Bob"},
+		{"deleted", "/music/album/track1.mp3", "", a.Name()},
+		{"restored", "/music/song.mp3", "", a.Name()},
+		{"moved", "/archive/music/song.mp3", "/archive/music/", "Bob"},
+	}
+	if len(rh.Events) != len(expected) {
+		t.Fatal("Expected 6 events, got ", len(rh.Events))
+	}
+	for i, ex := range expected {
+		event := rh.Events[i]
+		if event.Kind != ex.kind || event.Path != ex.path || event.Directory != ex.dir {
+			t.Error(i, ": expected ", ex.kind, " ", ex.path, " ", ex.dir, " got ", event.Kind, " ", event.Path, " ", event.Directory)
+		}
+		if event.Instance == nil || event.Instance.Name() != ex.by {
+			t.Error(i, ": expected change by ", ex.by)
+		}
+	}
+
+	if h := song.PathHistory(); h[0] != "/music/song.mp3" || h[len(h)-1] != "/music/song.mp3" {
+		t.Error("Incorrect path history ", h)
+	}
+	if _, e := a.History("/nothing"); e != ErrUnknownRes {
+		t.Error("Expected ErrUnknownRes")
+	}
+}
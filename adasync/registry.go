@@ -0,0 +1,195 @@
+package adasync
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// InstanceInfo describes an instance of a collection. Each instance keeps a
+// registry of every other instance it has sync'd with, either directly or
+// through another instance, so we can show where copies of a collection live.
+type InstanceInfo struct {
+	ID       *Hash
+	Label    string
+	LastSync time.Time
+	Device   string
+	Path     string
+}
+
+// UUID is the human friendly form of the instance ID
+func (info *InstanceInfo) UUID() string {
+	return formatUUID(info.ID)
+}
+
+// Name is the label if there is one, otherwise the path, the same as
+// Instance.Name. Registries from before paths were kept fall back to the UUID.
+func (info *InstanceInfo) Name() string {
+	if info.Label != "" {
+		return info.Label
+	}
+	if info.Path != "" {
+		return info.Path
+	}
+	return info.UUID()
+}
+
+func formatUUID(id *Hash) string {
+	return hex.EncodeToString(id[0:4]) + "-" +
+		hex.EncodeToString(id[4:6]) + "-" +
+		hex.EncodeToString(id[6:8]) + "-" +
+		hex.EncodeToString(id[8:10]) + "-" +
+		hex.EncodeToString(id[10:])
+}
+
+func parseUUID(str string) (*Hash, error) {
+	bs, e := hex.DecodeString(strings.Replace(str, "-", "", -1))
+	if e != nil {
+		return nil, e
+	}
+	if len(bs) != len(Hash{}) {
+		return nil, errors.New("Incorrect UUID length")
+	}
+	return HashFromBytes(bs), nil
+}
+
+// parseInstanceId accepts either the UUID or the base64 form of an instance
+// ID.
+func parseInstanceId(str string) (*Hash, error) {
+	if id, e := parseUUID(str); e == nil {
+		return id, nil
+	}
+	return DecodeHash(str)
+}
+
+var deviceName = func() string {
+	host, _ := os.Hostname()
+	return host + " (" + runtime.GOOS + ")"
+}
+
+// UUID is the human friendly form of the instance ID
+func (ins *Instance) UUID() string {
+	return formatUUID(ins.id)
+}
+
+// Name is the "label" setting if there is one, otherwise the path, the same as
+// InstanceInfo.Name.
+func (ins *Instance) Name() string {
+	if label := ins.GetSetting("label"); label != "" {
+		return label
+	}
+	return ins.pathStr
+}
+
+func (ins *Instance) Path() string {
+	return ins.pathStr
+}
+
+// Online is false once the drive the instance is on has been unmounted
+func (ins *Instance) Online() bool {
+	return !ins.offline
+}
+
+func (ins *Instance) CollectionId() string {
+	return ins.collection.IdStr()
+}
+
+// Info describes this instance the same way it's described in the registry of
+// other instances.
+func (ins *Instance) Info() *InstanceInfo {
+	return &InstanceInfo{
+		ID:       ins.id,
+		Label:    ins.GetSetting("label"),
+		LastSync: ins.lastSync,
+		Device:   deviceName(),
+		Path:     ins.pathStr,
+	}
+}
+
+// register adds or updates an entry in the registry. When both have an entry
+// for the same instance, the most recently sync'd one wins.
+func (ins *Instance) register(info *InstanceInfo) {
+	idStr := info.ID.String()
+	if info.ID.Equal(ins.id) {
+		return
+	}
+	if _, ok := ins.forgotten[idStr]; ok {
+		return
+	}
+	if cur, ok := ins.registry[idStr]; ok && !cur.LastSync.Before(info.LastSync) {
+		return
+	}
+	cp := *info
+	ins.registry[idStr] = &cp
+	ins.dirty = true
+}
+
+// Registry lists every instance of the collection that any of the open
+// instances know about, including the open instances.
+func (c *Collection) Registry() []*InstanceInfo {
+	merged := make(map[string]*InstanceInfo)
+	add := func(info *InstanceInfo) {
+		if cur, ok := merged[info.ID.String()]; !ok || cur.LastSync.Before(info.LastSync) {
+			merged[info.ID.String()] = info
+		}
+	}
+	for _, ins := range c.instances {
+		for _, info := range ins.registry {
+			add(info)
+		}
+	}
+	// open instances know the most about themselves
+	for _, ins := range c.instances {
+		merged[ins.id.String()] = ins.Info()
+	}
+	infos := make([]*InstanceInfo, 0, len(merged))
+	for _, info := range merged {
+		infos = append(infos, info)
+	}
+	sort.Sort(byLastSync(infos))
+	return infos
+}
+
+// FindInstance looks up an instance in the registry by label or ID.
+func (c *Collection) FindInstance(name string) *InstanceInfo {
+	id, _ := parseInstanceId(name)
+	for _, info := range c.Registry() {
+		if info.Label == name || info.ID.Equal(id) {
+			return info
+		}
+	}
+	return nil
+}
+
+type byLastSync []*InstanceInfo
+
+func (a byLastSync) Len() int           { return len(a) }
+func (a byLastSync) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byLastSync) Less(i, j int) bool { return a[i].LastSync.After(a[j].LastSync) }
+
+func (info *InstanceInfo) Serialize() *SerialInstanceInfo {
+	return &SerialInstanceInfo{
+		ID:       info.ID[:],
+		Label:    info.Label,
+		LastSync: info.LastSync.Unix(),
+		Device:   info.Device,
+		Path:     info.Path,
+	}
+}
+
+func (sInfo *SerialInstanceInfo) unmarshal() *InstanceInfo {
+	info := &InstanceInfo{
+		ID:     HashFromBytes(sInfo.ID),
+		Label:  sInfo.Label,
+		Device: sInfo.Device,
+		Path:   sInfo.Path,
+	}
+	if sInfo.LastSync != 0 {
+		info.LastSync = time.Unix(sInfo.LastSync, 0)
+	}
+	return info
+}
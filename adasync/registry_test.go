@@ -0,0 +1,53 @@
+package adasync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUUID(t *testing.T) {
+	id := HashFromBytes([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	uuid := formatUUID(id)
+	if uuid != "01020304-0506-0708-090a-0b0c0d0e0f10" {
+		t.Error("Incorrect UUID: " + uuid)
+	}
+	got, e := parseInstanceId(uuid)
+	if e != nil || !got.Equal(id) {
+		t.Error("Failed to parse UUID")
+	}
+	got, e = parseInstanceId(id.String())
+	if e != nil || !got.Equal(id) {
+		t.Error("Failed to parse base64 ID")
+	}
+	if newInstanceId()[6]>>4 != 4 {
+		t.Error("Expected version 4 UUID")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	c := New()
+	a := c.AddInstance("/a")
+	id := newInstanceId()
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.register(&InstanceInfo{ID: id, Label: "new", LastSync: t0})
+	a.register(&InstanceInfo{ID: id, Label: "old", LastSync: t0.AddDate(0, 0, -1)})
+	if a.registry[id.String()].Label != "new" {
+		t.Error("Most recent registry entry should win")
+	}
+	a.register(a.Info())
+	if len(a.registry) != 1 {
+		t.Error("Instance should not register itself")
+	}
+	if info := c.FindInstance("new"); info == nil || !info.ID.Equal(id) {
+		t.Error("Expected to find instance by label")
+	}
+	if info := c.FindInstance(formatUUID(a.id)); info == nil || info.Path != "/a" {
+		t.Error("Expected to find instance by UUID")
+	}
+	for _, label := range []string{"", "laptop"} {
+		a.settings["label"] = label
+		if a.Name() != a.Info().Name() {
+			t.Error("Expected the same name in the registry: ", a.Name(), a.Info().Name())
+		}
+	}
+}
@@ -12,6 +12,7 @@ type Resource struct {
 	Hash      *Hash
 	PathNodes *PathNodes
 	Size      int64
+	sigs      *blockSigs // cached block signatures, nil if there aren't any
 }
 
 func (r *Resource) RelativePath() *Path {
@@ -22,20 +23,74 @@ func (r *Resource) FullPath() string {
 	return r.PathNodes.Last().FullPath()
 }
 
+// Lookup finds the resource or directory at a path relative to the root of
+// the instance. If nothing is there now, a resource that used to be at that
+// path is returned.
+func (ins *Instance) Lookup(relPath string) *Resource {
+	var past *Resource
+	check := func(res *Resource) bool {
+		last := len(res.PathNodes.nodes) - 1
+		for i := last; i >= 0; i-- {
+			pn := res.PathNodes.nodes[i]
+			if pn.IsDeleted() {
+				continue
+			}
+			if i == last && pn.livePath(0) == relPath {
+				return true
+			}
+			if pn.pathAt(pn.Time, 0) == relPath {
+				past = res
+				return false
+			}
+		}
+		return false
+	}
+	for _, dir := range ins.directories {
+		if check(dir.Resource) {
+			return dir.Resource
+		}
+	}
+	for _, res := range ins.resources {
+		if check(res) {
+			return res
+		}
+	}
+	return past
+}
+
+// PathHistory is every location the resource has had, oldest first, with the
+// directories where they were at the time. Deletes show up as ".deleted".
+func (res *Resource) PathHistory() []string {
+	paths := make([]string, len(res.PathNodes.nodes))
+	for i, pn := range res.PathNodes.nodes {
+		paths[i] = pn.pathAt(pn.Time, 0)
+	}
+	return paths
+}
+
 type Directory struct {
 	*Resource
 	directories map[string]*Directory
 	resources   map[string]*Resource
 	tagged      bool
+	modTime     int64 // when it was last read, in unix nanoseconds. 0 if it needs to be read.
+	children    int   // how many things were in it
 }
 
 func (res *Resource) Serialize() *SerialResource {
-	return &SerialResource{
-		ID:        res.ID[:],
-		Hash:      res.Hash[:],
-		PathNodes: res.PathNodes.marshal(),
-		Size:      res.Size,
-	}
+	sRes := &SerialResource{
+		ID:         res.ID[:],
+		Hash:       res.Hash[:],
+		PathNodes:  res.PathNodes.marshal(),
+		Size:       res.Size,
+		Offset:     uint32(res.PathNodes.offset),
+		Checkpoint: uint32(res.PathNodes.checkpoint),
+	}
+	if res.sigs != nil {
+		sRes.BlockSize = uint32(res.sigs.blockSize)
+		sRes.BlockSigs = res.sigs.marshal()
+	}
+	return sRes
 }
 
 // Depth returns the directory depth of the resource
@@ -60,11 +115,14 @@ func (sRes *SerialResource) unmarshalInto(ins *Instance) *Resource {
 	for i, spn := range sRes.PathNodes {
 		pns.nodes[i] = spn.unmarshal(ins)
 	}
+	pns.offset = int(sRes.Offset)
+	pns.checkpoint = int(sRes.Checkpoint)
 	res := &Resource{
 		ID:        HashFromBytes(sRes.ID),
 		Hash:      HashFromBytes(sRes.Hash),
 		PathNodes: pns,
 		Size:      sRes.Size,
+		sigs:      unmarshalSigs(sRes.BlockSize, sRes.BlockSigs),
 	}
 	ins.resources[res.ID.String()] = res
 	return res
@@ -75,6 +133,8 @@ func (sRes *SerialResource) unmarshalDirInto(ins *Instance) *Directory {
 	for i, spn := range sRes.PathNodes {
 		pns.nodes[i] = spn.unmarshal(ins)
 	}
+	pns.offset = int(sRes.Offset)
+	pns.checkpoint = int(sRes.Checkpoint)
 	dir := &Directory{
 		Resource: &Resource{
 			ID:        HashFromBytes(sRes.ID),
@@ -99,14 +159,16 @@ func (ins *Instance) AddResourceWithPath(hash *Hash, size int64, pathNodes ...*P
 		//this (probably) means the resource was deleted and added again.
 		old.Hash = hash
 		old.Size = size
-		old.PathNodes.nodes = append(old.PathNodes.nodes, pathNodes...)
+		old.PathNodes.Record(pathNodes...)
 		err.Debug(old.PathNodes.Last().FullPath())
 		return old
 	}
+	pns := &PathNodes{}
+	pns.Record(pathNodes...)
 	res := &Resource{
 		ID:        resId,
 		Hash:      hash,
-		PathNodes: NewPathNodes(0, pathNodes...),
+		PathNodes: pns,
 		Size:      size,
 	}
 	ins.resources[res.ID.String()] = res
@@ -122,19 +184,16 @@ func (ins *Instance) AddDirectoryWithPath(hash *Hash, pathNodes ...*PathNode) *D
 		panic("Cannot create Directory without path")
 	}
 	tagged := false
-	pns := NewPathNodes(0, pathNodes...)
+	pns := &PathNodes{}
+	pns.Record(pathNodes...)
 	var id *Hash
 	pnsLast := pns.Last()
 	if l := len(pnsLast.Name); l == 0 || pnsLast.Name[l-1] != '/' {
 		panic("Bad directory name: " + pnsLast.Name)
 	}
-	if tagFile, e := filesystem.Open(pnsLast.FullPath() + ".tag.collection"); err.Check(e) {
-		defer tagFile.Close()
-		idBuf := make([]byte, 16)
-		if l, e := tagFile.Read(idBuf); err.Log(e) && l == 16 {
-			id = HashFromBytes(idBuf)
-			tagged = true
-		}
+	if tagId, e := readTag(pnsLast.FullPath() + ".tag.collection"); err.Check(e) {
+		id = tagId
+		tagged = true
 	}
 	if id == nil {
 		id = ins.generateResourceId(hash, pathNodes[0])
@@ -142,7 +201,7 @@ func (ins *Instance) AddDirectoryWithPath(hash *Hash, pathNodes ...*PathNode) *D
 	if old, ok := ins.directories[id.String()]; ok {
 		//this (probably) means the directory was deleted and added again.
 		old.tagged = tagged
-		old.PathNodes.nodes = append(old.PathNodes.nodes, pathNodes...)
+		old.PathNodes.Record(pathNodes...)
 		err.Debug(old.PathNodes.Last().FullPath())
 		return old
 	}
@@ -167,13 +226,26 @@ func (ins *Instance) AddDirectoryWithPath(hash *Hash, pathNodes ...*PathNode) *D
 	return dir
 }
 
+func (dir *Directory) serializeStat() *SerialDirStat {
+	return &SerialDirStat{
+		ID:       dir.ID[:],
+		ModTime:  dir.modTime,
+		Children: uint32(dir.children),
+	}
+}
+
+func (sStat *SerialDirStat) unmarshalInto(ins *Instance) {
+	if dir, ok := ins.directories[HashFromBytes(sStat.ID).String()]; ok {
+		dir.modTime = sStat.ModTime
+		dir.children = int(sStat.Children)
+	}
+}
+
 func (dir *Directory) WriteTag() {
-	if pn := dir.PathNodes.Last(); !dir.tagged && !pn.IsDeleted() {
-		tagFile, e := filesystem.Create(dir.FullPath() + ".tag.collection")
+	if pn := dir.PathNodes.Last(); !dir.tagged && !pn.IsDeleted() && keepsTags(dir.FullPath()) {
+		e := writeAtomic(dir.FullPath()+".tag.collection", withChecksum(dir.ID[:]), "")
 		if err.Log(e) {
-			defer tagFile.Close()
 			err.Debug(dir.ID, dir.Hash)
-			tagFile.Write(dir.ID[:])
 			dir.tagged = true
 		}
 	}
@@ -0,0 +1,813 @@
+package adasync
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"github.com/adamcolton/fs"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+An s3 instance is given as "s3://bucket/path". Every file is an object with
+the path as it's key, and a directory is the prefix of the keys in it. Mkdir
+puts an empty "dir/" object so an empty directory isn't lost. The state and
+config are objects like any other file. Tag files aren't written, directories
+keep their IDs through the state.
+
+Requests are signed with AWS signature version 4 and sent path style, so any
+S3 compatible endpoint can be used.
+
+A single PUT or copy is limited to 5GB, so anything bigger is sent in parts
+with a multipart upload, and copied in parts with UploadPartCopy. If it fails
+part way through the upload is aborted so the parts aren't left behind.
+*/
+
+var s3Defaults = map[string]string{
+	"s3 endpoint": "https://s3.amazonaws.com",
+	"s3 region":   "us-east-1",
+}
+
+// s3Setting falls back to the usual AWS environment variables for the keys.
+func s3Setting(key string) string {
+	if val, ok := Settings[key]; ok {
+		return val
+	}
+	switch key {
+	case "s3 access key":
+		return os.Getenv("AWS_ACCESS_KEY_ID")
+	case "s3 secret key":
+		return os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	return s3Defaults[key]
+}
+
+const s3Timeout = 30 * time.Second
+
+var (
+	// s3MaxPut is the largest object that's sent or copied in one request.
+	s3MaxPut int64 = 5 << 30
+	// s3PartSize is the size of each part of a multipart upload. S3 allows
+	// up to 10000 parts, so objects can be up to 5TB, which is S3's limit.
+	s3PartSize int64 = 512 << 20
+)
+
+type s3Transport struct {
+	prefix   string // s3://bucket
+	bucket   string
+	endpoint *url.URL
+	signer   *s3Signer
+	client   *http.Client
+}
+
+// DialS3 doesn't connect, every request stands on it's own. The endpoint,
+// region and keys are from the "s3 ..." settings.
+func DialS3(prefix string) (Transport, error) {
+	u, e := url.Parse(prefix)
+	if e != nil {
+		return nil, e
+	}
+	endpoint, e := url.Parse(s3Setting("s3 endpoint"))
+	if e != nil {
+		return nil, e
+	}
+	return &s3Transport{
+		prefix:   prefix,
+		bucket:   u.Host,
+		endpoint: endpoint,
+		signer: &s3Signer{
+			access: s3Setting("s3 access key"),
+			secret: s3Setting("s3 secret key"),
+			region: s3Setting("s3 region"),
+		},
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				ResponseHeaderTimeout: s3Timeout,
+			},
+		},
+	}, nil
+}
+
+func (t *s3Transport) Alive() bool { return true }
+
+func (t *s3Transport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
+
+// key is the object key for pathStr, without leading or trailing slashes.
+func (t *s3Transport) key(pathStr string) string {
+	return strings.Trim(strings.TrimPrefix(pathStr, t.prefix), "/")
+}
+
+var ErrS3 = errors.New("S3 request failed")
+
+// s3Error is what S3 sends back when a request fails.
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return ErrS3.Error() + ": " + strconv.Itoa(e.Status) + " " + e.Code + " " + e.Message
+}
+
+// do sends a signed request for key. A 404 is returned as os.ErrNotExist so
+// it can be checked with os.IsNotExist.
+func (t *s3Transport) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := *t.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + t.bucket + "/" + key
+	// sent escaped the same way it's signed
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+	if size == 0 {
+		body = nil
+	}
+	req, e := http.NewRequest(method, u.String(), body)
+	if e != nil {
+		return nil, e
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.ContentLength = size
+	if payloadHash == "" {
+		payloadHash = emptyHash
+	}
+	t.signer.sign(req, payloadHash, time.Now())
+	resp, e := t.client.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: method, Path: t.prefix + "/" + key, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		s3e := &s3Error{Status: resp.StatusCode}
+		buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		xml.Unmarshal(buf, s3e)
+		return nil, s3e
+	}
+	return resp, nil
+}
+
+// head is the info for the object at key
+func (t *s3Transport) head(key string) (*s3FileInfo, error) {
+	resp, e := t.do("HEAD", key, nil, nil, nil, 0, "")
+	if e != nil {
+		return nil, e
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &s3FileInfo{
+		name:    baseName(key),
+		size:    resp.ContentLength,
+		modTime: modTime,
+	}, nil
+}
+
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// list calls fn with what's directly under dir, which is a key ending in a
+// slash or empty for the root. fn returns false to stop.
+func (t *s3Transport) list(dir string, max int, fn func(*s3FileInfo) bool) error {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {dir},
+		"delimiter": {"/"},
+	}
+	if max > 0 {
+		query.Set("max-keys", strconv.Itoa(max))
+	}
+	for {
+		resp, e := t.do("GET", "", query, nil, nil, 0, "")
+		if e != nil {
+			return e
+		}
+		result := &s3ListResult{}
+		e = xml.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		if e != nil {
+			return e
+		}
+		for _, obj := range result.Contents {
+			if obj.Key == dir {
+				continue // the marker Mkdir put
+			}
+			if !fn(&s3FileInfo{name: obj.Key[len(dir):], size: obj.Size, modTime: obj.LastModified}) {
+				return nil
+			}
+		}
+		for _, pre := range result.CommonPrefixes {
+			if !fn(&s3FileInfo{name: strings.TrimSuffix(pre.Prefix[len(dir):], "/"), dir: true}) {
+				return nil
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// s3Key is a key and the size of it's object
+type s3Key struct {
+	key  string
+	size int64
+}
+
+// keysUnder is every key that starts with prefix, including markers.
+func (t *s3Transport) keysUnder(prefix string) ([]s3Key, error) {
+	var keys []s3Key
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+	for {
+		resp, e := t.do("GET", "", query, nil, nil, 0, "")
+		if e != nil {
+			return nil, e
+		}
+		result := &s3ListResult{}
+		e = xml.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		if e != nil {
+			return nil, e
+		}
+		for _, obj := range result.Contents {
+			keys = append(keys, s3Key{obj.Key, obj.Size})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// isDir is true if anything is under key, or there's a marker for it.
+func (t *s3Transport) isDir(key string) (bool, error) {
+	found := false
+	e := t.list(key+"/", 1, func(*s3FileInfo) bool {
+		found = true
+		return false
+	})
+	if e != nil || found {
+		return found, e
+	}
+	if _, e := t.head(key + "/"); e == nil {
+		return true, nil
+	} else if !os.IsNotExist(e) {
+		return false, e
+	}
+	return false, nil
+}
+
+func (t *s3Transport) stat(pathStr string) (*s3FileInfo, error) {
+	key := t.key(pathStr)
+	if key == "" {
+		return &s3FileInfo{name: "/", dir: true}, nil
+	}
+	if !strings.HasSuffix(pathStr, "/") {
+		if fi, e := t.head(key); e == nil || !os.IsNotExist(e) {
+			return fi, e
+		}
+	}
+	if ok, e := t.isDir(key); e != nil {
+		return nil, e
+	} else if ok {
+		return &s3FileInfo{name: baseName(key), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: pathStr, Err: os.ErrNotExist}
+}
+
+func (t *s3Transport) Stat(pathStr string) (os.FileInfo, error) {
+	fi, e := t.stat(pathStr)
+	if e != nil {
+		return nil, e
+	}
+	return fi, nil
+}
+
+func (t *s3Transport) Open(pathStr string) (fs.File, error) {
+	fi, e := t.stat(pathStr)
+	if e != nil {
+		return nil, e
+	}
+	return &s3File{t: t, key: t.key(pathStr), name: pathStr, info: fi}, nil
+}
+
+// Create writes to a local temp file, it's uploaded on Sync or Close.
+func (t *s3Transport) Create(pathStr string) (fs.File, error) {
+	tmp, e := ioutil.TempFile("", "adasync-s3")
+	if e != nil {
+		return nil, e
+	}
+	return &s3File{
+		t:     t,
+		key:   t.key(pathStr),
+		name:  pathStr,
+		info:  &s3FileInfo{name: baseName(t.key(pathStr))},
+		tmp:   tmp,
+		dirty: true,
+	}, nil
+}
+
+func (t *s3Transport) Mkdir(pathStr string, mode os.FileMode) error {
+	key := t.key(pathStr)
+	if key == "" {
+		return nil
+	}
+	resp, e := t.do("PUT", key+"/", nil, nil, nil, 0, "")
+	if e != nil {
+		return e
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// copy is done by the server, so nothing is downloaded. An object bigger than
+// s3MaxPut is copied in parts.
+func (t *s3Transport) copy(from, to string, size int64) error {
+	source := "/" + t.bucket + "/" + s3Escape(from, false)
+	if size > s3MaxPut {
+		return t.multipart(to, size, func(query url.Values, offset, length int64) (*http.Response, error) {
+			header := http.Header{
+				"X-Amz-Copy-Source":       {source},
+				"X-Amz-Copy-Source-Range": {"bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset+length-1, 10)},
+			}
+			return t.do("PUT", to, query, header, nil, 0, "")
+		})
+	}
+	resp, e := t.do("PUT", to, nil, http.Header{"X-Amz-Copy-Source": {source}}, nil, 0, "")
+	if e != nil {
+		return e
+	}
+	_, e = s3Result(resp, nil)
+	return e
+}
+
+// s3Result reads the body of resp into v. A copy or a multipart upload can
+// fail after the 200 is sent, that's in the body.
+func s3Result(resp *http.Response, v interface{}) (*http.Response, error) {
+	defer resp.Body.Close()
+	buf, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return nil, e
+	}
+	if s3e := (&s3Error{Status: resp.StatusCode}); xml.Unmarshal(buf, s3e) == nil && s3e.Code != "" {
+		return nil, s3e
+	}
+	if v != nil && len(buf) > 0 {
+		if e := xml.Unmarshal(buf, v); e != nil {
+			return nil, e
+		}
+	}
+	return resp, nil
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// multipart sends size bytes to key in parts of s3PartSize. sendPart sends
+// the part at offset, the query has it's number and the upload ID. The ETag
+// of each part is from the header for an upload, or the body for a copy.
+func (t *s3Transport) multipart(key string, size int64, sendPart func(query url.Values, offset, length int64) (*http.Response, error)) error {
+	resp, e := t.do("POST", key, url.Values{"uploads": {""}}, nil, nil, 0, "")
+	if e != nil {
+		return e
+	}
+	initiated := &struct{ UploadId string }{}
+	if _, e := s3Result(resp, initiated); e != nil {
+		return e
+	}
+	upload := url.Values{"uploadId": {initiated.UploadId}}
+	// the parts are kept until the upload is completed or aborted
+	abort := func(e error) error {
+		if resp, abortErr := t.do("DELETE", key, upload, nil, nil, 0, ""); abortErr == nil {
+			resp.Body.Close()
+		}
+		return e
+	}
+
+	complete := &struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{}
+	for offset := int64(0); offset < size; offset += s3PartSize {
+		length := s3PartSize
+		if offset+length > size {
+			length = size - offset
+		}
+		n := len(complete.Parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {initiated.UploadId}}
+		resp, e := sendPart(query, offset, length)
+		if e != nil {
+			return abort(e)
+		}
+		copied := &struct{ ETag string }{}
+		if resp, e = s3Result(resp, copied); e != nil {
+			return abort(e)
+		}
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			etag = copied.ETag
+		}
+		complete.Parts = append(complete.Parts, s3Part{n, etag})
+	}
+
+	body, e := xml.Marshal(complete)
+	if e != nil {
+		return abort(e)
+	}
+	sum := sha256.Sum256(body)
+	resp, e = t.do("POST", key, upload, nil, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(sum[:]))
+	if e != nil {
+		return abort(e)
+	}
+	if _, e := s3Result(resp, nil); e != nil {
+		return abort(e)
+	}
+	return nil
+}
+
+func (t *s3Transport) delete(key string) error {
+	resp, e := t.do("DELETE", key, nil, nil, nil, 0, "")
+	if e != nil {
+		return e
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Rename copies then deletes. A directory is renamed one key at a time.
+func (t *s3Transport) Rename(from, to string) error {
+	fromKey, toKey := t.key(from), t.key(to)
+	fi, e := t.stat(from)
+	if e != nil {
+		return e
+	}
+	if !fi.dir {
+		if e := t.copy(fromKey, toKey, fi.size); e != nil {
+			return e
+		}
+		return t.delete(fromKey)
+	}
+	keys, e := t.keysUnder(fromKey + "/")
+	if e != nil {
+		return e
+	}
+	for _, k := range keys {
+		if e := t.copy(k.key, toKey+k.key[len(fromKey):], k.size); e != nil {
+			return e
+		}
+	}
+	for _, k := range keys {
+		if e := t.delete(k.key); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (t *s3Transport) RemoveAll(pathStr string) error {
+	key := t.key(pathStr)
+	if key == "" {
+		return errors.New("Cannot remove the bucket")
+	}
+	keys, e := t.keysUnder(key + "/")
+	if e != nil {
+		return e
+	}
+	for _, k := range append(keys, s3Key{key: key}) {
+		if e := t.delete(k.key); e != nil && !os.IsNotExist(e) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Remove deletes a file, or a directory with nothing in it.
+func (t *s3Transport) Remove(pathStr string) error {
+	fi, e := t.stat(pathStr)
+	if e != nil {
+		return e
+	}
+	key := t.key(pathStr)
+	if !fi.dir {
+		return t.delete(key)
+	}
+	empty := true
+	if e := t.list(key+"/", 1, func(*s3FileInfo) bool {
+		empty = false
+		return false
+	}); e != nil {
+		return e
+	}
+	if !empty {
+		return &os.PathError{Op: "remove", Path: pathStr, Err: errors.New("directory not empty")}
+	}
+	return t.delete(key + "/")
+}
+
+func baseName(key string) string {
+	return key[strings.LastIndex(key, "/")+1:]
+}
+
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *s3FileInfo) Name() string { return fi.name }
+func (fi *s3FileInfo) Size() int64  { return fi.size }
+func (fi *s3FileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
+
+// ModTime is zero for a directory, a prefix doesn't have one.
+func (fi *s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *s3FileInfo) IsDir() bool        { return fi.dir }
+func (fi *s3FileInfo) Sys() interface{}   { return nil }
+
+// s3File reads an object with ranged GETs, so a Seek starts a new request.
+// Writes go to a temp file until they're uploaded.
+type s3File struct {
+	t      *s3Transport
+	key    string
+	name   string
+	info   *s3FileInfo
+	offset int64
+	body   io.ReadCloser
+	tmp    *os.File
+	dirty  bool
+}
+
+func (f *s3File) Read(b []byte) (int, error) {
+	if f.tmp != nil {
+		return f.tmp.Read(b)
+	}
+	if f.info.dir {
+		return 0, errors.New("Is a directory: " + f.name)
+	}
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		header := http.Header{"Range": {"bytes=" + strconv.FormatInt(f.offset, 10) + "-"}}
+		resp, e := f.t.do("GET", f.key, nil, header, nil, 0, "")
+		if e != nil {
+			return 0, e
+		}
+		f.body = resp.Body
+	}
+	n, e := f.body.Read(b)
+	f.offset += int64(n)
+	if e == io.EOF {
+		f.body.Close()
+		f.body = nil
+		if f.offset < f.info.size {
+			e = io.ErrUnexpectedEOF
+		}
+	}
+	return n, e
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	if f.tmp != nil {
+		return f.tmp.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return f.offset, errors.New("Negative seek")
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3File) Write(b []byte) (int, error) {
+	if f.tmp == nil {
+		return 0, errors.New("Not open for writing: " + f.name)
+	}
+	f.dirty = true
+	return f.tmp.Write(b)
+}
+
+// Sync uploads what's been written. Anything bigger than s3MaxPut is uploaded
+// in parts.
+func (f *s3File) Sync() error {
+	if f.tmp == nil || !f.dirty {
+		return nil
+	}
+	// it's read with ReadAt, so the offset for writing doesn't move
+	fi, e := f.tmp.Stat()
+	if e != nil {
+		return e
+	}
+	put := func(query url.Values, offset, length int64) (*http.Response, error) {
+		h := sha256.New()
+		if _, e := io.Copy(h, io.NewSectionReader(f.tmp, offset, length)); e != nil {
+			return nil, e
+		}
+		body := ioutil.NopCloser(io.NewSectionReader(f.tmp, offset, length))
+		return f.t.do("PUT", f.key, query, nil, body, length, hex.EncodeToString(h.Sum(nil)))
+	}
+	if size := fi.Size(); size > s3MaxPut {
+		e = f.t.multipart(f.key, size, put)
+	} else {
+		var resp *http.Response
+		if resp, e = put(nil, 0, size); e == nil {
+			resp.Body.Close()
+		}
+	}
+	if e != nil {
+		return e
+	}
+	f.dirty = false
+	return nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	if f.tmp == nil {
+		return nil
+	}
+	e := f.Sync()
+	f.tmp.Close()
+	os.Remove(f.tmp.Name())
+	f.tmp = nil
+	return e
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) {
+	if f.tmp != nil {
+		fi, e := f.tmp.Stat()
+		if e != nil {
+			return nil, e
+		}
+		return &s3FileInfo{name: f.info.name, size: fi.Size(), modTime: fi.ModTime()}, nil
+	}
+	return f.info, nil
+}
+
+func (f *s3File) Readdir(n int) ([]os.FileInfo, error) {
+	if !f.info.dir {
+		return nil, errors.New("Not a directory: " + f.name)
+	}
+	dir := f.key + "/"
+	if f.key == "" {
+		dir = ""
+	}
+	var fis []os.FileInfo
+	e := f.t.list(dir, 0, func(fi *s3FileInfo) bool {
+		fis = append(fis, fi)
+		return n <= 0 || len(fis) < n
+	})
+	return fis, e
+}
+
+// Name is the full path, like os.File
+func (f *s3File) Name() string { return f.name }
+
+var emptyHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// s3Signer signs requests with AWS signature version 4.
+type s3Signer struct {
+	access, secret, region string
+}
+
+func (s *s3Signer) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, vs := range req.Header {
+		k = strings.ToLower(k)
+		if k == "range" || k == "content-md5" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(vs, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	request := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		s3Query(req.URL.Query()),
+		canonical.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	reqHash := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	key := []byte("AWS4" + s.secret)
+	for _, part := range []string{day, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.access+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Query is the canonical query string, sorted with everything escaped.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string{}, query[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape escapes everything except the unreserved characters, and slashes
+// unless slash is set.
+func s3Escape(str string, slash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var out strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !slash {
+			out.WriteByte(c)
+		} else {
+			out.WriteByte('%')
+			out.WriteByte(hexDigits[c>>4])
+			out.WriteByte(hexDigits[c&15])
+		}
+	}
+	return out.String()
+}
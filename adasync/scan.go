@@ -1,6 +1,8 @@
 package adasync
 
 import (
+	"context"
+	"errors"
 	"github.com/adamcolton/err"
 	"os"
 	"path/filepath"
@@ -20,10 +22,16 @@ func fullScan() []string {
 }
 
 func FullScan() {
-	scan := fullScan()
+	FullScanContext(context.Background())
+}
+
+// FullScanContext stops searching for instances when ctx is done
+func FullScanContext(ctx context.Context) {
+	scan := ScanContext(ctx, full()).Slice()
 	for _, pathStr := range scan {
 		err.Debug("Found: ", pathStr)
-		Open(pathStr)
+		_, e := Open(pathStr)
+		err.Log(e)
 	}
 }
 
@@ -34,12 +42,32 @@ func quickScan() []string {
 func QuickScan() {
 	for _, pathStr := range quickScan() {
 		err.Debug("Found new drive: ", pathStr)
-		Open(pathStr)
+		_, e := Open(pathStr)
+		err.Log(e)
 	}
 }
 
 func SyncAll() {
+	SyncAllContext(context.Background())
+}
+
+// SyncAllContext stops syncing when ctx is done, but still writes the state
+// of every instance.
+func SyncAllContext(ctx context.Context) {
+	syncAll(ctx, false)
+}
+
+// DeepSyncAllContext is SyncAllContext, but every directory of every instance
+// is read, even if it looks unchanged.
+func DeepSyncAllContext(ctx context.Context) {
+	syncAll(ctx, true)
+}
+
+func syncAll(ctx context.Context, deep bool) {
 	for _, c := range collections {
+		if ctx.Err() != nil {
+			break
+		}
 		inss := make([]*Instance, len(c.instances))
 		idx := 0
 		for _, ins := range c.instances {
@@ -47,37 +75,129 @@ func SyncAll() {
 			idx++
 		}
 		for i, ins := range inss {
-			ins.SelfUpdate()
+			if ctx.Err() != nil {
+				break
+			}
+			ins.selfUpdate(deep)
 			if ins.dirty || ins.isNew {
 				for j, prev := range inss {
 					if j == i {
 						break
 					}
-					sync := Sync{
-						a:       ins,
-						b:       prev,
-						actions: make(map[int][]Action),
-					}
-					err.Debug("Syncing: ", ins.pathStr)
-					err.Debug("     To: ", prev.pathStr)
-					sync.Diff()
-					if !sync.Run() {
+					if !syncPair(ctx, ins, prev) {
 						break
 					}
 				}
 			}
 			ins.isNew = false
 		}
+		c.checkpoint()
 	}
 	for _, c := range collections {
 		for _, ins := range c.instances {
+			ins.maintain()
 			ins.Write()
 		}
 	}
 }
 
+var ErrDifferentCollections = errors.New("Instances are not in the same collection")
+
+// SyncInstances updates two instances of the same collection, syncs them with
+// each other and writes them.
+func SyncInstances(a, b *Instance) error {
+	if a.collection != b.collection {
+		return ErrDifferentCollections
+	}
+	a.SelfUpdate()
+	b.SelfUpdate()
+	syncPair(context.Background(), a, b)
+	a.collection.checkpoint()
+	for _, ins := range []*Instance{a, b} {
+		ins.maintain()
+		ins.Write()
+	}
+	return nil
+}
+
+// SyncPaths opens the instances under paths and syncs each of them with the
+// other open instances of it's collection.
+func SyncPaths(ctx context.Context, paths []string) {
+	for _, pathStr := range ScanContext(ctx, paths).Slice() {
+		if ctx.Err() != nil {
+			return
+		}
+		err.Debug("Found: ", pathStr)
+		if ins, e := Open(pathStr); err.Log(e) {
+			SyncInstance(ctx, ins)
+		}
+	}
+}
+
+// SyncInstance updates ins and syncs it with every other open instance of
+// it's collection.
+func SyncInstance(ctx context.Context, ins *Instance) {
+	ins.SelfUpdate()
+	for _, peer := range ins.collection.sortedInstances() {
+		if peer == ins || ctx.Err() != nil {
+			continue
+		}
+		peer.SelfUpdate()
+		syncPair(ctx, ins, peer)
+	}
+	ins.isNew = false
+	ins.collection.checkpoint()
+	for _, peer := range ins.collection.instances {
+		peer.maintain()
+		peer.Write()
+	}
+}
+
+// PlanSync updates two instances in memory and returns what syncing them
+// would do. Nothing is changed on disk.
+func PlanSync(a, b *Instance) ([]string, error) {
+	if a.collection != b.collection {
+		return nil, ErrDifferentCollections
+	}
+	a.SelfUpdate()
+	b.SelfUpdate()
+	sync := NewSync(a, b)
+	sync.Diff()
+	return sync.Plan(), nil
+}
+
+// syncPair runs a sync between two instances and returns false if there was
+// nothing to do.
+func syncPair(ctx context.Context, a, b *Instance) bool {
+	sync := NewSync(a, b)
+	err.Debug("Syncing: ", a.Name())
+	err.Debug("     To: ", b.Name())
+	sync.Diff()
+	ran := sync.RunContext(ctx)
+	if ctx.Err() != nil {
+		// a sync that was cut short doesn't count, b may not have seen
+		// everything a has
+		return false
+	}
+	mergePeers(a, b)
+	return ran
+}
+
+// maintain is run on every instance after syncing, before it's written.
+func (ins *Instance) maintain() {
+	ins.PurgeTrash()
+	ins.CollectTombstones()
+	ins.CompactHistory()
+}
+
+// DefaultScanPaths are the paths a full scan searches for instances.
+func DefaultScanPaths() []string {
+	return full()
+}
+
 type CollectionPaths struct {
 	paths map[string]bool
+	ctx   context.Context
 }
 
 func (cp *CollectionPaths) Slice() []string {
@@ -94,8 +214,14 @@ func (cp *CollectionPaths) Slice() []string {
 }
 
 func Scan(paths []string) *CollectionPaths {
+	return ScanContext(context.Background(), paths)
+}
+
+// ScanContext stops walking when ctx is done and returns what it found so far
+func ScanContext(ctx context.Context, paths []string) *CollectionPaths {
 	collectionPaths := &CollectionPaths{
 		paths: make(map[string]bool),
+		ctx:   ctx,
 	}
 	for _, path := range paths {
 		filepath.Walk(string(path), collectionPaths.AddIfCollection)
@@ -103,7 +229,13 @@ func Scan(paths []string) *CollectionPaths {
 	return collectionPaths
 }
 
-func (cp *CollectionPaths) AddIfCollection(subPath string, _ os.FileInfo, _ error) error {
+func (cp *CollectionPaths) AddIfCollection(subPath string, fi os.FileInfo, _ error) error {
+	if cp.ctx != nil && cp.ctx.Err() != nil {
+		return cp.ctx.Err()
+	}
+	if isTrash(fi) {
+		return filepath.SkipDir
+	}
 	subPath = toSlash(subPath)
 	if ignLstStr, ok := Settings["ignore"]; ok {
 		if osIgnore(subPath) {
@@ -119,7 +251,7 @@ func (cp *CollectionPaths) AddIfCollection(subPath string, _ os.FileInfo, _ erro
 	}
 	dir, file := filepath.Split(subPath)
 	file = strings.ToLower(file)
-	if file == "config.collection" || file == ".collection" {
+	if file == "config.collection" || file == ".collection" || "/"+file == cryptMarker {
 		cp.paths[dir] = true
 		return filepath.SkipDir
 	}
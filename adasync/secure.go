@@ -0,0 +1,262 @@
+package adasync
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUntrustedPeer = errors.New("Peer is not trusted")
+var ErrFrameSize = errors.New("Frame too large")
+
+const maxFrame = 1 << 20
+
+/*
+Every daemon has an ed25519 key. A peer is trusted by an instance if its key
+is in the instance's "trusted peers" and not in the daemon's "revoked peers".
+Connecting is a handshake where each side sends its key and a new X25519 key,
+then signs a hash of both hellos. The X25519 secret gives a key for each
+direction and everything after is sealed with AES-GCM, starting with an "ok"
+from each side once it's accepted the other.
+*/
+
+var identityCache struct {
+	sync.Mutex
+	path string
+	key  ed25519.PrivateKey
+}
+
+// PeerIdentity is the key this daemon proves itself to peers with. It's read
+// from the file in the "peer key" setting, which is created if it doesn't
+// exist.
+func PeerIdentity() (ed25519.PrivateKey, error) {
+	pathStr := GetServiceSetting("peer key")
+	identityCache.Lock()
+	defer identityCache.Unlock()
+	if identityCache.path == pathStr && identityCache.key != nil {
+		return identityCache.key, nil
+	}
+	var seed []byte
+	if buf, e := ioutil.ReadFile(pathStr); e == nil {
+		seed, e = base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+		if e != nil || len(seed) != ed25519.SeedSize {
+			return nil, errors.New("Bad peer key in " + pathStr)
+		}
+	} else if os.IsNotExist(e) {
+		seed = make([]byte, ed25519.SeedSize)
+		rand.Read(seed)
+		os.MkdirAll(filepath.Dir(pathStr), 0700)
+		if e := ioutil.WriteFile(pathStr, []byte(base64.StdEncoding.EncodeToString(seed)+"\n"), 0600); e != nil {
+			return nil, e
+		}
+	} else {
+		return nil, e
+	}
+	identityCache.path = pathStr
+	identityCache.key = ed25519.NewKeyFromSeed(seed)
+	return identityCache.key, nil
+}
+
+// PeerKeyString is how a peer's key is written in the settings.
+func PeerKeyString(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func keyIn(key ed25519.PublicKey, list string) bool {
+	if list == "" {
+		return false
+	}
+	str := PeerKeyString(key)
+	for _, cur := range StringList(list) {
+		if cur == str {
+			return true
+		}
+	}
+	return false
+}
+
+func revoked(key ed25519.PublicKey) bool {
+	return keyIn(key, GetServiceSetting("revoked peers"))
+}
+
+// trusts is true if the peer with key may read or write ins.
+func (ins *Instance) trusts(key ed25519.PublicKey) bool {
+	return key != nil && keyIn(key, ins.GetSetting("trusted peers")) && !revoked(key)
+}
+
+// secureConn is a connection after the handshake. Each Write is sent as one
+// sealed frame.
+type secureConn struct {
+	net.Conn
+	peer       ed25519.PublicKey
+	send, recv cipher.AEAD
+	sendN      uint64
+	recvN      uint64
+	rmux, wmux sync.Mutex
+	buf        []byte
+}
+
+const helloLen = ed25519.PublicKeySize + 32
+
+// secureHandshake authenticates both sides of conn. accept is given the
+// peer's key once it's proved it has it.
+func secureHandshake(conn net.Conn, key ed25519.PrivateKey, client bool, accept func(ed25519.PublicKey) bool) (*secureConn, error) {
+	if key == nil {
+		return nil, errors.New("No peer key")
+	}
+	conn.SetDeadline(time.Now().Add(peerTimeout))
+	defer conn.SetDeadline(time.Time{})
+	eph, e := ecdh.X25519().GenerateKey(rand.Reader)
+	if e != nil {
+		return nil, e
+	}
+	hello := append(append([]byte{}, key.Public().(ed25519.PublicKey)...), eph.PublicKey().Bytes()...)
+	theirs := make([]byte, helloLen)
+	if e := exchange(conn, hello, theirs); e != nil {
+		return nil, e
+	}
+	peer := ed25519.PublicKey(theirs[:ed25519.PublicKeySize])
+	theirEph, e := ecdh.X25519().NewPublicKey(theirs[ed25519.PublicKeySize:])
+	if e != nil {
+		return nil, e
+	}
+
+	clientHello, serverHello := hello, theirs
+	role, theirRole := "client", "server"
+	if !client {
+		clientHello, serverHello = theirs, hello
+		role, theirRole = theirRole, role
+	}
+	h := sha256.New()
+	h.Write(clientHello)
+	h.Write(serverHello)
+	transcript := h.Sum(nil)
+
+	sig := make([]byte, ed25519.SignatureSize)
+	if e := exchange(conn, ed25519.Sign(key, append([]byte("adasync "+role), transcript...)), sig); e != nil {
+		return nil, e
+	}
+	if !ed25519.Verify(peer, append([]byte("adasync "+theirRole), transcript...), sig) || !accept(peer) {
+		return nil, ErrUntrustedPeer
+	}
+
+	shared, e := eph.ECDH(theirEph)
+	if e != nil {
+		return nil, e
+	}
+	sc := &secureConn{Conn: conn, peer: peer}
+	if sc.send, e = directionKey(shared, transcript, role); e != nil {
+		return nil, e
+	}
+	if sc.recv, e = directionKey(shared, transcript, theirRole); e != nil {
+		return nil, e
+	}
+	// a side that didn't accept hangs up instead of confirming
+	ok := make([]byte, 2)
+	if e := exchange(sc, []byte("ok"), ok); e != nil {
+		return nil, ErrUntrustedPeer
+	}
+	return sc, nil
+}
+
+// exchange sends ours while it reads theirs, so neither side waits on the
+// other.
+func exchange(conn net.Conn, ours, theirs []byte) error {
+	sent := make(chan error, 1)
+	go func() {
+		_, e := conn.Write(ours)
+		sent <- e
+	}()
+	_, e := io.ReadFull(conn, theirs)
+	if e2 := <-sent; e == nil {
+		e = e2
+	}
+	return e
+}
+
+func directionKey(shared, transcript []byte, role string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write(transcript)
+	mac.Write([]byte(role))
+	block, e := aes.NewCipher(mac.Sum(nil))
+	if e != nil {
+		return nil, e
+	}
+	return cipher.NewGCM(block)
+}
+
+func frameNonce(n uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], n)
+	return nonce
+}
+
+func (sc *secureConn) Write(b []byte) (int, error) {
+	sc.wmux.Lock()
+	defer sc.wmux.Unlock()
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxFrame-sc.send.Overhead() {
+			chunk = chunk[:maxFrame-sc.send.Overhead()]
+		}
+		sealed := sc.send.Seal(nil, frameNonce(sc.sendN), chunk, nil)
+		sc.sendN++
+		frame := make([]byte, 4, 4+len(sealed))
+		binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+		if _, e := sc.Conn.Write(append(frame, sealed...)); e != nil {
+			return written, e
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+func (sc *secureConn) Read(b []byte) (int, error) {
+	sc.rmux.Lock()
+	defer sc.rmux.Unlock()
+	if len(sc.buf) == 0 {
+		var size [4]byte
+		if _, e := io.ReadFull(sc.Conn, size[:]); e != nil {
+			return 0, e
+		}
+		l := binary.BigEndian.Uint32(size[:])
+		if l > maxFrame {
+			return 0, ErrFrameSize
+		}
+		sealed := make([]byte, l)
+		if _, e := io.ReadFull(sc.Conn, sealed); e != nil {
+			return 0, e
+		}
+		opened, e := sc.recv.Open(nil, frameNonce(sc.recvN), sealed, nil)
+		if e != nil {
+			return 0, e
+		}
+		sc.recvN++
+		sc.buf = opened
+	}
+	n := copy(b, sc.buf)
+	sc.buf = sc.buf[n:]
+	return n, nil
+}
+
+func sameKey(a, b ed25519.PublicKey) bool {
+	return bytes.Equal(a, b)
+}
@@ -0,0 +1,158 @@
+package adasync
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSecureHandshake(t *testing.T) {
+	pubA, keyA, _ := ed25519.GenerateKey(rand.Reader)
+	pubB, keyB, _ := ed25519.GenerateKey(rand.Reader)
+	handshake := func(acceptA, acceptB ed25519.PublicKey) (*secureConn, *secureConn, error, error) {
+		ca, cb := net.Pipe()
+		var sa, sb *secureConn
+		var ea, eb error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			sa, ea = secureHandshake(ca, keyA, true, func(k ed25519.PublicKey) bool { return sameKey(k, acceptA) })
+			if ea != nil {
+				ca.Close()
+			}
+			wg.Done()
+		}()
+		go func() {
+			sb, eb = secureHandshake(cb, keyB, false, func(k ed25519.PublicKey) bool { return sameKey(k, acceptB) })
+			if eb != nil {
+				cb.Close()
+			}
+			wg.Done()
+		}()
+		wg.Wait()
+		return sa, sb, ea, eb
+	}
+
+	sa, sb, ea, eb := handshake(pubB, pubA)
+	if ea != nil || eb != nil {
+		t.Fatal(ea, eb)
+	}
+	if !sameKey(sa.peer, pubB) || !sameKey(sb.peer, pubA) {
+		t.Error("Each side should know the other's key")
+	}
+	go sa.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, e := io.ReadFull(sb, buf); e != nil || string(buf) != "hello" {
+		t.Error("Expected message to be sent over the secure connection")
+	}
+	sa.Close()
+
+	if _, _, ea, eb := handshake(pubB, pubB); eb != ErrUntrustedPeer || ea != ErrUntrustedPeer {
+		t.Error("Server should reject a client it doesn't trust: ", ea, eb)
+	}
+}
+
+// recordProxy forwards to addr and keeps everything that comes back.
+func recordProxy(ctx context.Context, t *testing.T, addr string) (string, *bytes.Buffer, *sync.Mutex) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	var mux sync.Mutex
+	buf := &bytes.Buffer{}
+	go func() {
+		for {
+			client, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			server, e := net.Dial("tcp", addr)
+			if e != nil {
+				client.Close()
+				continue
+			}
+			go io.Copy(server, client)
+			go func() {
+				b := make([]byte, 32*1024)
+				for {
+					n, e := server.Read(b)
+					mux.Lock()
+					buf.Write(b[:n])
+					mux.Unlock()
+					if e != nil || func() error { _, e := client.Write(b[:n]); return e }() != nil {
+						client.Close()
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), buf, &mux
+}
+
+func TestPeerAuth(t *testing.T) {
+	tmp := tempInstanceDir(t, "/a", "/b", "/c")
+	secret := []byte("the secret family recipe")
+	ioutil.WriteFile(tmp+"/a/recipe.txt", secret, 0600)
+	ioutil.WriteFile(tmp+"/c/other.txt", []byte("other"), 0600)
+	a, _ := Init(tmp+"/a", "")
+	b, _ := Init(tmp+"/b", a.CollectionId())
+	c, _ := Init(tmp+"/c", "")
+	key := trust(t, tmp, a, b)
+	defer delete(Settings, "peer key")
+	defer CloseTransports()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, port := startPeer(ctx, t, a)
+	s.Share(c)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	proxy, wire, mux := recordProxy(ctx, t, addr)
+	if e := PullPeer(ctx, b, "adasync://"+proxy+tmp+"/a"); e != nil {
+		t.Fatal(e)
+	}
+	if buf, e := ioutil.ReadFile(tmp + "/b/recipe.txt"); e != nil || !bytes.Equal(buf, secret) {
+		t.Fatal("Expected recipe to be pulled")
+	}
+	mux.Lock()
+	if wire.Len() == 0 || bytes.Contains(wire.Bytes(), secret) {
+		t.Error("Expected everything on the wire to be encrypted")
+	}
+	mux.Unlock()
+
+	// c doesn't trust us
+	if _, e := filesystem.Stat("adasync://" + addr + tmp + "/c/other.txt"); e == nil || e.Error() != ErrUntrustedPeer.Error() {
+		t.Error("Should not read an instance that doesn't trust us: ", e)
+	}
+
+	// a stranger can't connect at all
+	CloseTransports()
+	Settings["peer key"] = tmp + "/stranger.key"
+	if _, e := filesystem.Stat("adasync://" + addr + tmp + "/a/recipe.txt"); e == nil {
+		t.Error("Should reject a peer that isn't trusted")
+	}
+
+	CloseTransports()
+	Settings["peer key"] = tmp + "/peer.key"
+	Settings["revoked peers"] = PeerKeyString(key.Public().(ed25519.PublicKey))
+	defer delete(Settings, "revoked peers")
+	s.Share(a)
+	if _, e := filesystem.Stat("adasync://" + addr + tmp + "/a/recipe.txt"); e == nil {
+		t.Error("Should reject a revoked peer")
+	}
+	if e := PullPeer(ctx, b, "adasync://"+addr+tmp+"/a"); e == nil {
+		t.Error("Should not pull from a revoked peer")
+	}
+}
@@ -0,0 +1,204 @@
+package adasync
+
+import (
+	"github.com/adamcolton/err"
+	"github.com/adamcolton/fs"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sftpTransport reaches an instance like "sftp://user@host/path" over ssh.
+type sftpTransport struct {
+	prefix string
+	conn   *ssh.Client
+	client *sftp.Client
+	lost   int32
+}
+
+// DialSFTP connects with the keys from ssh-agent and the "ssh keys" setting.
+// The host has to be in the "known hosts" file.
+func DialSFTP(prefix string) (Transport, error) {
+	u, e := url.Parse(prefix)
+	if e != nil {
+		return nil, e
+	}
+	name := u.User.Username()
+	if name == "" {
+		if cur, e := user.Current(); err.Log(e) {
+			name = cur.Username
+		}
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host += ":22"
+	}
+	hostKeys, e := knownhosts.New(sshSetting("known hosts"))
+	if e != nil {
+		return nil, e
+	}
+	conn, e := ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            name,
+		Auth:            sshAuth(),
+		HostKeyCallback: hostKeys,
+		Timeout:         30 * time.Second,
+	})
+	if e != nil {
+		return nil, e
+	}
+	client, e := sftp.NewClient(conn)
+	if e != nil {
+		conn.Close()
+		return nil, e
+	}
+	err.Debug("Connected: ", prefix)
+	t := &sftpTransport{
+		prefix: prefix,
+		conn:   conn,
+		client: client,
+	}
+	go func() {
+		conn.Wait()
+		atomic.StoreInt32(&t.lost, 1)
+	}()
+	return t, nil
+}
+
+var sshDefaults = map[string]string{
+	"ssh keys":    "~/.ssh/id_ed25519,~/.ssh/id_ecdsa,~/.ssh/id_rsa",
+	"known hosts": "~/.ssh/known_hosts",
+}
+
+// sshSetting is a setting with ~ expanded to the home directory.
+func sshSetting(key string) string {
+	val, ok := Settings[key]
+	if !ok {
+		val = sshDefaults[key]
+	}
+	if home, e := os.UserHomeDir(); e == nil {
+		val = strings.Replace(val, "~", home, -1)
+	}
+	return val
+}
+
+func sshAuth() []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, e := net.Dial("unix", sock); err.Log(e) {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	var signers []ssh.Signer
+	for _, keyPath := range strings.Split(sshSetting("ssh keys"), ",") {
+		buf, e := ioutil.ReadFile(strings.TrimSpace(keyPath))
+		if e != nil {
+			continue
+		}
+		if signer, e := ssh.ParsePrivateKey(buf); err.Log(e) {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	return methods
+}
+
+func (t *sftpTransport) path(pathStr string) string {
+	p := strings.TrimPrefix(pathStr, t.prefix)
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
+func (t *sftpTransport) Alive() bool { return atomic.LoadInt32(&t.lost) == 0 }
+
+func (t *sftpTransport) Close() error {
+	t.client.Close()
+	return t.conn.Close()
+}
+
+func (t *sftpTransport) Open(pathStr string) (fs.File, error) {
+	p := t.path(pathStr)
+	f, e := t.client.Open(p)
+	if e != nil {
+		return nil, e
+	}
+	return &sftpFile{File: f, client: t.client, path: p, name: pathStr}, nil
+}
+
+func (t *sftpTransport) Create(pathStr string) (fs.File, error) {
+	p := t.path(pathStr)
+	f, e := t.client.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if e != nil {
+		return nil, e
+	}
+	return &sftpFile{File: f, client: t.client, path: p, name: pathStr}, nil
+}
+
+func (t *sftpTransport) Stat(pathStr string) (os.FileInfo, error) {
+	return t.client.Stat(t.path(pathStr))
+}
+
+func (t *sftpTransport) Mkdir(pathStr string, mode os.FileMode) error {
+	p := t.path(pathStr)
+	if e := t.client.Mkdir(p); e != nil {
+		return e
+	}
+	// not every server supports chmod, the directory is still usable
+	err.Log(t.client.Chmod(p, mode))
+	return nil
+}
+
+// Rename replaces the target like os.Rename if the server supports it.
+func (t *sftpTransport) Rename(from, to string) error {
+	if _, ok := t.client.HasExtension("posix-rename@openssh.com"); ok {
+		return t.client.PosixRename(t.path(from), t.path(to))
+	}
+	return t.client.Rename(t.path(from), t.path(to))
+}
+
+func (t *sftpTransport) RemoveAll(pathStr string) error {
+	return t.client.RemoveAll(t.path(pathStr))
+}
+
+func (t *sftpTransport) Remove(pathStr string) error {
+	return t.client.Remove(t.path(pathStr))
+}
+
+type sftpFile struct {
+	*sftp.File
+	client *sftp.Client
+	path   string
+	name   string
+}
+
+func (f *sftpFile) Readdir(n int) ([]os.FileInfo, error) {
+	fis, e := f.client.ReadDir(f.path)
+	if n > 0 && len(fis) > n {
+		fis = fis[:n]
+	}
+	return fis, e
+}
+
+// Sync is a no-op if the server can't fsync.
+func (f *sftpFile) Sync() error {
+	e := f.File.Sync()
+	if se, ok := e.(*sftp.StatusError); ok && se.FxCode() == sftp.ErrSSHFxOpUnsupported {
+		return nil
+	}
+	return e
+}
+
+// Name is the full path, like os.File
+func (f *sftpFile) Name() string { return f.name }
@@ -0,0 +1,152 @@
+package adasync
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+// startSFTP runs an ssh server on loopback that only serves sftp and only
+// accepts the client key. It returns the address and settings for a client.
+func startSFTP(t *testing.T, dir string) (string, map[string]string) {
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, e := ssh.NewSignerFromKey(hostPriv)
+	if e != nil {
+		t.Fatal(e)
+	}
+	clientPub, clientPriv, _ := ed25519.GenerateKey(rand.Reader)
+	authorized, _ := ssh.NewPublicKey(clientPub)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+
+	addr := ln.Addr().String()
+	block, e := ssh.MarshalPrivateKey(clientPriv, "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	keyPath := dir + "/id_ed25519"
+	hostsPath := dir + "/known_hosts"
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(block), 0600)
+	ioutil.WriteFile(hostsPath, []byte(knownhosts.Line([]string{addr}, hostKey.PublicKey())+"\n"), 0600)
+	return addr, map[string]string{
+		"ssh keys":    keyPath,
+		"known hosts": hostsPath,
+	}
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, e := ssh.NewServerConn(conn, config)
+	if e != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		ch, reqs, e := newCh.Accept()
+		if e != nil {
+			continue
+		}
+		go func() {
+			for req := range reqs {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					if server, e := sftp.NewServer(ch); e == nil {
+						server.Serve()
+						server.Close()
+					}
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestSFTPTransport(t *testing.T) {
+	tmp := tempInstanceDir(t, "/a/music/rock", "/b", "/keys")
+	ioutil.WriteFile(tmp+"/a/music/rock/song.mp3", []byte("song"), 0600)
+	ioutil.WriteFile(tmp+"/a/notes.txt", []byte("notes"), 0600)
+
+	addr, settings := startSFTP(t, tmp+"/keys")
+	for k, v := range settings {
+		Settings[k] = v
+		defer delete(Settings, k)
+	}
+	defer CloseTransports()
+
+	remote := "sftp://tester@" + addr + tmp + "/b"
+	if !IsRemote(remote) || IsRemote(tmp) {
+		t.Error("IsRemote is incorrect")
+	}
+	a, e := Init(tmp+"/a", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, e := Init(remote, a.CollectionId())
+	if e != nil {
+		t.Fatal(e)
+	}
+	SyncInstances(a, b)
+	if buf, e := ioutil.ReadFile(tmp + "/b/music/rock/song.mp3"); e != nil || string(buf) != "song" {
+		t.Fatal("Expected song to be copied over sftp")
+	}
+	if _, e := os.Stat(tmp + "/b/.collection"); e != nil {
+		t.Error("Expected state to be written over sftp")
+	}
+
+	os.Rename(tmp+"/a/notes.txt", tmp+"/a/music/notes.txt")
+	os.Remove(tmp + "/a/music/rock/song.mp3")
+	SyncInstances(a, b)
+	if _, e := os.Stat(tmp + "/b/music/notes.txt"); e != nil {
+		t.Error("Expected notes to be moved")
+	}
+	if _, e := os.Stat(tmp + "/b/music/rock/song.mp3"); !os.IsNotExist(e) {
+		t.Error("Expected song to be deleted")
+	}
+
+	// changes on the remote side are found by a self update over sftp
+	ioutil.WriteFile(tmp+"/b/fromb.txt", []byte("from b"), 0600)
+	SyncInstances(a, b)
+	if buf, e := ioutil.ReadFile(tmp + "/a/fromb.txt"); e != nil || string(buf) != "from b" {
+		t.Error("Expected file to be copied from the remote")
+	}
+
+	CloseTransports()
+	ins, e := Open(remote)
+	if e != nil || ins != b {
+		t.Error("Expected to reopen the remote instance")
+	}
+}
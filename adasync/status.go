@@ -0,0 +1,123 @@
+package adasync
+
+import (
+	"sort"
+)
+
+// PairStatus is what syncing two instances would change.
+type PairStatus struct {
+	A, B     *Instance
+	Added    int
+	Modified int
+	Moved    int
+	Deleted  int
+	Bytes    int64
+}
+
+func (ps *PairStatus) InSync() bool {
+	return ps.Added == 0 && ps.Modified == 0 && ps.Moved == 0 && ps.Deleted == 0
+}
+
+// Status runs a self diff on every open instance, without writing anything,
+// and reports what syncing each pair of instances in a collection would do.
+func Status() []*PairStatus {
+	var statuses []*PairStatus
+	for _, c := range sortedCollections() {
+		inss := c.sortedInstances()
+		for _, ins := range inss {
+			ins.SelfUpdate()
+		}
+		for i, a := range inss {
+			for _, b := range inss[i+1:] {
+				statuses = append(statuses, pairStatus(a, b))
+			}
+		}
+	}
+	return statuses
+}
+
+// pairStatus diffs a and b without changing if either is dirty
+func pairStatus(a, b *Instance) *PairStatus {
+	aDirty, bDirty := a.dirty, b.dirty
+	sync := NewSync(a, b)
+	sync.Diff()
+	a.dirty, b.dirty = aDirty, bDirty
+	return sync.Status()
+}
+
+// Status counts the actions Diff found. A copy and a delete at the same path
+// is a modified file, a non-static file that changes gets a new resource.
+func (sync *Sync) Status() *PairStatus {
+	ps := &PairStatus{
+		A: sync.a,
+		B: sync.b,
+	}
+	copied := make(map[string]bool)
+	deleted := make(map[string]bool)
+	for _, actions := range sync.actions {
+		for _, action := range actions {
+			switch action := action.(type) {
+			case *CpRes:
+				if action.res.PathNodes.Last().Parent() != nil {
+					copied[action.ins.pathStr+action.res.RelativePath().String()] = true
+					ps.Bytes += action.res.Size
+				}
+			case *CpDir:
+				if !action.dir.PathNodes.Last().IsDeleted() {
+					ps.Added++
+				}
+			case *MvRes:
+				if action.cloneFrom.PathNodes.Last().IsDeleted() {
+					deleted[action.cloneTo.FullPath()] = true
+				} else {
+					ps.Moved++
+				}
+			case *DeleteRes:
+				deleted[action.cloneTo.FullPath()] = true
+			}
+		}
+	}
+	for pathStr := range copied {
+		if deleted[pathStr] {
+			ps.Modified++
+		} else {
+			ps.Added++
+		}
+	}
+	for pathStr := range deleted {
+		if !copied[pathStr] {
+			ps.Deleted++
+		}
+	}
+	return ps
+}
+
+func sortedCollections() []*Collection {
+	cs := make([]*Collection, 0, len(collections))
+	for _, c := range collections {
+		cs = append(cs, c)
+	}
+	sort.Sort(byIdStr(cs))
+	return cs
+}
+
+type byIdStr []*Collection
+
+func (a byIdStr) Len() int           { return len(a) }
+func (a byIdStr) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byIdStr) Less(i, j int) bool { return a[i].IdStr() < a[j].IdStr() }
+
+func (c *Collection) sortedInstances() []*Instance {
+	inss := make([]*Instance, 0, len(c.instances))
+	for _, ins := range c.instances {
+		inss = append(inss, ins)
+	}
+	sort.Sort(byPath(inss))
+	return inss
+}
+
+type byPath []*Instance
+
+func (a byPath) Len() int           { return len(a) }
+func (a byPath) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byPath) Less(i, j int) bool { return a[i].pathStr < a[j].pathStr }
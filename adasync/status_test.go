@@ -0,0 +1,62 @@
+package adasync
+
+import (
+	"testing"
+)
+
+func TestSyncStatus(t *testing.T) {
+	c := New()
+	a := c.AddInstance("/a")
+	b := c.AddInstance("/b")
+	music := a.AddDirectory(&Hash{}, a.root, "music/")
+	b.directories[music.ID.String()] = &Directory{
+		Resource: &Resource{
+			ID:        music.ID,
+			Hash:      music.Hash,
+			PathNodes: music.PathNodes.clone(b),
+		},
+		directories: make(map[string]*Directory),
+		resources:   make(map[string]*Resource),
+	}
+	share := func(res *Resource) {
+		b.resources[res.ID.String()] = &Resource{
+			ID:        res.ID,
+			Hash:      res.Hash,
+			Size:      res.Size,
+			PathNodes: res.PathNodes.clone(b),
+		}
+	}
+	hash := func(b byte) *Hash {
+		return HashFromBytes([]byte{b, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	}
+
+	a.AddResource(hash(1), 100, music, "new.mp3")
+
+	moved := a.AddResource(hash(2), 10, music, "moved.mp3")
+	share(moved)
+	moved.PathNodes.Record(a.PathNode(a.root, "moved.mp3"))
+
+	deleted := a.AddResource(hash(3), 10, music, "deleted.mp3")
+	share(deleted)
+	deleted.PathNodes.Record(a.PathNodeFromHash(nil, ".deleted"))
+
+	old := a.AddResource(hash(4), 10, music, "notes.txt")
+	share(old)
+	old.PathNodes.Record(a.PathNodeFromHash(nil, ".deleted"))
+	a.AddResource(hash(5), 20, music, "notes.txt")
+
+	a.dirty, b.dirty = false, false
+	ps := pairStatus(a, b)
+	if ps.Added != 1 || ps.Moved != 1 || ps.Deleted != 1 || ps.Modified != 1 {
+		t.Errorf("Incorrect counts: %+v", ps)
+	}
+	if ps.Bytes != 120 {
+		t.Error("Incorrect bytes: ", ps.Bytes)
+	}
+	if ps.InSync() {
+		t.Error("Should not be in sync")
+	}
+	if a.dirty || b.dirty {
+		t.Error("Status should not make instances dirty")
+	}
+}
@@ -1,6 +1,7 @@
 package adasync
 
 import (
+	"context"
 	"github.com/adamcolton/err"
 	"io"
 	"math/rand"
@@ -12,6 +13,15 @@ type Sync struct {
 	b        *Instance
 	actions  map[int][]Action
 	maxDepth int
+	only     *Instance // if set, actions that change the other instance are dropped
+}
+
+func NewSync(a, b *Instance) *Sync {
+	return &Sync{
+		a:       a,
+		b:       b,
+		actions: make(map[int][]Action),
+	}
 }
 
 func (sync *Sync) Diff() {
@@ -33,14 +43,14 @@ func (sync *Sync) Diff() {
 				err.Debug("ResDir", aDir.FullPath())
 				sync.ResolveDirectoryDifference(id, i)
 			}
-		} else {
+		} else if !sync.a.seenBy(aDir.Resource, sync.b) {
 			err.Debug("CpyDir", aDir.FullPath())
 			sync.MakeDirectory(aDir, sync.b)
 			sync.b.dirty = true
 		}
 	}
 	for id, bDir := range sync.b.directories {
-		if _, ok := sync.a.directories[id]; !ok {
+		if _, ok := sync.a.directories[id]; !ok && !sync.b.seenBy(bDir.Resource, sync.a) {
 			err.Debug("CpyDir", bDir.FullPath())
 			sync.MakeDirectory(bDir, sync.a)
 			sync.a.dirty = true
@@ -53,14 +63,14 @@ func (sync *Sync) Diff() {
 				err.Debug("Resolve", aRes.FullPath(), i)
 				sync.ResolveResourceDifference(id, i)
 			}
-		} else {
+		} else if !sync.a.seenBy(aRes, sync.b) {
 			err.Debug("Copy", aRes.FullPath())
 			sync.CopyResource(aRes, sync.b)
 			sync.b.dirty = true
 		}
 	}
 	for id, bRes := range sync.b.resources {
-		if _, ok := sync.a.resources[id]; !ok {
+		if _, ok := sync.a.resources[id]; !ok && !sync.b.seenBy(bRes, sync.a) {
 			err.Debug("Copy", bRes.FullPath())
 			sync.CopyResource(bRes, sync.a)
 			sync.a.dirty = true
@@ -69,6 +79,11 @@ func (sync *Sync) Diff() {
 }
 
 func (sync *Sync) addAction(depth int, action Action) {
+	if sync.only != nil {
+		if ins := actionTarget(action); ins != nil && ins != sync.only {
+			return
+		}
+	}
 	actionList, ok := sync.actions[depth]
 	if !ok {
 		actionList = make([]Action, 0)
@@ -79,40 +94,87 @@ func (sync *Sync) addAction(depth int, action Action) {
 	}
 }
 
+// actionTarget is the instance an action changes. It's nil for actions that
+// are only added while running another action.
+func actionTarget(action Action) *Instance {
+	switch action := action.(type) {
+	case *CpRes:
+		return action.ins
+	case *CpDir:
+		return action.ins
+	case *MvRes:
+		return action.cloneTo.PathNodes.Last().Instance
+	case *DeleteRes:
+		return action.cloneTo.PathNodes.Last().Instance
+	}
+	return nil
+}
+
 func (sync *Sync) Run() bool {
+	return sync.RunContext(context.Background())
+}
+
+// RunContext stops between actions when ctx is done. Each action updates the
+// state as it goes, so the state is still correct for what did run. Renames
+// that are waiting still run, the state already has those files at the name
+// they're being renamed to.
+func (sync *Sync) RunContext(ctx context.Context) bool {
 	l := len(sync.actions)
 	if l == 0 {
 		return false
 	}
 
 	for i := 0; i <= sync.maxDepth; i++ {
-		sync.runList(i)
+		sync.runList(ctx, i)
 	}
 	for i := -sync.maxDepth - 1; i < 0; i++ {
-		sync.runList(i)
+		sync.runList(ctx, i)
 	}
 
 	return true
 }
 
-func (sync *Sync) runList(depth int) {
+func (sync *Sync) runList(ctx context.Context, depth int) {
 	actionList, ok := sync.actions[depth]
 	if ok {
 		delete(sync.actions, depth)
-		for i := 0; i < len(actionList); i++ {
-			actionList[i].Execute()
+		for _, action := range actionList {
+			if _, retry := action.(*RetryRename); ctx.Err() == nil || retry {
+				action.Execute()
+			}
+		}
+	}
+}
+
+// Plan describes the actions Diff found, in the order Run will execute them.
+// Actions that Run adds along the way, like retrying a rename, are not
+// included.
+func (sync *Sync) Plan() []string {
+	var plan []string
+	planList := func(depth int) {
+		for _, action := range sync.actions[depth] {
+			plan = append(plan, action.String())
 		}
 	}
+	for i := 0; i <= sync.maxDepth; i++ {
+		planList(i)
+	}
+	for i := -sync.maxDepth - 1; i < 0; i++ {
+		planList(i)
+	}
+	return plan
 }
 
 type Action interface {
 	Execute()
+	String() string
 }
 
 type CpRes struct {
 	res  *Resource
 	ins  *Instance
 	sync *Sync
+	sigs *blockSigs // found while copying, if ins caches them
 }
 
 func (sync *Sync) CopyResource(res *Resource, ins *Instance) {
@@ -132,27 +194,31 @@ func (cpRes *CpRes) Execute() {
 	}
 }
 
+func (cpRes *CpRes) String() string {
+	if cpRes.res.PathNodes.Last().Parent() == nil {
+		return "Record deleted " + cpRes.res.ID.String() + " on " + cpRes.ins.Name()
+	}
+	return "Copy " + cpRes.res.RelativePath().String() + " to " + cpRes.ins.Name()
+}
+
 func (cpRes *CpRes) copyResData() {
-	pns := &PathNodes{
-		nodes: make([]*PathNode, len(cpRes.res.PathNodes.nodes)),
-	}
-	for i, srcN := range cpRes.res.PathNodes.nodes {
-		pns.nodes[i] = &PathNode{
-			Name:     srcN.Name,
-			ParentID: srcN.ParentID,
-			Instance: cpRes.ins,
-		}
+	if cpRes.sigs == nil && cpRes.ins.cachesSigs() {
+		cpRes.sigs = cpRes.res.sigs
 	}
 	cpRes.ins.resources[cpRes.res.ID.String()] = &Resource{
 		ID:        cpRes.res.ID,
 		Hash:      cpRes.res.Hash,
-		PathNodes: pns,
+		PathNodes: cpRes.res.PathNodes.clone(cpRes.ins),
 		Size:      cpRes.res.Size,
+		sigs:      cpRes.sigs,
 	}
 }
 
 func (cpRes *CpRes) copyContents() bool {
-	srcStr := cpRes.res.FullPath()
+	if cpRes.ins.isObjectStore() {
+		return err.Log(cpRes.ins.storeObject(cpRes.res))
+	}
+	srcStr := cpRes.res.dataPath()
 	dstRelPath := cpRes.res.RelativePath()
 
 	dstStrRoot := cpRes.ins.pathStr
@@ -161,17 +227,39 @@ func (cpRes *CpRes) copyContents() bool {
 	name, moved := confirmedAavailableName(dstStrRoot, dstRelPath.name)
 	dstStr := dstStrRoot + name
 
+	// if the name is taken, it's likely an older version of the file
+	if !(moved && cpRes.copyDelta(srcStr, dstStrRoot+dstRelPath.name, dstStr)) && !cpRes.copyFile(srcStr, dstStr, name) {
+		return false
+	}
+	if moved {
+		cpRes.sync.addAction(-1, &RetryRename{
+			current: dstStr,
+			target:  dstStrRoot + dstRelPath.name,
+		})
+	}
+	return true
+}
+
+// copyFile copies all of srcStr to dstStr. If the instance caches
+// signatures, they're found as it's copied.
+func (cpRes *CpRes) copyFile(srcStr, dstStr, name string) bool {
 	if srcFile, e := filesystem.Open(srcStr); err.Log(e) {
 		defer srcFile.Close()
+		src, size, e := readContents(srcFile)
+		if !err.Log(e) {
+			return false
+		}
+		var sw *sigWriter
+		if size >= deltaMinSize && cpRes.ins.cachesSigs() {
+			sw = newSigWriter(size)
+			src = io.TeeReader(src, sw)
+		}
 		if dstFile, e := filesystem.Create(dstStr); err.Log(e) {
 			defer dstFile.Close()
-			if _, e := io.Copy(dstFile, srcFile); err.Log(e) {
+			if e := cpRes.ins.writeContents(dstFile, src, size, name); err.Log(e) {
 				dstFile.Sync()
-				if moved {
-					cpRes.sync.addAction(-1, &RetryRename{
-						current: dstStr,
-						target:  dstStrRoot + dstRelPath.name,
-					})
+				if sw != nil {
+					cpRes.sigs = sw.finish()
 				}
 				return true
 			}
@@ -196,25 +284,15 @@ func (sync *Sync) MakeDirectory(dir *Directory, ins *Instance) {
 
 func (cpDir *CpDir) Execute() {
 	err.Debug("Copying: ", cpDir.dir.FullPath())
-	if !cpDir.dir.PathNodes.Last().IsDeleted() {
+	if !cpDir.dir.PathNodes.Last().IsDeleted() && !cpDir.ins.isObjectStore() {
 		dstStr := cpDir.ins.pathStr + cpDir.dir.RelativePath().String()
 		filesystem.Mkdir(dstStr, 0700)
 	}
-	pns := &PathNodes{
-		nodes: make([]*PathNode, len(cpDir.dir.PathNodes.nodes)),
-	}
-	for i, srcN := range cpDir.dir.PathNodes.nodes {
-		pns.nodes[i] = &PathNode{
-			Name:     srcN.Name,
-			ParentID: srcN.ParentID,
-			Instance: cpDir.ins,
-		}
-	}
 	dir := &Directory{
 		Resource: &Resource{
 			ID:        cpDir.dir.ID,
 			Hash:      cpDir.dir.Hash,
-			PathNodes: pns,
+			PathNodes: cpDir.dir.PathNodes.clone(cpDir.ins),
 		},
 		directories: make(map[string]*Directory),
 		resources:   make(map[string]*Resource),
@@ -228,6 +306,13 @@ func (cpDir *CpDir) Execute() {
 	}
 }
 
+func (cpDir *CpDir) String() string {
+	if cpDir.dir.PathNodes.Last().IsDeleted() {
+		return "Record deleted " + cpDir.dir.ID.String() + " on " + cpDir.ins.Name()
+	}
+	return "Create " + cpDir.dir.RelativePath().String() + " on " + cpDir.ins.Name()
+}
+
 func (sync *Sync) ResolveDirectoryDifference(id string, divergeStart int) {
 	a := sync.a.directories[id]
 	b := sync.b.directories[id]
@@ -337,26 +422,45 @@ func resolveDifference(a, b *Resource, divergeStart int) int {
 
 	mv := MV_A2B
 
+	if apn.ParentID == nil && !apn.IsDeleted() {
+		err.Debug(apn.Name)
+		panic("Bad Node")
+	}
+	if bpn.ParentID == nil && !bpn.IsDeleted() {
+		err.Debug(bpn.Name)
+		panic("Bad Node")
+	}
+
 	// If divergeStart is equal to the length of one of the PathNode lists,
 	// that has highest priority; they were syncd at one point and then
 	// more has happened to the longer
-	// The next priority is if one of them was deleted, we choose the other
-	// If all else fails (neither is deleted and they have divergent histories)
-	// we choose which ever one has the longest relative path.
-	if len(a.PathNodes.nodes) == divergeStart {
+	// Next, if the vector clocks show one change was made knowing about the
+	// other, the later change wins.
+	// If the changes were concurrent and one of them was deleted, we choose
+	// the other. Otherwise the clocks give an order that every instance will
+	// agree on.
+	// Histories from before vector clocks have neither, so we choose which
+	// ever one has the longest relative path.
+	order := apn.Clock.Compare(bpn.Clock)
+	if a.PathNodes.Len() == divergeStart {
 		mv = MV_B2A
-	} else if len(b.PathNodes.nodes) == divergeStart || bpn.ParentID == nil {
-		if bpn.ParentID == nil && bpn.Name != ".deleted" {
-			err.Debug(bpn.Name)
-			panic("Bad Node")
+	} else if b.PathNodes.Len() == divergeStart || order == ClockAfter {
+	} else if order == ClockBefore {
+		mv = MV_B2A
+	} else if apn.IsDeleted() != bpn.IsDeleted() {
+		if apn.IsDeleted() {
+			mv = MV_B2A
 		}
-	} else if apn.ParentID == nil {
-		if apn.Name != ".deleted" {
-			panic("Bad Node")
+	} else if order == ClockConcurrent {
+		err.Debug("Concurrent changes to ", a.ID, " on ", apn.Instance.Name(), " and ", bpn.Instance.Name())
+		if apn.Clock.less(bpn.Clock) {
+			mv = MV_B2A
+		}
+	} else if !apn.IsDeleted() {
+		err.Debug("Conflicting histories for ", a.ID, " on ", apn.Instance.Name(), " and ", bpn.Instance.Name())
+		if len(bpn.RelativePath().String()) > len(apn.RelativePath().String()) {
+			mv = MV_B2A
 		}
-		mv = MV_B2A
-	} else if len(bpn.RelativePath().String()) > len(apn.RelativePath().String()) {
-		mv = MV_B2A
 	}
 
 	var pn *PathNode
@@ -407,6 +511,9 @@ func (mvRes *MvRes) Execute() {
 				start:     mvRes.start,
 			})
 		}
+	} else if cloneToNode.Instance.isObjectStore() {
+		// the path is only in the state
+		copyNodes(mvRes.cloneFrom.PathNodes, mvRes.cloneTo.PathNodes, mvRes.start)
 	} else {
 		//check that there isn't a file there, if there is, create a random prefix.
 		cloneToStrRoot := cloneToNode.Instance.pathStr
@@ -425,6 +532,14 @@ func (mvRes *MvRes) Execute() {
 	}
 }
 
+func (mvRes *MvRes) String() string {
+	cloneToNode := mvRes.cloneTo.PathNodes.Last()
+	if mvRes.cloneFrom.PathNodes.Last().IsDeleted() {
+		return "Delete " + cloneToNode.RelativePath().String() + " on " + cloneToNode.Instance.Name()
+	}
+	return "Move " + cloneToNode.RelativePath().String() + " to " + mvRes.cloneFrom.RelativePath().String() + " on " + cloneToNode.Instance.Name()
+}
+
 type DeleteRes struct {
 	cloneFrom *Resource
 	cloneTo   *Resource
@@ -433,27 +548,42 @@ type DeleteRes struct {
 
 func (deleteRes *DeleteRes) Execute() {
 	err.Debug("Deleting", deleteRes.cloneTo.FullPath())
-	err.Log(filesystem.RemoveAll(deleteRes.cloneTo.FullPath()))
+	ins := deleteRes.cloneTo.PathNodes.Last().Instance
+	err.Log(ins.moveToTrash(deleteRes.cloneTo))
 	copyNodes(deleteRes.cloneFrom.PathNodes, deleteRes.cloneTo.PathNodes, deleteRes.start)
 }
 
+func (deleteRes *DeleteRes) String() string {
+	return "Delete " + deleteRes.cloneTo.FullPath()
+}
+
+// copyNodes makes the history in toPns match fromPns from start on. Start is
+// a position in the full history, so it accounts for compaction.
 func copyNodes(fromPns, toPns *PathNodes, start int) {
 	ins := toPns.Last().Instance //in theory, all in the instance values should be the same
-	for i := start; i < len(fromPns.nodes); i++ {
-		cloneFrom := fromPns.nodes[i]
+	if start < fromPns.offset || start < toPns.offset {
+		// the histories were compacted differently, there's no overlap to
+		// splice, so take the whole thing
+		*toPns = *fromPns.clone(ins)
+		return
+	}
+	for i := start; i < fromPns.Len(); i++ {
+		cloneFrom := fromPns.nodes[i-fromPns.offset]
 		pn := &PathNode{
 			Name:     cloneFrom.Name,
 			ParentID: cloneFrom.ParentID,
 			Instance: ins,
+			Clock:    cloneFrom.Clock,
+			Time:     cloneFrom.Time,
 		}
-		if i >= len(toPns.nodes) {
+		if j := i - toPns.offset; j >= len(toPns.nodes) {
 			toPns.Add(pn)
 		} else {
-			toPns.nodes[i] = pn
+			toPns.nodes[j] = pn
 		}
 	}
-	if len(toPns.nodes) > len(fromPns.nodes) {
-		toPns.nodes = toPns.nodes[:len(fromPns.nodes)]
+	if toPns.Len() > fromPns.Len() {
+		toPns.nodes = toPns.nodes[:fromPns.Len()-toPns.offset]
 	}
 }
 
@@ -468,6 +598,10 @@ func (retry *RetryRename) Execute() {
 	}
 }
 
+func (retry *RetryRename) String() string {
+	return "Rename " + retry.current + " to " + retry.target
+}
+
 func (sync *Sync) ReadOnlyDiff(readOnly, write *Instance) {
 	for id, rDir := range readOnly.directories {
 		if _, ok := sync.b.directories[id]; !ok {
@@ -0,0 +1,272 @@
+package adasync
+
+import (
+	"crypto/rand"
+	"github.com/adamcolton/err"
+)
+
+// A tombstone is a resource who's last PathNode is ".deleted". It has to stay
+// in the collection state until every instance has seen the delete, otherwise
+// an instance that hasn't would copy the resource back. Each instance keeps a
+// seen-vector for each tombstone listing the instances that have seen it.
+// These are merged whenever two instances sync, and once every known instance
+// has seen a tombstone, it can be dropped.
+
+// newInstanceId generates a random (version 4) UUID
+func newInstanceId() *Hash {
+	id := &Hash{}
+	rand.Read(id[:])
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id
+}
+
+// ID uniquely identifies an instance across all copies of the collection
+func (ins *Instance) ID() *Hash {
+	return ins.id
+}
+
+func (ins *Instance) isTombstone(res *Resource) bool {
+	return res != ins.root.Resource && res.PathNodes.Last().IsDeleted()
+}
+
+// observeTombstones marks every tombstone in the instance as seen by this
+// instance. If a resource was restored, it's no longer a tombstone.
+func (ins *Instance) observeTombstones() {
+	self := ins.id.String()
+	observe := func(res *Resource) {
+		if !ins.isTombstone(res) {
+			return
+		}
+		seen, ok := ins.tombstones[res.ID.String()]
+		if !ok {
+			seen = make(map[string]*Hash)
+			ins.tombstones[res.ID.String()] = seen
+		}
+		if _, ok := seen[self]; !ok {
+			seen[self] = ins.id
+			ins.dirty = true
+		}
+	}
+	for _, res := range ins.resources {
+		observe(res)
+	}
+	for _, dir := range ins.directories {
+		observe(dir.Resource)
+	}
+	for resId := range ins.tombstones {
+		res, ok := ins.resources[resId]
+		if dir, isDir := ins.directories[resId]; isDir {
+			res, ok = dir.Resource, true
+		}
+		if !ok || !ins.isTombstone(res) {
+			delete(ins.tombstones, resId)
+			ins.dirty = true
+		}
+	}
+}
+
+// seenBy returns true if res is a tombstone that peer has already seen. If
+// the peer doesn't have the resource, that means it's already dropped it.
+func (ins *Instance) seenBy(res *Resource, peer *Instance) bool {
+	if !ins.isTombstone(res) {
+		return false
+	}
+	_, seen := ins.tombstones[res.ID.String()][peer.id.String()]
+	return seen
+}
+
+// mergePeers is called after two instances sync. Each learns about the
+// instances the other knows about and the tombstones they've seen.
+func mergePeers(a, b *Instance) {
+	a.observeTombstones()
+	b.observeTombstones()
+	t := now()
+	a.lastSync = t
+	b.lastSync = t
+	a.register(b.Info())
+	b.register(a.Info())
+	for _, info := range a.registry {
+		b.register(info)
+	}
+	for _, info := range b.registry {
+		a.register(info)
+	}
+	for _, id := range a.forgotten {
+		b.forget(id)
+	}
+	for _, id := range b.forgotten {
+		a.forget(id)
+	}
+	mergeSeen(a, b)
+	mergeSeen(b, a)
+}
+
+func mergeSeen(from, to *Instance) {
+	for resId, fromSeen := range from.tombstones {
+		toSeen, ok := to.tombstones[resId]
+		if !ok {
+			continue
+		}
+		for insId, id := range fromSeen {
+			if _, ok := toSeen[insId]; !ok {
+				toSeen[insId] = id
+				to.dirty = true
+			}
+		}
+	}
+}
+
+func (ins *Instance) forget(id *Hash) {
+	idStr := id.String()
+	if _, ok := ins.forgotten[idStr]; !ok {
+		ins.forgotten[idStr] = id
+		ins.dirty = true
+	}
+	if _, ok := ins.registry[idStr]; ok {
+		delete(ins.registry, idStr)
+		ins.dirty = true
+	}
+}
+
+// ForgetInstance is for instances that will never be sync'd again, like a lost
+// thumb drive. The ID can be found with FindInstance. Tombstones will no longer
+// wait for the forgotten instance to see them. This is sync'd to the other
+// instances of the collection.
+func (c *Collection) ForgetInstance(id *Hash) {
+	for _, ins := range c.instances {
+		ins.forget(id)
+	}
+}
+
+// CollectTombstones drops any tombstone that every known instance has seen.
+// Until an instance has sync'd with at least one other, nothing is collected.
+// Tombstones for resources still in the trash are kept so they can be
+// restored, and so are directories that are still in the history of anything
+// that's kept, the history needs them to be serialized.
+func (ins *Instance) CollectTombstones() {
+	ins.observeTombstones()
+	if len(ins.registry) == 0 {
+		return
+	}
+	collect := make(map[string]bool)
+	for resId, seen := range ins.tombstones {
+		if _, inTrash := ins.trash[resId]; inTrash {
+			continue
+		}
+		all := true
+		for idStr := range ins.registry {
+			if _, ok := seen[idStr]; !ok {
+				all = false
+				break
+			}
+		}
+		if all {
+			collect[resId] = true
+		}
+	}
+	// keeping a directory keeps the directories in it's history, so this runs
+	// until nothing else is kept
+	for kept := true; kept; {
+		kept = false
+		for id := range ins.parentsInUse(collect) {
+			if collect[id] {
+				delete(collect, id)
+				kept = true
+			}
+		}
+	}
+	for resId := range collect {
+		err.Debug("Collecting tombstone: ", resId)
+		if dir, ok := ins.directories[resId]; ok {
+			for _, pn := range dir.PathNodes.nodes {
+				if parent := pn.Parent(); parent != nil && parent.directories[pn.Name] == dir {
+					delete(parent.directories, pn.Name)
+				}
+			}
+		}
+		delete(ins.resources, resId)
+		delete(ins.directories, resId)
+		delete(ins.tombstones, resId)
+		ins.dirty = true
+	}
+}
+
+// parentsInUse are the IDs of the directories in the history of every
+// resource and directory that isn't being collected.
+func (ins *Instance) parentsInUse(collect map[string]bool) map[string]bool {
+	inUse := make(map[string]bool)
+	add := func(res *Resource) {
+		if collect[res.ID.String()] {
+			return
+		}
+		for _, pn := range res.PathNodes.nodes {
+			if pn.ParentID != nil {
+				inUse[pn.ParentID.String()] = true
+			}
+		}
+	}
+	for _, res := range ins.resources {
+		add(res)
+	}
+	for _, dir := range ins.directories {
+		add(dir.Resource)
+	}
+	return inUse
+}
+
+func (ins *Instance) serializePeers(sIns *SerialInstance) {
+	sIns.InstanceId = ins.id[:]
+	sIns.Registry = append(sIns.Registry, ins.Info().Serialize())
+	for _, info := range ins.registry {
+		sIns.Registry = append(sIns.Registry, info.Serialize())
+	}
+	for _, id := range ins.forgotten {
+		sIns.ForgottenInstances = append(sIns.ForgottenInstances, id[:])
+	}
+	for resId, seen := range ins.tombstones {
+		id, e := DecodeHash(resId)
+		if !err.Log(e) {
+			continue
+		}
+		sTomb := &SerialTombstone{
+			ID: id[:],
+		}
+		for insId, id := range seen {
+			if _, forgotten := ins.forgotten[insId]; !forgotten {
+				sTomb.SeenBy = append(sTomb.SeenBy, id[:])
+			}
+		}
+		sIns.Tombstones = append(sIns.Tombstones, sTomb)
+	}
+}
+
+func (sIns *SerialInstance) unmarshalPeersInto(ins *Instance) {
+	if len(sIns.InstanceId) == len(ins.id) {
+		ins.id = HashFromBytes(sIns.InstanceId)
+	}
+	for _, idBytes := range sIns.KnownInstances {
+		id := HashFromBytes(idBytes)
+		ins.registry[id.String()] = &InstanceInfo{ID: id}
+	}
+	for _, sInfo := range sIns.Registry {
+		info := sInfo.unmarshal()
+		if info.ID.Equal(ins.id) {
+			ins.lastSync = info.LastSync
+		} else {
+			ins.registry[info.ID.String()] = info
+		}
+	}
+	for _, idBytes := range sIns.ForgottenInstances {
+		id := HashFromBytes(idBytes)
+		ins.forgotten[id.String()] = id
+	}
+	for _, sTomb := range sIns.Tombstones {
+		seen := make(map[string]*Hash)
+		for _, idBytes := range sTomb.SeenBy {
+			id := HashFromBytes(idBytes)
+			seen[id.String()] = id
+		}
+		ins.tombstones[HashFromBytes(sTomb.ID).String()] = seen
+	}
+}
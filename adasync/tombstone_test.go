@@ -0,0 +1,157 @@
+package adasync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func addTombstone(ins *Instance, id *Hash) {
+	ins.resources[id.String()] = &Resource{
+		ID:        id,
+		Hash:      id,
+		PathNodes: NewPathNodes(0, ins.PathNode(ins.root, "foo.txt"), ins.PathNodeFromHash(nil, ".deleted")),
+	}
+}
+
+func TestCollectTombstones(t *testing.T) {
+	c := New()
+	a := c.AddInstance("/a")
+	b := c.AddInstance("/b")
+	id := HashFromBytes([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	addTombstone(a, id)
+	addTombstone(b, id)
+
+	a.CollectTombstones()
+	if _, ok := a.resources[id.String()]; !ok {
+		t.Error("Should not collect before syncing with a peer")
+	}
+
+	lost := newInstanceId()
+	b.register(&InstanceInfo{ID: lost})
+	mergePeers(a, b)
+	a.CollectTombstones()
+	if _, ok := a.resources[id.String()]; !ok {
+		t.Error("Should not collect before every instance has seen the tombstone")
+	}
+
+	c.ForgetInstance(lost)
+	a.CollectTombstones()
+	if _, ok := a.resources[id.String()]; ok {
+		t.Error("Expected tombstone to be collected")
+	}
+	if !b.seenBy(b.resources[id.String()], a) {
+		t.Error("Expected b to know a has seen the tombstone")
+	}
+}
+
+func TestSerializePeers(t *testing.T) {
+	c := New()
+	a := c.AddInstance("/a")
+	id := HashFromBytes([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	addTombstone(a, id)
+	a.observeTombstones()
+	a.register(&InstanceInfo{ID: newInstanceId(), Label: "Alice's phone"})
+	a.forget(newInstanceId())
+
+	sIns := &SerialInstance{}
+	a.serializePeers(sIns)
+	b := c.AddInstance("/b")
+	sIns.unmarshalPeersInto(b)
+	if !b.id.Equal(a.id) {
+		t.Error("Instance ID was not restored")
+	}
+	if len(b.registry) != 1 || len(b.forgotten) != 1 {
+		t.Error("Registry and forgotten instances were not restored")
+	}
+	for _, info := range b.registry {
+		if info.Label != "Alice's phone" {
+			t.Error("Registry label was not restored")
+		}
+	}
+	if _, ok := b.tombstones[id.String()][a.id.String()]; !ok {
+		t.Error("Seen-vector was not restored")
+	}
+}
+
+func TestKeepTrashedTombstones(t *testing.T) {
+	c := New()
+	a := c.AddInstance("/a")
+	b := c.AddInstance("/b")
+	id := HashFromBytes([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	addTombstone(a, id)
+	addTombstone(b, id)
+	a.trash[id.String()] = &TrashEntry{ID: id}
+	mergePeers(a, b)
+	a.CollectTombstones()
+	if _, ok := a.resources[id.String()]; !ok {
+		t.Error("Should not collect a tombstone that is still in the trash")
+	}
+	b.CollectTombstones()
+	if _, ok := b.resources[id.String()]; ok {
+		t.Error("Expected tombstone to be collected")
+	}
+}
+
+func TestCollectMovedFromDirectory(t *testing.T) {
+	tmp := tempInstanceDir(t, "/a/old", "/a/empty", "/b")
+	ioutil.WriteFile(tmp+"/a/old/song.mp3", []byte("song"), 0600)
+	a, e := Init(tmp+"/a", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, e := Init(tmp+"/b", a.CollectionId())
+	if e != nil {
+		t.Fatal(e)
+	}
+	SyncInstances(a, b)
+	old, empty := a.Lookup("/old/"), a.Lookup("/empty/")
+	if old == nil || empty == nil {
+		t.Fatal("Expected directories")
+	}
+
+	// move the song out of /old/ and delete it, only a collects
+	os.Rename(tmp+"/a/old/song.mp3", tmp+"/a/song.mp3")
+	os.RemoveAll(tmp + "/a/old")
+	os.RemoveAll(tmp + "/a/empty")
+	a.SelfUpdate()
+	syncPair(context.Background(), a, b)
+	a.observeTombstones()
+	b.observeTombstones()
+	mergePeers(a, b)
+	a.CollectTombstones()
+	if _, ok := a.directories[empty.ID.String()]; ok {
+		t.Fatal("Expected the empty directory to be collected")
+	}
+	if _, ok := a.root.directories["empty/"]; ok {
+		t.Error("Expected a collected directory to be removed from it's parent")
+	}
+	if _, ok := a.directories[old.ID.String()]; !ok {
+		t.Fatal("Expected a directory that's in a history to be kept")
+	}
+
+	// the history still has it's parent after it's written and read
+	buf := a.Marshal()
+	delete(a.collection.instances, a.pathStr)
+	a2, _, e := unmarshal(buf, a.pathStr)
+	if e != nil {
+		t.Fatal(e)
+	}
+	song := a2.Lookup("/song.mp3")
+	if song == nil || !song.PathNodes.nodes[0].ParentID.Equal(old.ID) {
+		t.Fatal("Expected the first location of song to still be in /old/")
+	}
+	bSong := b.resources[song.ID.String()]
+	if d := song.PathNodes.DiffAt(bSong.PathNodes); d != -1 {
+		t.Error("Expected the same history as an instance that hasn't collected: ", d)
+	}
+	l := bSong.PathNodes.Len()
+	syncPair(context.Background(), a2, b)
+	if bSong.PathNodes.Len() != l || song.PathNodes.Len() != l {
+		t.Error("Expected nothing to change in the history")
+	}
+	if buf, e := ioutil.ReadFile(tmp + "/b/song.mp3"); e != nil || string(buf) != "song" {
+		t.Error("Expected song to stay where it is")
+	}
+}
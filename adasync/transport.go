@@ -0,0 +1,239 @@
+package adasync
+
+import (
+	"errors"
+	"github.com/adamcolton/fs"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Transport reaches the files of a remote instance. It's given the full path,
+// like "sftp://user@host/music/a.mp3", the same as the local filesystem would
+// be.
+type Transport interface {
+	fs.FileSystem
+	Close() error
+	// Alive is false once the connection is lost, the transport will be
+	// dialed again the next time it's used.
+	Alive() bool
+}
+
+// Dialer connects to a remote. The prefix is everything before the path,
+// like "sftp://user@host:22".
+type Dialer func(prefix string) (Transport, error)
+
+// Dialers by scheme
+var Dialers = map[string]Dialer{
+	"sftp":    DialSFTP,
+	"adasync": DialPeer,
+	"s3":      DialS3,
+}
+
+// untagged are the schemes that don't get tag files. An object store has no
+// directories to put them in, the directory IDs are only kept in the state.
+var untagged = map[string]bool{
+	"s3": true,
+}
+
+// keepsTags is false if pathStr is on a transport that doesn't use tag files.
+func keepsTags(pathStr string) bool {
+	if !IsRemote(pathStr) {
+		return true
+	}
+	scheme, _, _ := splitRemote(pathStr)
+	return !untagged[scheme]
+}
+
+var ErrUnknownScheme = errors.New("Unknown scheme")
+var ErrCrossTransport = errors.New("Cannot rename between transports")
+
+// IsRemote is true if pathStr is reached through a Transport.
+func IsRemote(pathStr string) bool {
+	return strings.Contains(pathStr, "://")
+}
+
+// splitRemote breaks "sftp://user@host/a/b" into "sftp", "sftp://user@host"
+// and "/a/b".
+func splitRemote(pathStr string) (scheme, prefix, rest string) {
+	i := strings.Index(pathStr, "://")
+	scheme = pathStr[:i]
+	rest = pathStr[i+3:]
+	j := strings.Index(rest, "/")
+	if j == -1 {
+		return scheme, pathStr, "/"
+	}
+	return scheme, pathStr[:i+3+j], rest[j:]
+}
+
+// router is the filesystem everything goes through. Remote paths go to their
+// transport and everything else to local.
+type router struct {
+	mux     sync.Mutex
+	local   fs.FileSystem
+	remote  map[string]Transport // prefix -> transport
+	dialing map[string]*dialCall // prefix -> dial that hasn't finished
+	crypt   map[string]*cryptFS  // root -> encrypted instance
+}
+
+// dialCall is a dial in progress, done is closed once t and e are set.
+type dialCall struct {
+	done chan struct{}
+	t    Transport
+	e    error
+}
+
+func newRouter(local fs.FileSystem) *router {
+	return &router{
+		local:   local,
+		remote:  make(map[string]Transport),
+		dialing: make(map[string]*dialCall),
+		crypt:   make(map[string]*cryptFS),
+	}
+}
+
+// route goes through cryptFS for anything in an encrypted instance, it
+// then uses transport for the encrypted path.
+func (r *router) route(pathStr string) (fs.FileSystem, error) {
+	r.mux.Lock()
+	for root, c := range r.crypt {
+		if pathStr == root || strings.HasPrefix(pathStr, root+"/") {
+			r.mux.Unlock()
+			return c, nil
+		}
+	}
+	r.mux.Unlock()
+	return r.transport(pathStr)
+}
+
+func (r *router) encrypted(root string) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	_, ok := r.crypt[root]
+	return ok
+}
+
+func (r *router) transport(pathStr string) (fs.FileSystem, error) {
+	if !IsRemote(pathStr) {
+		return r.local, nil
+	}
+	scheme, prefix, _ := splitRemote(pathStr)
+	r.mux.Lock()
+	if t, ok := r.remote[prefix]; ok && t.Alive() {
+		r.mux.Unlock()
+		return t, nil
+	}
+	// a dial can take a while, the lock is only held to find or publish it so
+	// everything else keeps going. Anything else that needs the same prefix
+	// waits for the same dial.
+	call, ok := r.dialing[prefix]
+	if !ok {
+		dial, ok := Dialers[scheme]
+		if !ok {
+			r.mux.Unlock()
+			return nil, ErrUnknownScheme
+		}
+		call = &dialCall{done: make(chan struct{})}
+		r.dialing[prefix] = call
+		r.mux.Unlock()
+		call.t, call.e = dial(prefix)
+		r.mux.Lock()
+		delete(r.dialing, prefix)
+		old := r.remote[prefix]
+		if call.e == nil {
+			r.remote[prefix] = call.t
+		}
+		r.mux.Unlock()
+		close(call.done)
+		// the one it replaces lost it's connection, but it still has to be
+		// closed to stop it's client
+		if old != nil && call.e == nil {
+			old.Close()
+		}
+	} else {
+		r.mux.Unlock()
+		<-call.done
+	}
+	if call.e != nil {
+		return nil, call.e
+	}
+	return call.t, nil
+}
+
+// closeAll disconnects every transport.
+func (r *router) closeAll() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for prefix, t := range r.remote {
+		t.Close()
+		delete(r.remote, prefix)
+	}
+}
+
+func (r *router) Open(pathStr string) (fs.File, error) {
+	f, e := r.route(pathStr)
+	if e != nil {
+		return nil, e
+	}
+	return f.Open(pathStr)
+}
+
+func (r *router) Create(pathStr string) (fs.File, error) {
+	f, e := r.route(pathStr)
+	if e != nil {
+		return nil, e
+	}
+	return f.Create(pathStr)
+}
+
+func (r *router) Stat(pathStr string) (os.FileInfo, error) {
+	f, e := r.route(pathStr)
+	if e != nil {
+		return nil, e
+	}
+	return f.Stat(pathStr)
+}
+
+func (r *router) Mkdir(pathStr string, mode os.FileMode) error {
+	f, e := r.route(pathStr)
+	if e != nil {
+		return e
+	}
+	return f.Mkdir(pathStr, mode)
+}
+
+func (r *router) Rename(from, to string) error {
+	f, e := r.route(from)
+	if e != nil {
+		return e
+	}
+	if t, e := r.route(to); e != nil {
+		return e
+	} else if t != f {
+		return ErrCrossTransport
+	}
+	return f.Rename(from, to)
+}
+
+func (r *router) RemoveAll(pathStr string) error {
+	f, e := r.route(pathStr)
+	if e != nil {
+		return e
+	}
+	return f.RemoveAll(pathStr)
+}
+
+func (r *router) Remove(pathStr string) error {
+	f, e := r.route(pathStr)
+	if e != nil {
+		return e
+	}
+	return f.Remove(pathStr)
+}
+
+// CloseTransports disconnects from every remote instance.
+func CloseTransports() {
+	if r, ok := filesystem.(*router); ok {
+		r.closeAll()
+	}
+}
@@ -0,0 +1,84 @@
+package adasync
+
+import (
+	"github.com/adamcolton/fs"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testTransport struct {
+	fs.FileSystem
+	dead, closed bool
+}
+
+func (t *testTransport) Close() error {
+	t.closed = true
+	return nil
+}
+
+func (t *testTransport) Alive() bool { return !t.dead }
+
+func TestRouterDialUnlocked(t *testing.T) {
+	release := make(chan bool)
+	started := make(chan bool)
+	dials := 0
+	Dialers["test"] = func(prefix string) (Transport, error) {
+		if prefix == "test://slow" {
+			dials++
+			started <- true
+			<-release
+		}
+		return &testTransport{FileSystem: fs.Std}, nil
+	}
+	defer delete(Dialers, "test")
+
+	r := newRouter(fs.Std)
+	var wg sync.WaitGroup
+	got := make([]fs.FileSystem, 2)
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			got[i], _ = r.transport("test://slow/a")
+		}(i)
+	}
+	<-started
+
+	// while slow is dialing, anything else can still get through
+	done := make(chan bool)
+	go func() {
+		r.transport("test://fast/a")
+		r.route("/local")
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Dial should not block other transports")
+	}
+
+	close(release)
+	wg.Wait()
+	if dials != 1 || got[0] == nil || got[0] != got[1] {
+		t.Error("Both should get the same transport from one dial")
+	}
+}
+
+func TestRouterRedialCloses(t *testing.T) {
+	Dialers["test"] = func(prefix string) (Transport, error) {
+		return &testTransport{FileSystem: fs.Std}, nil
+	}
+	defer delete(Dialers, "test")
+
+	r := newRouter(fs.Std)
+	first, _ := r.transport("test://host/a")
+	first.(*testTransport).dead = true
+	second, _ := r.transport("test://host/a")
+	if second == first {
+		t.Fatal("Expected a dead transport to be dialed again")
+	}
+	if !first.(*testTransport).closed {
+		t.Error("Expected the dead transport to be closed")
+	}
+}
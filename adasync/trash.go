@@ -0,0 +1,209 @@
+package adasync
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/adamcolton/err"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// trashDir is where an instance keeps resources that a sync deleted. Rather
+// than removing a file as soon as a peer says it's gone, it's moved here and
+// held on to according to the "trash days" and "trash max bytes" settings.
+const trashDir = "/.trash.collection/"
+
+var now = time.Now
+
+var (
+	ErrNotDeleted  = errors.New("Resource is not deleted")
+	ErrNotInTrash  = errors.New("Resource is not in the trash")
+	ErrNoLocation  = errors.New("Resource has no location to restore to")
+	ErrParentGone  = errors.New("Parent directory of resource is deleted")
+	ErrUnknownRes  = errors.New("Unknown resource")
+	ErrRestoreRoot = errors.New("Cannot restore the root directory")
+)
+
+// TrashEntry is a resource that was deleted by a sync and is being held in the
+// trash.
+type TrashEntry struct {
+	ID      *Hash
+	Deleted time.Time
+	Size    int64
+}
+
+func trashName(id *Hash) string {
+	return base64.URLEncoding.EncodeToString(id[:])
+}
+
+func (ins *Instance) trashPath(id *Hash) string {
+	return ins.pathStr + trashDir + trashName(id)
+}
+
+// isTrash is used while walking an instance to skip over the trash
+func isTrash(fi os.FileInfo) bool {
+	return fi != nil && fi.IsDir() && fi.Name()+"/" == trashDir[1:]
+}
+
+// moveToTrash moves the resource from it's current location into the trash.
+// It should be called before the ".deleted" node is added to the resource.
+func (ins *Instance) moveToTrash(res *Resource) error {
+	if !ins.isObjectStore() {
+		if e := ins.trashContents(res); e != nil {
+			return e
+		}
+	}
+	ins.trash[res.ID.String()] = &TrashEntry{
+		ID:      res.ID,
+		Deleted: now(),
+		Size:    res.Size,
+	}
+	ins.dirty = true
+	return nil
+}
+
+// trashContents moves the file or directory for res into the trash
+// directory. An object store keeps the contents where they are.
+func (ins *Instance) trashContents(res *Resource) error {
+	filesystem.Mkdir(ins.pathStr+trashDir, 0700)
+	dst := ins.trashPath(res.ID)
+	if _, e := filesystem.Stat(dst); e == nil {
+		// deleted, restored and deleted again
+		err.Log(filesystem.RemoveAll(dst))
+	}
+	return filesystem.Rename(res.FullPath(), dst)
+}
+
+// Trash returns the entries in the trash, oldest first.
+func (ins *Instance) Trash() []*TrashEntry {
+	entries := make([]*TrashEntry, 0, len(ins.trash))
+	for _, entry := range ins.trash {
+		entries = append(entries, entry)
+	}
+	sort.Sort(byDeleted(entries))
+	return entries
+}
+
+type byDeleted []*TrashEntry
+
+func (a byDeleted) Len() int           { return len(a) }
+func (a byDeleted) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDeleted) Less(i, j int) bool { return a[i].Deleted.Before(a[j].Deleted) }
+
+// Restore takes a resource out of the trash and puts it back at the last
+// location it had before it was deleted. The restore is recorded as a new
+// PathNode, so it will be sync'd to peers the same way a move is.
+func (ins *Instance) Restore(id *Hash) error {
+	var res *Resource
+	var dir *Directory
+	if dir = ins.directories[id.String()]; dir != nil {
+		if dir == ins.root {
+			return ErrRestoreRoot
+		}
+		res = dir.Resource
+	} else if res = ins.resources[id.String()]; res == nil {
+		return ErrUnknownRes
+	}
+	if !res.PathNodes.Last().IsDeleted() {
+		return ErrNotDeleted
+	}
+	entry, ok := ins.trash[id.String()]
+	if !ok {
+		return ErrNotInTrash
+	}
+
+	var last *PathNode
+	for i := len(res.PathNodes.nodes) - 1; i >= 0; i-- {
+		if pn := res.PathNodes.nodes[i]; !pn.IsDeleted() {
+			last = pn
+			break
+		}
+	}
+	if last == nil {
+		return ErrNoLocation
+	}
+	parent := last.Parent()
+	if parent == nil || parent.PathNodes.Last().IsDeleted() {
+		return ErrParentGone
+	}
+
+	name := last.Name
+	if !ins.isObjectStore() {
+		dstRoot := ins.pathStr + parent.RelativePath().String()
+		var moved bool
+		name, moved = confirmedAavailableName(dstRoot, last.Name)
+		if e := filesystem.Rename(ins.trashPath(entry.ID), dstRoot+name); e != nil {
+			return e
+		}
+		if moved {
+			err.Debug("Restored to: ", dstRoot+name)
+		}
+	}
+	pn := ins.PathNode(parent, name)
+	res.PathNodes.Record(pn)
+	if dir != nil {
+		parent.directories[name] = dir
+	}
+	delete(ins.trash, id.String())
+	ins.dirty = true
+	return nil
+}
+
+// PurgeTrash permanently removes anything in the trash that is older than
+// "trash days" and, oldest first, anything that puts the trash over
+// "trash max bytes". A value of 0 for either setting disables that limit.
+func (ins *Instance) PurgeTrash() {
+	days, _ := strconv.Atoi(ins.GetSetting("trash days"))
+	maxBytes, _ := strconv.ParseInt(ins.GetSetting("trash max bytes"), 10, 64)
+	for _, entry := range expiredTrash(ins.Trash(), now(), days, maxBytes) {
+		err.Debug("Emptying from trash: ", entry.ID)
+		var e error
+		if ins.isObjectStore() {
+			e = ins.removeObject(entry.ID)
+		} else {
+			e = filesystem.RemoveAll(ins.trashPath(entry.ID))
+		}
+		if err.Log(e) {
+			delete(ins.trash, entry.ID.String())
+			ins.dirty = true
+		}
+	}
+}
+
+// expiredTrash takes the entries in the trash sorted oldest first and returns
+// the ones that should be removed.
+func expiredTrash(entries []*TrashEntry, t time.Time, days int, maxBytes int64) []*TrashEntry {
+	var expired []*TrashEntry
+	total := int64(0)
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	cutoff := t.AddDate(0, 0, -days)
+	for _, entry := range entries {
+		if (days > 0 && entry.Deleted.Before(cutoff)) || (maxBytes > 0 && total > maxBytes) {
+			expired = append(expired, entry)
+			total -= entry.Size
+		}
+	}
+	return expired
+}
+
+func (entry *TrashEntry) Serialize() *SerialTrashEntry {
+	return &SerialTrashEntry{
+		ID:      entry.ID[:],
+		Deleted: entry.Deleted.Unix(),
+		Size:    entry.Size,
+	}
+}
+
+func (sEntry *SerialTrashEntry) unmarshalInto(ins *Instance) *TrashEntry {
+	entry := &TrashEntry{
+		ID:      HashFromBytes(sEntry.ID),
+		Deleted: time.Unix(sEntry.Deleted, 0),
+		Size:    sEntry.Size,
+	}
+	ins.trash[entry.ID.String()] = entry
+	return entry
+}
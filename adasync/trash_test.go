@@ -0,0 +1,123 @@
+package adasync
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExpiredTrash(t *testing.T) {
+	t0 := time.Date(2020, 1, 31, 0, 0, 0, 0, time.UTC)
+	entries := []*TrashEntry{
+		{Deleted: t0.AddDate(0, 0, -20), Size: 100},
+		{Deleted: t0.AddDate(0, 0, -5), Size: 200},
+		{Deleted: t0.AddDate(0, 0, -1), Size: 300},
+	}
+	tests := []struct {
+		days     int
+		maxBytes int64
+		expect   int
+	}{
+		{days: 0, maxBytes: 0, expect: 0},
+		{days: 30, maxBytes: 0, expect: 0},
+		{days: 10, maxBytes: 0, expect: 1},
+		{days: 2, maxBytes: 0, expect: 2},
+		{days: 0, maxBytes: 500, expect: 1},
+		{days: 0, maxBytes: 300, expect: 2},
+		{days: 0, maxBytes: 250, expect: 3},
+		{days: 10, maxBytes: 300, expect: 2},
+	}
+	for _, test := range tests {
+		got := expiredTrash(entries, t0, test.days, test.maxBytes)
+		if len(got) != test.expect {
+			t.Error("Expected: ", test.expect, " Got: ", len(got), " for ", test.days, test.maxBytes)
+		}
+		for i, entry := range got {
+			if entry != entries[i] {
+				t.Error("Expected oldest entries to expire first")
+			}
+		}
+	}
+}
+
+func TestTrashName(t *testing.T) {
+	id := HashFromBytes([]byte{251, 255, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	if name := trashName(id); name != "-_8DBAUGBwgJCgsMDQ4PEA==" {
+		t.Error("Incorrect trash name: " + name)
+	}
+}
+
+func TestTrashRestore(t *testing.T) {
+	tmp := tempInstanceDir(t, "/a/music", "/b")
+	ioutil.WriteFile(tmp+"/a/music/song.mp3", []byte("song"), 0600)
+	a, e := Init(tmp+"/a", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, e := Init(tmp+"/b", a.CollectionId())
+	if e != nil {
+		t.Fatal(e)
+	}
+	SyncInstances(a, b)
+	song := b.Lookup("/music/song.mp3")
+	if song == nil {
+		t.Fatal("Expected song to be sync'd")
+	}
+
+	// the delete on a is a DeleteRes on b, it goes to b's trash
+	os.Remove(tmp + "/a/music/song.mp3")
+	SyncInstances(a, b)
+	if !song.PathNodes.Last().IsDeleted() {
+		t.Error("Expected song to be deleted in the state")
+	}
+	if _, e := os.Stat(tmp + "/b/music/song.mp3"); !os.IsNotExist(e) {
+		t.Error("Expected song to be moved out of place")
+	}
+	if buf, e := ioutil.ReadFile(b.trashPath(song.ID)); e != nil || string(buf) != "song" {
+		t.Error("Expected song in the trash: ", e)
+	}
+	if trash := b.Trash(); len(trash) != 1 || !trash[0].ID.Equal(song.ID) {
+		t.Error("Expected a trash entry for song")
+	}
+
+	l := song.PathNodes.Len()
+	if e := b.Restore(song.ID); e != nil {
+		t.Fatal(e)
+	}
+	if buf, e := ioutil.ReadFile(tmp + "/b/music/song.mp3"); e != nil || string(buf) != "song" {
+		t.Error("Expected song to be put back")
+	}
+	pn := song.PathNodes.Last()
+	if song.PathNodes.Len() != l+1 || pn.IsDeleted() || pn.Name != "song.mp3" || pn.Parent().PathNodes.Last().Name != "music/" {
+		t.Error("Expected the restore to be a new location in the history")
+	}
+	if changedBy(song.PathNodes.nodes[l-1].Clock, pn.Clock) != b.id.String() {
+		t.Error("Expected the restore to be by b")
+	}
+	if len(b.Trash()) != 0 {
+		t.Error("Expected the trash entry to be removed")
+	}
+
+	// the restore spreads like a move
+	SyncInstances(a, b)
+	if buf, e := ioutil.ReadFile(tmp + "/a/music/song.mp3"); e != nil || string(buf) != "song" {
+		t.Error("Expected the restore to be sync'd")
+	}
+	if res := a.Lookup("/music/song.mp3"); res == nil || !res.ID.Equal(song.ID) || res.PathNodes.Len() != song.PathNodes.Len() {
+		t.Error("Expected the same history on a")
+	}
+
+	os.Remove(tmp + "/a/music/song.mp3")
+	SyncInstances(a, b)
+	b.PurgeTrash()
+	if _, e := os.Stat(b.trashPath(song.ID)); e != nil {
+		t.Error("Expected a new deletion to be kept: ", e)
+	}
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Now().AddDate(0, 0, 31) }
+	b.PurgeTrash()
+	if _, e := os.Stat(b.trashPath(song.ID)); !os.IsNotExist(e) || len(b.Trash()) != 0 {
+		t.Error("Expected old deletions to be emptied from the trash")
+	}
+}
@@ -0,0 +1,412 @@
+package adasync
+
+import (
+	"context"
+	"github.com/adamcolton/err"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of FileEvent
+const (
+	EventWrite = iota
+	EventRemove
+	EventRename
+	EventOverflow // events were dropped
+)
+
+// FileEvent is a change a watcher saw inside an instance. Paths are relative
+// to the root of the instance, like "/a/b.txt", and directories end with a
+// slash. A directory that's created is a write. Renames into the instance
+// from outside it are writes and renames out of it are removes.
+type FileEvent struct {
+	Kind int
+	Path string
+	From string // only for EventRename
+}
+
+// ApplyEvents updates the instance in memory from a batch of events without
+// walking it and returns false if nothing changed. Anything that can't be
+// resolved from the events, like a file in a directory that was never seen,
+// falls back to a SelfUpdate.
+func (ins *Instance) ApplyEvents(events []*FileEvent) bool {
+	u := &liveUpdate{ins: ins}
+	for _, ev := range events {
+		switch ev.Kind {
+		case EventWrite:
+			u.write(ev.Path)
+		case EventRemove:
+			u.remove(ev.Path)
+		case EventRename:
+			u.rename(ev.From, ev.Path)
+		case EventOverflow:
+			u.missed = true
+		}
+	}
+	if u.missed {
+		err.Debug("Could not apply events to ", ins.pathStr)
+		ins.SelfUpdate()
+		return true
+	}
+	return u.changed
+}
+
+type liveUpdate struct {
+	ins     *Instance
+	dirs    map[string]*Directory // relative path -> live directory
+	files   map[string]*Resource  // relative path -> live resource
+	missed  bool
+	changed bool
+}
+
+func (u *liveUpdate) touch() {
+	u.ins.dirty = true
+	u.changed = true
+}
+
+// ignoreEvent is true for anything a self scan would skip.
+func ignoreEvent(relPath string) bool {
+	_, name := split(relPath)
+	return relPath == "" || strings.HasPrefix(relPath, trashDir) || endsWith(strings.TrimSuffix(name, "/"), ".collection")
+}
+
+// dir finds the live directory at relPath. The directory maps can be out of
+// date after a sync, so like files, directories are indexed by where they
+// are now. The indexes are built the first time they're needed and dropped
+// whenever a directory moves.
+func (u *liveUpdate) dir(relPath string) *Directory {
+	if u.dirs == nil {
+		u.dirs = make(map[string]*Directory)
+		for _, dir := range u.ins.directories {
+			if pn := dir.PathNodes.Last(); !pn.IsDeleted() {
+				path := pn.RelativePath()
+				u.dirs[path.relDir+path.name] = dir
+			}
+		}
+	}
+	return u.dirs[relPath]
+}
+
+// file finds the live resource at relPath.
+func (u *liveUpdate) file(relPath string) *Resource {
+	if u.files == nil {
+		u.files = make(map[string]*Resource)
+		for _, res := range u.ins.resources {
+			if pn := res.PathNodes.Last(); !pn.IsDeleted() {
+				path := pn.RelativePath()
+				u.files[path.relDir+path.name] = res
+			}
+		}
+	}
+	return u.files[relPath]
+}
+
+// moved drops the indexes after a directory moves or is removed, everything
+// under it has a new path.
+func (u *liveUpdate) moved() {
+	u.dirs = nil
+	u.files = nil
+}
+
+func (u *liveUpdate) deleteRes(res *Resource) {
+	u.touch()
+	res.PathNodes.Record(u.ins.PathNodeFromHash(nil, ".deleted"))
+}
+
+func (u *liveUpdate) write(relPath string) {
+	if ignoreEvent(relPath) {
+		return
+	}
+	pathStr := u.ins.pathStr + relPath
+	stat, e := filesystem.Stat(pathStr)
+	if e != nil {
+		// it's already gone again, the remove will be in this batch or the next
+		return
+	}
+	if stat.IsDir() {
+		relPath = endingSlash(relPath)
+		pathStr = endingSlash(pathStr)
+	}
+	relDir, name := split(relPath)
+	parent := u.dir(relDir)
+	if parent == nil {
+		u.missed = true
+		return
+	}
+	path := PathFromString(pathStr, u.ins.pathStr)
+
+	if stat.IsDir() {
+		if u.dir(relPath) == nil {
+			err.Debug("Added: ", pathStr)
+			u.touch()
+			hash, _, _ := path.Stat()
+			u.dirs[relPath] = u.ins.AddDirectory(hash, parent, name)
+		}
+		// a directory that was moved in or created with mkdir -p may already
+		// have things in it
+		if f, e := filesystem.Open(pathStr); err.Log(e) {
+			fis, e := f.Readdir(-1)
+			f.Close()
+			err.Log(e)
+			for _, fi := range fis {
+				u.write(relPath + fi.Name())
+			}
+		}
+		return
+	}
+
+	if res := u.file(relPath); res != nil {
+		if u.ins.pathEqualsResource(res, pathStr) {
+			return
+		}
+		u.deleteRes(res)
+	}
+	err.Debug("Added: ", pathStr)
+	u.touch()
+	hash, _, size, sigs := path.stat(u.ins.cachesSigs())
+	res := u.ins.AddResource(hash, size, parent, name)
+	res.sigs = sigs
+	u.files[relPath] = res
+}
+
+func (u *liveUpdate) remove(relPath string) {
+	if ignoreEvent(relPath) {
+		return
+	}
+	if dir := u.dir(endingSlash(relPath)); dir != nil && dir != u.ins.root {
+		u.removeDir(dir)
+		u.moved()
+	} else if res := u.file(relPath); res != nil {
+		err.Debug("Removed: ", res.FullPath())
+		u.deleteRes(res)
+		delete(u.files, relPath)
+	}
+}
+
+// removeDir deletes a directory and anything still in it.
+func (u *liveUpdate) removeDir(dir *Directory) {
+	err.Debug("Removed: ", dir.FullPath())
+	for _, child := range u.ins.directories {
+		if child.PathNodes.Last().Parent() == dir {
+			u.removeDir(child)
+		}
+	}
+	for _, res := range u.ins.resources {
+		if pn := res.PathNodes.Last(); pn.Parent() == dir {
+			u.deleteRes(res)
+		}
+	}
+	unlinkDir(dir)
+	u.deleteRes(dir.Resource)
+}
+
+// unlinkDir takes a directory out of it's parent's map before it moves.
+func unlinkDir(dir *Directory) {
+	pn := dir.PathNodes.Last()
+	if parent := pn.Parent(); parent != nil && parent.directories[pn.Name] == dir {
+		delete(parent.directories, pn.Name)
+	}
+}
+
+func (u *liveUpdate) rename(from, to string) {
+	switch {
+	case ignoreEvent(from):
+		u.write(to)
+		return
+	case ignoreEvent(to):
+		u.remove(from)
+		return
+	}
+	if dir := u.dir(endingSlash(from)); dir != nil && dir != u.ins.root {
+		to = endingSlash(to)
+		relDir, name := split(to)
+		parent := u.dir(relDir)
+		if parent == nil {
+			u.missed = true
+			return
+		}
+		if old := u.dir(to); old != nil {
+			u.removeDir(old)
+			u.moved()
+		}
+		err.Debug("Moved: ", dir.FullPath())
+		err.Debug("To: ", u.ins.pathStr+to)
+		u.touch()
+		unlinkDir(dir)
+		dir.PathNodes.Record(u.ins.PathNode(parent, name))
+		parent.directories[name] = dir
+		u.moved()
+		return
+	}
+	res := u.file(from)
+	if res == nil {
+		u.write(to)
+		return
+	}
+	relDir, name := split(to)
+	parent := u.dir(relDir)
+	if parent == nil {
+		u.missed = true
+		return
+	}
+	if old := u.file(to); old != nil {
+		u.deleteRes(old)
+	}
+	err.Debug("Moved: ", res.FullPath())
+	err.Debug("To: ", u.ins.pathStr+to)
+	u.touch()
+	res.PathNodes.Record(u.ins.PathNode(parent, name))
+	delete(u.files, from)
+	u.files[to] = res
+}
+
+// eventBatch collects events until there haven't been any for quiet, or
+// they've been collecting for max, so a burst of writes turns into one
+// update.
+type eventBatch struct {
+	quiet, max  time.Duration
+	events      []*FileEvent
+	first, last time.Time
+}
+
+func (b *eventBatch) add(t time.Time, events ...*FileEvent) {
+	if len(b.events) == 0 {
+		b.first = t
+	}
+	b.last = t
+	b.events = append(b.events, events...)
+}
+
+// due is how long until the batch should be flushed. It's only meaningful if
+// there are events.
+func (b *eventBatch) due(t time.Time) time.Duration {
+	d := b.last.Add(b.quiet)
+	if max := b.first.Add(b.max); max.Before(d) {
+		d = max
+	}
+	return d.Sub(t)
+}
+
+func (b *eventBatch) take() []*FileEvent {
+	events := b.events
+	b.events = nil
+	return events
+}
+
+// liveDirs is the full path of every directory in the instance that hasn't
+// been deleted.
+func (ins *Instance) liveDirs() []string {
+	var dirs []string
+	for _, dir := range ins.directories {
+		if !dir.PathNodes.Last().IsDeleted() {
+			dirs = append(dirs, dir.FullPath())
+		}
+	}
+	return dirs
+}
+
+// Watchers keeps track of which instances are being watched. Jobs for the
+// same instance are coalesced, so events wait in pending until the job runs.
+type Watchers struct {
+	mux     sync.Mutex
+	d       *Daemon
+	running map[*Instance]bool
+	pending map[*Instance][]*FileEvent
+}
+
+func NewWatchers(d *Daemon) *Watchers {
+	return &Watchers{
+		d:       d,
+		running: make(map[*Instance]bool),
+		pending: make(map[*Instance][]*FileEvent),
+	}
+}
+
+func (w *Watchers) watching(ins *Instance) bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.running[ins]
+}
+
+// WatchAll starts watching every open local instance that isn't already
+// watched and doesn't have "watch" set to false. The watchers keep running
+// until ctx is done.
+func (w *Watchers) WatchAll(ctx context.Context) {
+	for _, c := range sortedCollections() {
+		for _, ins := range c.sortedInstances() {
+			if ins.GetSetting("watch") == "false" || IsRemote(ins.pathStr) || ins.isObjectStore() || isEncrypted(ins.pathStr) {
+				continue
+			}
+			w.mux.Lock()
+			start := !w.running[ins]
+			w.running[ins] = true
+			w.mux.Unlock()
+			if start {
+				go func(ins *Instance, dirs []string) {
+					watchInstance(ctx, ins.pathStr, dirs, func(events []*FileEvent) {
+						w.flush(ins, events)
+					})
+					w.mux.Lock()
+					delete(w.running, ins)
+					w.mux.Unlock()
+				}(ins, ins.liveDirs())
+			}
+		}
+	}
+}
+
+// flush is called by the watcher with each batch. The events are applied and
+// synced by a job, so they never run at the same time as anything else.
+func (w *Watchers) flush(ins *Instance, events []*FileEvent) {
+	w.mux.Lock()
+	w.pending[ins] = append(w.pending[ins], events...)
+	w.mux.Unlock()
+	w.d.Add(&Job{
+		Name: "watch " + ins.pathStr,
+		Run: func(ctx context.Context) {
+			w.mux.Lock()
+			events := w.pending[ins]
+			delete(w.pending, ins)
+			w.mux.Unlock()
+			// a sync causes events on the other side, but they won't change
+			// anything so they end here
+			if len(events) > 0 && ins.Online() && ins.ApplyEvents(events) {
+				w.syncPeers(ctx, ins)
+			}
+		},
+	})
+}
+
+// applyPending applies the events that are waiting for ins's job, so they're
+// in the state before it's sync'd. The job will find nothing left to do.
+func (w *Watchers) applyPending(ins *Instance) {
+	w.mux.Lock()
+	events := w.pending[ins]
+	delete(w.pending, ins)
+	w.mux.Unlock()
+	if len(events) > 0 && ins.Online() {
+		ins.ApplyEvents(events)
+	}
+}
+
+// syncPeers is SyncInstance without the walks. Peers that are watched only
+// need the events that haven't been applied yet, the rest need a SelfUpdate.
+func (w *Watchers) syncPeers(ctx context.Context, ins *Instance) {
+	for _, peer := range ins.collection.sortedInstances() {
+		if peer == ins || ctx.Err() != nil {
+			continue
+		}
+		if w.watching(peer) {
+			w.applyPending(peer)
+		} else {
+			peer.SelfUpdate()
+		}
+		syncPair(ctx, ins, peer)
+	}
+	ins.collection.checkpoint()
+	for _, peer := range ins.collection.instances {
+		peer.maintain()
+		peer.Write()
+	}
+}
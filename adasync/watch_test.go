@@ -0,0 +1,131 @@
+package adasync
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestApplyEventsMoves(t *testing.T) {
+	c := New()
+	ins := c.AddInstance("/a")
+	music := ins.AddDirectory(&Hash{}, ins.root, "music/")
+	rock := ins.AddDirectory(&Hash{1}, music, "rock/")
+	song := ins.AddResource(&Hash{2}, 100, rock, "song.mp3")
+	other := ins.AddResource(&Hash{3}, 100, music, "other.mp3")
+	keep := ins.AddResource(&Hash{4}, 100, ins.root, "keep.txt")
+
+	changed := ins.ApplyEvents([]*FileEvent{
+		{Kind: EventRename, From: "/music/rock/", Path: "/rock/"},
+		{Kind: EventRename, From: "/music/other.mp3", Path: "/rock/other.mp3"},
+		{Kind: EventRename, From: "/keep.txt", Path: "/.trash.collection/abc"},
+	})
+	if p := song.RelativePath().String(); p != "/rock/song.mp3" {
+		t.Error("Incorrect path after directory move: " + p)
+	}
+	if p := other.RelativePath().String(); p != "/rock/other.mp3" {
+		t.Error("Incorrect path after move: " + p)
+	}
+	if !keep.PathNodes.Last().IsDeleted() {
+		t.Error("Moving into the trash should delete")
+	}
+	if _, ok := music.directories["rock/"]; ok || ins.root.directories["rock/"] != rock {
+		t.Error("Directory should have moved in the tree")
+	}
+	if !changed || !ins.dirty {
+		t.Error("Instance should be dirty")
+	}
+
+	// a sync can leave the old entry behind, events for it are ignored
+	music.directories["rock/"] = rock
+	if ins.ApplyEvents([]*FileEvent{{Kind: EventRemove, Path: "/music/rock/"}}) || rock.PathNodes.Last().IsDeleted() {
+		t.Error("Should not find directory at old location")
+	}
+
+	ins.ApplyEvents([]*FileEvent{
+		{Kind: EventRemove, Path: "/rock/"},
+	})
+	if !rock.PathNodes.Last().IsDeleted() || !song.PathNodes.Last().IsDeleted() || !other.PathNodes.Last().IsDeleted() {
+		t.Error("Removing a directory should delete everything in it")
+	}
+	if music.PathNodes.Last().IsDeleted() {
+		t.Error("Should not delete other directories")
+	}
+}
+
+func TestApplyEventsWrite(t *testing.T) {
+	pathStr := tempInstanceDir(t, "/music/rock")
+	ioutil.WriteFile(pathStr+"/music/rock/song.mp3", []byte("song"), 0600)
+	ioutil.WriteFile(pathStr+"/notes.collection", []byte("skip"), 0600)
+
+	c := New()
+	ins := c.AddInstance(pathStr)
+	ins.ApplyEvents([]*FileEvent{
+		{Kind: EventWrite, Path: "/music/"},
+		{Kind: EventWrite, Path: "/notes.collection"},
+		{Kind: EventWrite, Path: "/gone.txt"},
+	})
+	if len(ins.directories) != 3 || len(ins.resources) != 1 {
+		t.Fatal("Expected the new directory and everything in it")
+	}
+	u := &liveUpdate{ins: ins}
+	res := u.file("/music/rock/song.mp3")
+	if res == nil || res.Size != 4 {
+		t.Fatal("Expected to find song")
+	}
+
+	// with the default settings a write to a known file doesn't change it
+	ioutil.WriteFile(pathStr+"/music/rock/song.mp3", []byte("longer song"), 0600)
+	ins.ApplyEvents([]*FileEvent{{Kind: EventWrite, Path: "/music/rock/song.mp3"}})
+	if len(ins.resources) != 1 {
+		t.Error("Static file should not change")
+	}
+	ins.settings["static"] = "false"
+	ins.ApplyEvents([]*FileEvent{{Kind: EventWrite, Path: "/music/rock/song.mp3"}})
+	u = &liveUpdate{ins: ins}
+	if !res.PathNodes.Last().IsDeleted() || u.file("/music/rock/song.mp3").Size != 11 {
+		t.Error("Changed file should replace the old resource")
+	}
+}
+
+func TestEventBatch(t *testing.T) {
+	start := time.Now()
+	b := &eventBatch{quiet: time.Second, max: 3 * time.Second}
+	b.add(start, &FileEvent{})
+	if d := b.due(start); d != time.Second {
+		t.Error("Incorrect due: ", d)
+	}
+	b.add(start.Add(2500*time.Millisecond), &FileEvent{})
+	if d := b.due(start.Add(2500 * time.Millisecond)); d != 500*time.Millisecond {
+		t.Error("Should not wait past max: ", d)
+	}
+	if events := b.take(); len(events) != 2 || len(b.events) != 0 {
+		t.Error("Incorrect take")
+	}
+}
+
+func TestSyncPeersAppliesPending(t *testing.T) {
+	tmp := tempInstanceDir(t, "/a", "/b")
+	aStr, bStr := tmp+"/a", tmp+"/b"
+
+	c := New()
+	a := c.AddInstance(aStr)
+	b := c.AddInstance(bStr)
+	a.SelfUpdate()
+	b.SelfUpdate()
+
+	// b is watched, but it's job hasn't run yet
+	ioutil.WriteFile(bStr+"/song.mp3", []byte("song"), 0600)
+	w := NewWatchers(nil)
+	w.running[b] = true
+	w.pending[b] = []*FileEvent{{Kind: EventWrite, Path: "/song.mp3"}}
+
+	w.syncPeers(context.Background(), a)
+	if data, e := ioutil.ReadFile(aStr + "/song.mp3"); e != nil || string(data) != "song" {
+		t.Error("Pending change should have been sync'd")
+	}
+	if len(w.pending[b]) != 0 {
+		t.Error("Pending events should have been applied")
+	}
+}
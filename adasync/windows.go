@@ -2,6 +2,10 @@
 
 package adasync
 
+import (
+	"context"
+)
+
 /*
 TODO: option to only scan new drives
 */
@@ -53,3 +57,10 @@ func detectDrives() ([]string, []string) {
 	drives = drvs
 	return newDrives, missingDrives
 }
+
+// watchMounts only works on linux, elsewhere the scan job finds new drives
+func watchMounts(ctx context.Context, d *Daemon) {}
+
+// watchInstance only works on linux, elsewhere changes are found by the
+// shallow check
+func watchInstance(ctx context.Context, root string, dirs []string, flush func([]*FileEvent)) {}
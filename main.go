@@ -1,72 +1,612 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"github.com/adamcolton/adasync/adasync"
 	"github.com/adamcolton/err"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
 )
 
-type Runable interface {
-	Run()
-}
+/*
+adasync <command> [flags] [args]
 
-type FullScan struct{}
+Every command takes the same flags:
+  -config     global config file, defaults to config.txt in the working dir
+  -log-level  "debug" or "none"
+  -log        file to log to, defaults to stderr
+  -format     "text" or "json"
+*/
 
-func (_ FullScan) Run() {
-	err.Debug("-- Starting Full Scan --")
-	collection.FullScan()
+type command struct {
+	args  string
+	about string
+	run   func(ctx *env, args []string) int
 }
 
-type QuickScan struct{}
+var commands = map[string]*command{
+	"init":    {"<path>", "Make path an instance, use -collection to join an existing collection", runInit},
+	"scan":    {"[path...]", "Find instances and record changes made to them, use -deep to read every directory", runScan},
+	"status":  {"[path...]", "Show what each pair of instances needs to sync", runStatus},
+	"sync":    {"<path> <path>", "Sync two instances", runSync},
+	"plan":    {"<path> <path>", "Show what syncing two instances would do", runPlan},
+	"fsck":    {"[path...]", "Check instance state against the files on disk", runFsck},
+	"history": {"<file>", "Show where a file has been", runHistory},
+	"restore": {"<path> [id...]", "List the trash, or restore resources from it", runRestore},
+	"daemon":  {"", "Keep scanning and syncing", runDaemon},
+	"key":     {"", "Show the key peers trust this daemon by", runKey},
+}
 
-func (_ QuickScan) Run() {
-	err.Debug("-- Checking for New Drives --")
-	collection.QuickScan()
+type env struct {
+	flags      *flag.FlagSet
+	config     string
+	logLevel   string
+	logFile    string
+	format     string
+	collection string
+	objects    bool
+	encrypt    bool
+	deep       bool
+	out        io.Writer
 }
 
-type SyncAll struct{}
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	ctx := &env{
+		flags: flag.NewFlagSet(name, flag.ExitOnError),
+		out:   os.Stdout,
+	}
+	ctx.flags.StringVar(&ctx.config, "config", "config.txt", "global config file")
+	ctx.flags.StringVar(&ctx.logLevel, "log-level", "none", "debug or none")
+	ctx.flags.StringVar(&ctx.logFile, "log", "", "file to log to, defaults to stderr")
+	ctx.flags.StringVar(&ctx.format, "format", "text", "text or json")
+	switch name {
+	case "init":
+		ctx.flags.StringVar(&ctx.collection, "collection", "", "id of the collection to join")
+		ctx.flags.BoolVar(&ctx.objects, "objects", false, "keep files by their hash instead of their path")
+		ctx.flags.BoolVar(&ctx.encrypt, "encrypt", false, "encrypt names and contents with the collection's key")
+	case "scan":
+		ctx.flags.BoolVar(&ctx.deep, "deep", false, "read every directory, even if it looks unchanged")
+	case "daemon":
+		ctx.logLevel = "debug"
+		ctx.logFile = "log.txt"
+		ctx.flags.Lookup("log-level").DefValue = ctx.logLevel
+		ctx.flags.Lookup("log").DefValue = ctx.logFile
+	}
+	ctx.flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: adasync %s [flags] %s\n", name, cmd.args)
+		ctx.flags.PrintDefaults()
+	}
+	ctx.flags.Parse(os.Args[2:])
+	if e := ctx.setup(); e != nil {
+		fmt.Fprintln(os.Stderr, e)
+		os.Exit(2)
+	}
+	os.Exit(cmd.run(ctx, ctx.flags.Args()))
+}
 
-func (_ SyncAll) Run() {
-	err.Debug("-- Running Sync --")
-	collection.SyncAll()
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: adasync <command> [flags] [args]")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %-15s %s\n", name, commands[name].args, commands[name].about)
+	}
 }
 
-func main() {
-	out, _ := os.Create("log.txt")
-	err.DebugOut = out
+// setup applies the flags shared by every command
+func (ctx *env) setup() error {
+	switch ctx.format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown format: %s", ctx.format)
+	}
+	switch ctx.logLevel {
+	case "none":
+		err.DebugOut = ioutil.Discard
+	case "debug":
+		err.DebugOut = os.Stderr
+		if ctx.logFile != "" {
+			out, e := os.Create(ctx.logFile)
+			if e != nil {
+				return e
+			}
+			err.DebugOut = out
+		}
+	default:
+		return fmt.Errorf("unknown log level: %s", ctx.logLevel)
+	}
 	err.Debug("Started")
-	path, e := filepath.Abs("./")
-	err.Panic(e)
-	path = filepath.ToSlash(path)
-	settings, _ := collection.LoadConfig(path + "config.txt")
+	settings, _ := adasync.LoadConfig(ctx.config)
+	for key, val := range settings {
+		adasync.Settings[key] = val
+	}
 	if ignore, ok := settings["ignore"]; ok {
-		collection.Settings["ignore"] = ignore
 		err.Debug("Ignoring: ", ignore)
 	} else {
-		collection.Settings["ignore"] = collection.DefaultIgnore
+		adasync.Settings["ignore"] = adasync.DefaultIgnore
 		err.Debug("No ignore setting - using defaults")
 	}
-	runChan := make(chan Runable, 100)
-	go func(runChan <-chan Runable) {
-		for {
-			run := <-runChan
-			run.Run()
+	return nil
+}
+
+// print writes v as JSON or calls text to write it for people
+func (ctx *env) print(v interface{}, text func(w io.Writer)) {
+	if ctx.format == "json" {
+		enc := json.NewEncoder(ctx.out)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return
+	}
+	text(ctx.out)
+}
+
+func (ctx *env) fail(e error) int {
+	fmt.Fprintln(os.Stderr, e)
+	return 1
+}
+
+func absPath(pathStr string) string {
+	if adasync.IsRemote(pathStr) {
+		return strings.TrimSuffix(pathStr, "/")
+	}
+	abs, e := filepath.Abs(pathStr)
+	err.Panic(e)
+	return filepath.ToSlash(abs)
+}
+
+// openAll opens every instance under paths, or under the default scan paths
+// if none are given.
+func openAll(paths []string) ([]*adasync.Instance, error) {
+	if len(paths) == 0 {
+		paths = adasync.DefaultScanPaths()
+	}
+	// remote paths aren't searched, they have to be the root of an instance
+	var local, found []string
+	for _, pathStr := range paths {
+		if adasync.IsRemote(pathStr) {
+			found = append(found, absPath(pathStr))
+		} else {
+			local = append(local, absPath(pathStr))
+		}
+	}
+	if len(local) > 0 {
+		found = append(found, adasync.Scan(local).Slice()...)
+	}
+	sort.Strings(found)
+	inss := make([]*adasync.Instance, 0, len(found))
+	for _, pathStr := range found {
+		err.Debug("Found: ", pathStr)
+		ins, e := adasync.Open(pathStr)
+		if e != nil {
+			return nil, fmt.Errorf("%s: %s", pathStr, e)
 		}
-	}(runChan)
+		inss = append(inss, ins)
+	}
+	return inss, nil
+}
 
-	go func() {
-		for {
-			time.Sleep(time.Minute * 5)
-			runChan <- QuickScan{}
-			runChan <- SyncAll{}
+type instanceInfo struct {
+	Path       string    `json:"path"`
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Collection string    `json:"collection"`
+	LastSync   time.Time `json:"lastSync,omitempty"`
+}
+
+func infoFor(ins *adasync.Instance) *instanceInfo {
+	info := ins.Info()
+	return &instanceInfo{
+		Path:       ins.Path(),
+		ID:         ins.UUID(),
+		Name:       ins.Name(),
+		Collection: ins.CollectionId(),
+		LastSync:   info.LastSync,
+	}
+}
+
+func runInit(ctx *env, args []string) int {
+	if len(args) != 1 {
+		ctx.flags.Usage()
+		return 2
+	}
+	create := adasync.Init
+	if ctx.objects && ctx.encrypt {
+		return ctx.fail(fmt.Errorf("-objects and -encrypt can't be used together"))
+	} else if ctx.objects {
+		create = adasync.InitObjectStore
+	} else if ctx.encrypt {
+		create = adasync.InitEncrypted
+	}
+	ins, e := create(absPath(args[0]), ctx.collection)
+	if e != nil {
+		return ctx.fail(e)
+	}
+	info := infoFor(ins)
+	ctx.print(info, func(w io.Writer) {
+		fmt.Fprintf(w, "%s\n  instance:   %s\n  collection: %s\n", info.Path, info.ID, info.Collection)
+	})
+	return 0
+}
+
+func runScan(ctx *env, args []string) int {
+	inss, e := openAll(args)
+	if e != nil {
+		return ctx.fail(e)
+	}
+	infos := make([]*instanceInfo, len(inss))
+	for i, ins := range inss {
+		if ctx.deep {
+			ins.DeepSelfUpdate()
+		} else {
+			ins.SelfUpdate()
+		}
+		ins.Write()
+		infos[i] = infoFor(ins)
+	}
+	ctx.print(infos, func(w io.Writer) {
+		for _, info := range infos {
+			fmt.Fprintln(w, info.Path)
+		}
+	})
+	return 0
+}
+
+type pairInfo struct {
+	A        string `json:"a"`
+	B        string `json:"b"`
+	Added    int    `json:"added"`
+	Modified int    `json:"modified"`
+	Moved    int    `json:"moved"`
+	Deleted  int    `json:"deleted"`
+	Bytes    int64  `json:"bytes"`
+	InSync   bool   `json:"inSync"`
+}
+
+type statusInfo struct {
+	Instances []*instanceInfo `json:"instances"`
+	Pairs     []*pairInfo     `json:"pairs"`
+}
+
+func printInstance(w io.Writer, info *instanceInfo) {
+	lastSync := "never synced"
+	if !info.LastSync.IsZero() {
+		lastSync = "synced " + info.LastSync.Format(time.RFC3339)
+	}
+	name := info.Name
+	if name != info.Path {
+		name += " (" + info.Path + ")"
+	}
+	fmt.Fprintf(w, "  %s %s\n", name, lastSync)
+}
+
+// runStatus exits with 1 if any pair of instances is out of sync
+func runStatus(ctx *env, args []string) int {
+	inss, e := openAll(args)
+	if e != nil {
+		return ctx.fail(e)
+	}
+	status := &statusInfo{}
+	for _, ins := range inss {
+		status.Instances = append(status.Instances, infoFor(ins))
+	}
+	code := 0
+	for _, ps := range adasync.Status() {
+		status.Pairs = append(status.Pairs, &pairInfo{
+			A:        ps.A.Name(),
+			B:        ps.B.Name(),
+			Added:    ps.Added,
+			Modified: ps.Modified,
+			Moved:    ps.Moved,
+			Deleted:  ps.Deleted,
+			Bytes:    ps.Bytes,
+			InSync:   ps.InSync(),
+		})
+		if !ps.InSync() {
+			code = 1
+		}
+	}
+	ctx.print(status, func(w io.Writer) {
+		byCollection := make(map[string][]*instanceInfo)
+		var ids []string
+		for _, info := range status.Instances {
+			if _, ok := byCollection[info.Collection]; !ok {
+				ids = append(ids, info.Collection)
+			}
+			byCollection[info.Collection] = append(byCollection[info.Collection], info)
+		}
+		for _, id := range ids {
+			fmt.Fprintln(w, "collection", id)
+			for _, info := range byCollection[id] {
+				printInstance(w, info)
+			}
 		}
+		for _, pair := range status.Pairs {
+			if pair.InSync {
+				fmt.Fprintf(w, "%s <-> %s: in sync\n", pair.A, pair.B)
+				continue
+			}
+			fmt.Fprintf(w, "%s <-> %s: %d added, %d modified, %d moved, %d deleted, %d bytes to copy\n",
+				pair.A, pair.B, pair.Added, pair.Modified, pair.Moved, pair.Deleted, pair.Bytes)
+		}
+	})
+	return code
+}
+
+// openPair opens the two instances given as arguments
+func openPair(ctx *env, args []string) (*adasync.Instance, *adasync.Instance, int) {
+	if len(args) != 2 {
+		ctx.flags.Usage()
+		return nil, nil, 2
+	}
+	a, e := adasync.Open(absPath(args[0]))
+	if e != nil {
+		return nil, nil, ctx.fail(e)
+	}
+	b, e := adasync.Open(absPath(args[1]))
+	if e != nil {
+		return nil, nil, ctx.fail(e)
+	}
+	return a, b, 0
+}
+
+func runSync(ctx *env, args []string) int {
+	if len(args) == 2 && adasync.IsPeer(args[1]) {
+		a, e := adasync.Open(absPath(args[0]))
+		if e != nil {
+			return ctx.fail(e)
+		}
+		if e := adasync.PullPeer(context.Background(), a, args[1]); e != nil {
+			return ctx.fail(e)
+		}
+		adasync.CloseTransports()
+		return 0
+	}
+	a, b, code := openPair(ctx, args)
+	if a == nil {
+		return code
+	}
+	if e := adasync.SyncInstances(a, b); e != nil {
+		return ctx.fail(e)
+	}
+	return 0
+}
+
+func runPlan(ctx *env, args []string) int {
+	a, b, code := openPair(ctx, args)
+	if a == nil {
+		return code
+	}
+	plan, e := adasync.PlanSync(a, b)
+	if e != nil {
+		return ctx.fail(e)
+	}
+	ctx.print(plan, func(w io.Writer) {
+		if len(plan) == 0 {
+			fmt.Fprintln(w, "Nothing to do")
+		}
+		for _, action := range plan {
+			fmt.Fprintln(w, action)
+		}
+	})
+	return 0
+}
+
+func runFsck(ctx *env, args []string) int {
+	inss, e := openAll(args)
+	if e != nil {
+		return ctx.fail(e)
+	}
+	problems := make(map[string][]string)
+	code := 0
+	for _, ins := range inss {
+		if p := ins.Fsck(); len(p) > 0 {
+			problems[ins.Path()] = p
+			code = 1
+		}
+	}
+	ctx.print(problems, func(w io.Writer) {
+		for _, ins := range inss {
+			if p, ok := problems[ins.Path()]; ok {
+				fmt.Fprintln(w, ins.Path())
+				for _, problem := range p {
+					fmt.Fprintln(w, "  "+problem)
+				}
+			}
+		}
+	})
+	return code
+}
+
+// openContaining opens the instance that pathStr is in and returns the path
+// relative to it's root.
+func openContaining(pathStr string) (*adasync.Instance, string, error) {
+	if adasync.IsRemote(pathStr) {
+		return nil, "", fmt.Errorf("%s: only local paths are supported", pathStr)
+	}
+	pathStr = absPath(pathStr)
+	for dir := filepath.Dir(pathStr); ; dir = filepath.Dir(dir) {
+		if adasync.IsInstanceRoot(dir) {
+			ins, e := adasync.Open(dir)
+			return ins, strings.TrimPrefix(pathStr, strings.TrimSuffix(dir, "/")), e
+		}
+		if next := filepath.Dir(dir); next == dir {
+			return nil, "", fmt.Errorf("%s is not in an instance", pathStr)
+		}
+	}
+}
+
+type eventInfo struct {
+	Kind      string `json:"kind"`
+	Path      string `json:"path"`
+	Directory string `json:"directory,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Device    string `json:"device,omitempty"`
+}
+
+type historyInfo struct {
+	ID        string       `json:"id"`
+	Path      string       `json:"path"`
+	Deleted   bool         `json:"deleted"`
+	Compacted int          `json:"compacted,omitempty"`
+	Events    []*eventInfo `json:"events"`
+}
+
+func runHistory(ctx *env, args []string) int {
+	if len(args) != 1 {
+		ctx.flags.Usage()
+		return 2
+	}
+	ins, relPath, e := openContaining(args[0])
+	if e != nil {
+		return ctx.fail(e)
+	}
+	rh, e := ins.History(relPath)
+	if e != nil {
+		return ctx.fail(fmt.Errorf("%s: %s", relPath, e))
+	}
+	history := &historyInfo{
+		ID:        rh.ID.String(),
+		Path:      rh.Path,
+		Deleted:   rh.Deleted,
+		Compacted: rh.Compacted,
+	}
+	for _, event := range rh.Events {
+		info := &eventInfo{
+			Kind:      event.Kind,
+			Path:      event.Path,
+			Directory: event.Directory,
+		}
+		if event.Instance != nil {
+			info.Instance = event.Instance.Name()
+			info.Device = event.Instance.Device
+		}
+		history.Events = append(history.Events, info)
+	}
+	ctx.print(history, func(w io.Writer) {
+		state := ""
+		if history.Deleted {
+			state = " (deleted)"
+		}
+		fmt.Fprintf(w, "%s %s%s\n", history.ID, history.Path, state)
+		if history.Compacted > 0 {
+			fmt.Fprintf(w, "  ... %d older entries\n", history.Compacted)
+		}
+		for _, event := range history.Events {
+			by := ""
+			if event.Instance != "" {
+				by = " by " + event.Instance
+				if event.Device != "" {
+					by += " on " + event.Device
+				}
+			}
+			path := event.Path
+			if event.Directory != "" {
+				path += " (directory moved to " + event.Directory + ")"
+			}
+			fmt.Fprintf(w, "  %-8s %s%s\n", event.Kind, path, by)
+		}
+	})
+	return 0
+}
+
+type trashInfo struct {
+	ID      string    `json:"id"`
+	Deleted time.Time `json:"deleted"`
+	Size    int64     `json:"size"`
+}
+
+func runRestore(ctx *env, args []string) int {
+	if len(args) < 1 {
+		ctx.flags.Usage()
+		return 2
+	}
+	ins, e := adasync.Open(absPath(args[0]))
+	if e != nil {
+		return ctx.fail(e)
+	}
+	if len(args) == 1 {
+		var trash []*trashInfo
+		for _, entry := range ins.Trash() {
+			trash = append(trash, &trashInfo{
+				ID:      entry.ID.String(),
+				Deleted: entry.Deleted,
+				Size:    entry.Size,
+			})
+		}
+		ctx.print(trash, func(w io.Writer) {
+			for _, entry := range trash {
+				fmt.Fprintf(w, "%s  %s  %d bytes\n", entry.ID, entry.Deleted.Format(time.RFC3339), entry.Size)
+			}
+		})
+		return 0
+	}
+	code := 0
+	for _, idStr := range args[1:] {
+		id, e := adasync.DecodeHash(idStr)
+		if e == nil {
+			e = ins.Restore(id)
+		}
+		if e != nil {
+			code = ctx.fail(fmt.Errorf("%s: %s", idStr, e))
+		}
+	}
+	ins.Write()
+	return code
+}
+
+// runDaemon stops on SIGTERM or interrupt after the current action finishes
+// and the state is written.
+func runDaemon(ctx *env, args []string) int {
+	c, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-sigs
+		err.Debug("Received ", sig, ", shutting down")
+		cancel()
 	}()
+	adasync.RunDaemon(c)
+	return 0
+}
+
+type keyInfo struct {
+	Key string `json:"key"`
+}
 
-	for {
-		runChan <- FullScan{}
-		runChan <- SyncAll{}
-		time.Sleep(time.Hour * 2)
+func runKey(ctx *env, args []string) int {
+	key, e := adasync.PeerIdentity()
+	if e != nil {
+		return ctx.fail(e)
+	}
+	info := &keyInfo{
+		Key: adasync.PeerKeyString(key.Public().(ed25519.PublicKey)),
 	}
+	ctx.print(info, func(w io.Writer) {
+		fmt.Fprintln(w, info.Key)
+	})
+	return 0
 }
@@ -19,7 +19,8 @@ func main() {
 	}).Slice()
 	for _, pathStr := range cols {
 		err.Debug("Found: ", pathStr)
-		adasync.Open(pathStr)
+		_, e := adasync.Open(pathStr)
+		err.Log(e)
 	}
 	adasync.SyncAll()
 	err.Debug("Done")